@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- BRACKET MATCHING -----------------
+
+const (
+	openBrackets  = "([{"
+	closeBrackets = ")]}"
+)
+
+// maxBracketScan caps how many lines are searched for a bracket's partner
+const maxBracketScan = 5000
+
+// bracketPair is the bracket at or next to the cursor and its partner, if
+// it has one
+type bracketPair struct {
+	line, col           int
+	matchLine, matchCol int
+	matched             bool
+}
+
+// cursorBrackets finds the bracket under the cursor, or just before it, and
+// its partner; brackets in strings and comments are ignored.
+func (e *Editor) cursorBrackets() (bracketPair, bool) {
+	if e.cursorLine >= len(e.lines) {
+		return bracketPair{}, false
+	}
+	ln := e.lines[e.cursorLine]
+	for _, col := range []int{e.cursorCol, e.cursorCol - 1} {
+		if col < 0 || col >= len(ln) || !strings.ContainsRune(openBrackets+closeBrackets, rune(ln[col])) {
+			continue
+		}
+		if !e.isCode(e.cursorLine, col) {
+			continue
+		}
+		pair := bracketPair{line: e.cursorLine, col: col}
+		pair.matchLine, pair.matchCol, pair.matched = e.matchBracket(e.cursorLine, col)
+		return pair, true
+	}
+	return bracketPair{}, false
+}
+
+// matchBracket finds the partner of the bracket at line, col by counting
+// nesting of the same bracket kind, forwards for an opening bracket and
+// backwards for a closing one.
+func (e *Editor) matchBracket(line, col int) (int, int, bool) {
+	ch := e.lines[line][col]
+	if i := strings.IndexByte(openBrackets, ch); i >= 0 {
+		partner := closeBrackets[i]
+		depth := 0
+		for l := line; l < len(e.lines) && l <= line+maxBracketScan; l++ {
+			text := e.lines[l]
+			start := 0
+			if l == line {
+				start = col
+			}
+			for c := start; c < len(text); c++ {
+				if text[c] != ch && text[c] != partner || !e.isCode(l, c) {
+					continue
+				}
+				if text[c] == ch {
+					depth++
+				} else if depth--; depth == 0 {
+					return l, c, true
+				}
+			}
+		}
+		return 0, 0, false
+	}
+
+	partner := openBrackets[strings.IndexByte(closeBrackets, ch)]
+	depth := 0
+	for l := line; l >= 0 && l >= line-maxBracketScan; l-- {
+		text := e.lines[l]
+		start := len(text) - 1
+		if l == line {
+			start = col
+		}
+		for c := start; c >= 0; c-- {
+			if text[c] != ch && text[c] != partner || !e.isCode(l, c) {
+				continue
+			}
+			if text[c] == ch {
+				depth++
+			} else if depth--; depth == 0 {
+				return l, c, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// isCode reports whether the byte at line, col is outside the string,
+// comment and regex tokens the highlighter found
+func (e *Editor) isCode(line, col int) bool {
+	if line >= len(e.lineTokens) {
+		return true
+	}
+	for _, token := range e.lineTokens[line] {
+		if col < token.Start || col >= token.End {
+			continue
+		}
+		switch token.Type {
+		case TokenString, TokenComment, TokenRegex:
+			return false
+		}
+	}
+	return true
+}
+
+// jumpToMatch moves the cursor to the partner of the bracket under it
+func (e *Editor) jumpToMatch() {
+	pair, ok := e.cursorBrackets()
+	switch {
+	case !ok:
+		e.message = "No bracket at cursor"
+	case !pair.matched:
+		e.message = "Unmatched '" + string(e.lines[pair.line][pair.col]) + "'"
+	default:
+		e.cursorLine, e.cursorCol = pair.matchLine, pair.matchCol
+		e.updateCursorVisualCol()
+		e.adjustScroll()
+	}
+}
+
+// drawBracketMarks highlights the cells of the bracket pair on a drawn line;
+// x is where the line's text starts on screen
+func (e *Editor) drawBracketMarks(pair bracketPair, lineIdx, x, y, maxWidth int) {
+	mark := func(col int) {
+		vis := visualColForByteCol(e.lines[lineIdx], col) - e.horizOffset
+		if vis < 0 || vis >= maxWidth {
+			return
+		}
+		r, comb, cur, _ := e.screen.GetContent(x+vis, y)
+		fg, _, _ := cur.Decompose()
+		style := tcell.StyleDefault.Background(tcell.NewRGBColor(70, 80, 110)).Foreground(fg).Bold(true)
+		if !pair.matched {
+			// Unbalanced - white on dark red like invalid tokens
+			style = e.getTokenStyle(TokenInvalid)
+		}
+		e.screen.SetContent(x+vis, y, r, comb, style)
+	}
+	if lineIdx == pair.line {
+		mark(pair.col)
+	}
+	if pair.matched && lineIdx == pair.matchLine {
+		mark(pair.matchCol)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ----------------- BUILD & ERROR FORMATS -----------------
+
+// ErrorFormat describes how a tool reports problems. Pattern matches a
+// line naming a location, using the named groups file, line, col, severity
+// and message. Tools that spread a report over several lines can also give
+// Before, whose groups fill in the located lines after it until a blank
+// line, and After, which supplies the message for located lines before it.
+type ErrorFormat struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Before  string `json:"before,omitempty"`
+	After   string `json:"after,omitempty"`
+}
+
+// defaultErrorFormats are tried after the user's, in order
+var defaultErrorFormats = []ErrorFormat{
+	{
+		Name:    "rustc",
+		Before:  `^(?P<severity>error|warning)(?:\[\w+\])?: (?P<message>.*)$`,
+		Pattern: `^\s*--> (?P<file>[^:]+):(?P<line>\d+):(?P<col>\d+)$`,
+	},
+	{
+		Name:    "tsc",
+		Pattern: `^(?P<file>[^\s(][^(]*)\((?P<line>\d+),(?P<col>\d+)\): (?P<severity>error|warning) (?P<message>.*)$`,
+	},
+	{
+		Name:    "python",
+		Pattern: `^\s*File "(?P<file>[^"<]+)", line (?P<line>\d+)`,
+		After:   `^(?P<message>\w*(?:Error|Exception|Warning|Interrupt|Exit)\b.*)$`,
+	},
+	{
+		Name:    "eslint",
+		Pattern: `^(?P<file>\S[^:]*): line (?P<line>\d+), col (?P<col>\d+), (?P<severity>Error|Warning) - (?P<message>.*)$`,
+	},
+	{
+		Name:    "eslint-stylish",
+		Before:  `^(?P<file>(?:/|[A-Za-z]:\\)\S+)$`,
+		Pattern: `^\s+(?P<line>\d+):(?P<col>\d+)\s+(?P<severity>error|warning)\s+(?P<message>.*?)(?:\s{2,}[\w/@-]+)?$`,
+	},
+	{
+		Name:    "go vet",
+		Pattern: `^vet: (?P<file>[^:\s]+):(?P<line>\d+):(?:(?P<col>\d+):)?\s*(?P<message>.*)$`,
+	},
+	{
+		Name:    "gcc",
+		Pattern: `^(?P<file>[^:\s]+):(?P<line>\d+):(?:(?P<col>\d+):)?\s*(?:(?P<severity>fatal error|error|warning|note):\s*)?(?P<message>.*)$`,
+	},
+}
+
+// defaultBuildCommands are the shell commands building a project in each
+// language, by grammar name; "{file}" is replaced with the buffer's file
+var defaultBuildCommands = map[string]string{
+	"Go":         "go build ./...",
+	"Rust":       "cargo build",
+	"C":          "make",
+	"CPP":        "make",
+	"TypeScript": "tsc --noEmit",
+	"JavaScript": "eslint {file}",
+	"Python":     "python3 -m py_compile {file}",
+}
+
+// projectConfigName is the optional per-project file holding the build
+// command and extra error formats
+const projectConfigName = ".site.json"
+
+type projectConfig struct {
+	Build        string        `json:"build"`
+	ErrorFormats []ErrorFormat `json:"errorFormats"`
+}
+
+func loadProjectConfig(root string) (projectConfig, error) {
+	var config projectConfig
+	data, err := os.ReadFile(filepath.Join(root, projectConfigName))
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return config, fmt.Errorf("%s: %v", projectConfigName, err)
+	}
+	return config, nil
+}
+
+// compiledErrorFormat is an ErrorFormat with its patterns compiled
+type compiledErrorFormat struct {
+	name                   string
+	pattern, before, after *regexp.Regexp
+}
+
+// compileErrorFormats compiles the project's, the user's and the default
+// formats, in that order
+func compileErrorFormats(project []ErrorFormat) ([]compiledErrorFormat, error) {
+	all := append(append(append([]ErrorFormat(nil), project...), options.ErrorFormats...), defaultErrorFormats...)
+	var compiled []compiledErrorFormat
+	for _, f := range all {
+		c := compiledErrorFormat{name: f.Name}
+		var err error
+		if f.Pattern == "" {
+			return nil, fmt.Errorf("error format %q: no pattern", f.Name)
+		}
+		if c.pattern, err = regexp.Compile(f.Pattern); err != nil {
+			return nil, fmt.Errorf("error format %q: %v", f.Name, err)
+		}
+		if f.Before != "" {
+			if c.before, err = regexp.Compile(f.Before); err != nil {
+				return nil, fmt.Errorf("error format %q: %v", f.Name, err)
+			}
+		}
+		if f.After != "" {
+			if c.after, err = regexp.Compile(f.After); err != nil {
+				return nil, fmt.Errorf("error format %q: %v", f.Name, err)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// submatches returns the named groups re matched in line, or nil
+func submatches(re *regexp.Regexp, line string) map[string]string {
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	groups := map[string]string{}
+	for i, name := range re.SubexpNames() {
+		if name != "" && m[i] != "" {
+			groups[name] = m[i]
+		}
+	}
+	return groups
+}
+
+// parseErrors turns a tool's output into diagnostics; relative file names
+// are taken to be relative to dir
+func parseErrors(output, dir string, formats []compiledErrorFormat) []Diagnostic {
+	var diags []Diagnostic
+	before := make([]map[string]string, len(formats))
+	pending := make([][]int, len(formats)) // diagnostics waiting for an After line
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			for i := range before {
+				before[i] = nil
+			}
+			continue
+		}
+	formats:
+		for i, f := range formats {
+			if f.after != nil && len(pending[i]) > 0 {
+				if groups := submatches(f.after, line); groups != nil {
+					for _, d := range pending[i] {
+						diags[d].Message = groups["message"]
+						if groups["severity"] != "" {
+							diags[d].Severity = severityName(groups["severity"])
+						}
+					}
+					pending[i] = nil
+					break formats
+				}
+			}
+			if f.before != nil {
+				if groups := submatches(f.before, line); groups != nil {
+					before[i] = groups
+					break formats
+				}
+			}
+			groups := submatches(f.pattern, line)
+			if groups == nil {
+				continue
+			}
+			for name, value := range before[i] {
+				if groups[name] == "" {
+					groups[name] = value
+				}
+			}
+			if groups["file"] == "" || groups["line"] == "" {
+				continue
+			}
+			d := Diagnostic{File: groups["file"], Message: groups["message"], Severity: severityName(groups["severity"]), Source: f.name}
+			if !filepath.IsAbs(d.File) {
+				d.File = filepath.Join(dir, d.File)
+			}
+			if n, err := strconv.Atoi(groups["line"]); err == nil {
+				d.Line = n - 1
+			}
+			if n, err := strconv.Atoi(groups["col"]); err == nil {
+				d.Col = n - 1
+			}
+			d.EndLine, d.EndCol = d.Line, d.Col
+			if d.Message == "" && f.after != nil {
+				pending[i] = append(pending[i], len(diags))
+			}
+			diags = append(diags, d)
+			break
+		}
+	}
+	return diags
+}
+
+// buildCommand picks the command to run and the directory to run it in:
+// the command given, the project's .site.json, the user's config, a
+// Makefile at the project root or the language's default, in that order
+func (e *Editor) buildCommand(args []string, useMake bool) (string, string, projectConfig, error) {
+	root := workspaceRoot(e.filename)
+	if e.filename == "" {
+		root, _ = os.Getwd()
+	}
+	config, err := loadProjectConfig(root)
+	if err != nil {
+		return "", root, config, err
+	}
+
+	command, configured := forLanguage(options.BuildCommands, e.format)
+	name := ""
+	if g := grammars.grammar(e.format); g != nil {
+		name = g.Name
+	}
+	switch {
+	case useMake:
+		command = strings.Join(append([]string{"make"}, args...), " ")
+	case len(args) > 0:
+		command = strings.Join(args, " ")
+	case config.Build != "":
+		command = config.Build
+	case configured:
+	default:
+		if _, err := os.Stat(filepath.Join(root, "Makefile")); err == nil {
+			command = "make"
+		} else {
+			command = defaultBuildCommands[name]
+		}
+	}
+	// The command runs at the project root, so the file is named absolutely
+	if strings.Contains(command, "{file}") {
+		file, err := filepath.Abs(e.filename)
+		if err != nil {
+			return "", root, config, err
+		}
+		command = strings.ReplaceAll(command, "{file}", shellQuote(file))
+	}
+	return command, root, config, nil
+}
+
+// shellQuote quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// build runs the build command in the background and collects the
+// problems it reports into the error list
+func (e *Editor) build(args []string, useMake bool) {
+	if e.building {
+		e.message = "A build is already running"
+		return
+	}
+	command, dir, config, err := e.buildCommand(args, useMake)
+	if err != nil {
+		e.message = "Build: " + err.Error()
+		return
+	}
+	if command == "" {
+		e.message = "No build command for " + e.format.String()
+		return
+	}
+	formats, err := compileErrorFormats(config.ErrorFormats)
+	if err != nil {
+		e.message = "Build: " + err.Error()
+		return
+	}
+
+	e.building = true
+	e.message = "Running " + command
+	screen := e.screen
+	go func() {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		diags := parseErrors(string(out), dir, formats)
+		postFuncEvent(screen, func(e *Editor) {
+			e.building = false
+			e.setErrorList(diags)
+			switch {
+			case len(diags) > 0:
+				e.nextError(1)
+			case err != nil:
+				e.message = "Build failed: " + err.Error()
+				if line := firstLine(string(out)); line != "" {
+					e.message += ": " + line
+				}
+			default:
+				e.message = "Build succeeded"
+			}
+		})
+	}()
+}
+
+// nextError moves step places through the error list, wrapping
+// around, and jumps to that problem
+func (e *Editor) nextError(step int) {
+	if len(e.errorList) == 0 {
+		e.message = "No errors"
+		return
+	}
+	n := len(e.errorList)
+	e.errorIndex = ((e.errorIndex+step)%n + n) % n
+	d := e.errorList[e.errorIndex]
+	if !e.visitFile(d.File) {
+		return
+	}
+	e.cursorLine = min(max(d.Line, 0), len(e.lines)-1)
+	e.cursorCol = min(max(d.Col, 0), len(e.lines[e.cursorLine]))
+	e.updateCursorVisualCol()
+	e.adjustScroll()
+	e.message = fmt.Sprintf("(%d/%d) %s:%d: %s: %s", e.errorIndex+1, n, relativePath(d.File), d.Line+1, d.Severity, d.Message)
+}
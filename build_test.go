@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	saved := options.ErrorFormats
+	options.ErrorFormats = nil
+	defer func() { options.ErrorFormats = saved }()
+	formats, err := compileErrorFormats(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diag := func(file string, line, col int, severity, source, message string) Diagnostic {
+		return Diagnostic{File: file, Line: line, Col: col, EndLine: line, EndCol: col, Severity: severity, Source: source, Message: message}
+	}
+	tests := []struct {
+		name   string
+		output string
+		want   []Diagnostic
+	}{
+		{
+			name: "rustc",
+			output: `error[E0425]: cannot find value ` + "`x`" + ` in this scope
+  --> src/main.rs:3:13
+   |
+3  |     println!("{}", x);
+   |                    ^ not found in this scope
+
+warning: unused variable: ` + "`y`" + `
+ --> src/lib.rs:10:9`,
+			want: []Diagnostic{
+				diag("/p/src/main.rs", 2, 12, "error", "rustc", "cannot find value `x` in this scope"),
+				diag("/p/src/lib.rs", 9, 8, "warning", "rustc", "unused variable: `y`"),
+			},
+		},
+		{
+			name:   "tsc",
+			output: "src/app.ts(12,5): error TS2322: Type 'string' is not assignable to type 'number'.",
+			want:   []Diagnostic{diag("/p/src/app.ts", 11, 4, "error", "tsc", "TS2322: Type 'string' is not assignable to type 'number'.")},
+		},
+		{
+			name: "python",
+			output: `Traceback (most recent call last):
+  File "/p/main.py", line 8, in <module>
+    main()
+  File "/p/lib/util.py", line 3, in main
+    return 1 / 0
+ZeroDivisionError: division by zero`,
+			want: []Diagnostic{
+				diag("/p/main.py", 7, 0, "error", "python", "ZeroDivisionError: division by zero"),
+				diag("/p/lib/util.py", 2, 0, "error", "python", "ZeroDivisionError: division by zero"),
+			},
+		},
+		{
+			name:   "eslint",
+			output: "/p/app.js: line 4, col 7, Warning - 'x' is assigned a value but never used. (no-unused-vars)",
+			want:   []Diagnostic{diag("/p/app.js", 3, 6, "warning", "eslint", "'x' is assigned a value but never used. (no-unused-vars)")},
+		},
+		{
+			name: "eslint-stylish",
+			output: `/p/src/app.js
+  4:7   warning  'x' is assigned a value but never used  no-unused-vars
+  9:1   error    Unexpected console statement             no-console
+
+/p/src/other.js
+  1:10  error  Missing semicolon  semi
+
+✖ 3 problems (2 errors, 1 warning)`,
+			want: []Diagnostic{
+				diag("/p/src/app.js", 3, 6, "warning", "eslint-stylish", "'x' is assigned a value but never used"),
+				diag("/p/src/app.js", 8, 0, "error", "eslint-stylish", "Unexpected console statement"),
+				diag("/p/src/other.js", 0, 9, "error", "eslint-stylish", "Missing semicolon"),
+			},
+		},
+		{
+			name:   "go vet",
+			output: "# site\nvet: ./main.go:12:2: unreachable code",
+			want:   []Diagnostic{diag("/p/main.go", 11, 1, "error", "go vet", "unreachable code")},
+		},
+		{
+			name: "gcc",
+			output: `main.c:5:10: fatal error: missing.h: No such file or directory
+util.c:20: warning: implicit declaration of function 'f'
+./pkg/a.go:7:2: undefined: y`,
+			want: []Diagnostic{
+				diag("/p/main.c", 4, 9, "error", "gcc", "missing.h: No such file or directory"),
+				diag("/p/util.c", 19, 0, "warning", "gcc", "implicit declaration of function 'f'"),
+				diag("/p/pkg/a.go", 6, 1, "error", "gcc", "undefined: y"),
+			},
+		},
+		{
+			name:   "no problems",
+			output: "ok  \tsite\t0.1s\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseErrors(tt.output, "/p", formats)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", formatDiags(got), formatDiags(tt.want))
+			}
+		})
+	}
+}
+
+func formatDiags(diags []Diagnostic) string {
+	var lines []string
+	for _, d := range diags {
+		lines = append(lines, fmt.Sprintf("%+v", d))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestCompileErrorFormatsReportsPatterns(t *testing.T) {
+	tests := []struct {
+		format ErrorFormat
+		want   string
+	}{
+		{ErrorFormat{Name: "empty"}, `error format "empty": no pattern`},
+		{ErrorFormat{Name: "bad", Pattern: `(?P<file>`}, "error format \"bad\": error parsing regexp: missing closing ): `(?P<file>`"},
+		{ErrorFormat{Name: "bad before", Pattern: `x`, Before: `[`}, "error format \"bad before\": error parsing regexp: missing closing ]: `[`"},
+	}
+	for _, tt := range tests {
+		_, err := compileErrorFormats([]ErrorFormat{tt.format})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.format.Name, err, tt.want)
+		}
+	}
+}
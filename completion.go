@@ -0,0 +1,372 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- COMPLETION POPUP -----------------
+
+// completionRows is how many candidates the popup shows at once
+const completionRows = 8
+
+// completionScanLines bounds how far from the cursor buffer words are
+// collected, so huge files stay quick to complete in
+const completionScanLines = 5000
+
+// completionItem is a candidate for the word being typed
+type completionItem struct {
+	text string
+	kind string // where it came from, shown beside it: word, keyword, ...
+}
+
+// completionProvider offers candidates for the word before the cursor;
+// prefix is the part of it already typed. Providers are asked in order and
+// the first to offer a word names its kind.
+type completionProvider interface {
+	completions(e *Editor, prefix string) []completionItem
+}
+
+var completionProviders = []completionProvider{keywordCompletions{}, snippetCompletions{}, bufferWordCompletions{}}
+
+// registerCompletionProvider adds a source of candidates after the
+// built-in ones, unless it's already there
+func registerCompletionProvider(p completionProvider) {
+	for _, q := range completionProviders {
+		if q == p {
+			return
+		}
+	}
+	completionProviders = append(completionProviders, p)
+}
+
+// keywordCompletions offers the active highlighter's keywords, which
+// include builtins for languages such as SQU1D++
+type keywordCompletions struct{}
+
+func (keywordCompletions) completions(e *Editor, prefix string) []completionItem {
+	if e.highlighter == nil {
+		return nil
+	}
+	var items []completionItem
+	for keyword := range e.highlighter.keywords {
+		items = append(items, completionItem{text: keyword, kind: "keyword"})
+	}
+	return items
+}
+
+// bufferWordCompletions offers the words in the buffer
+type bufferWordCompletions struct{}
+
+func (bufferWordCompletions) completions(e *Editor, prefix string) []completionItem {
+	seen := map[string]bool{}
+	var items []completionItem
+	from := max(e.cursorLine-completionScanLines, 0)
+	to := min(e.cursorLine+completionScanLines, len(e.lines))
+	for i := from; i < to; i++ {
+		line := e.lines[i]
+		for start := 0; start < len(line); {
+			if !isWordByte(line[start]) {
+				start++
+				continue
+			}
+			end := start
+			for end < len(line) && isWordByte(line[end]) {
+				end++
+			}
+			word := line[start:end]
+			// The word being typed isn't a candidate for itself
+			typing := i == e.cursorLine && end == e.cursorCol
+			if !typing && !seen[word] && (word[0] < '0' || word[0] > '9') {
+				seen[word] = true
+				items = append(items, completionItem{text: word, kind: "word"})
+			}
+			start = end
+		}
+	}
+	return items
+}
+
+// completionMatch is a ranked candidate and which of its bytes matched
+type completionMatch struct {
+	completionItem
+	score   int
+	matched []int
+}
+
+// suggestions is the completion popup, listing the candidates for the word
+// from start to the cursor
+type suggestions struct {
+	line, start int
+	matches     []completionMatch
+	selected    int
+	scroll      int
+	moved       bool // the selection was moved, so Enter accepts it
+}
+
+// fuzzyMatch checks that pattern's characters appear in order in text,
+// ignoring case, and scores how well: consecutive characters, word starts
+// and an exact prefix count for it, extra length against it
+func fuzzyMatch(pattern, text string) (int, []int, bool) {
+	score := 0
+	matched := make([]int, 0, len(pattern))
+	ti := 0
+	for pi := 0; pi < len(pattern); pi++ {
+		p := unicode.ToLower(rune(pattern[pi]))
+		found := false
+		for ; ti < len(text); ti++ {
+			if unicode.ToLower(rune(text[ti])) != p {
+				continue
+			}
+			switch {
+			case ti == 0:
+				score += 8
+			case len(matched) > 0 && matched[len(matched)-1] == ti-1:
+				score += 5
+			case text[ti-1] == '_' || unicode.IsLower(rune(text[ti-1])) && unicode.IsUpper(rune(text[ti])):
+				score += 4
+			}
+			if text[ti] == pattern[pi] {
+				score++
+			}
+			matched = append(matched, ti)
+			ti++
+			found = true
+			break
+		}
+		if !found {
+			return 0, nil, false
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(text), strings.ToLower(pattern)) {
+		score += 10
+	}
+	return score - len(text)/4, matched, true
+}
+
+// wordBeforeCursor returns where the word ending at the cursor starts
+func (e *Editor) wordBeforeCursor() (int, string) {
+	line := e.lines[e.cursorLine]
+	start := min(e.cursorCol, len(line))
+	for start > 0 && isWordByte(line[start-1]) {
+		start--
+	}
+	return start, line[start:min(e.cursorCol, len(line))]
+}
+
+// openCompletion shows the candidates for the word before the cursor;
+// asked for explicitly it also reports when there are none
+func (e *Editor) openCompletion(requested bool) {
+	start, prefix := e.wordBeforeCursor()
+	defer func() { e.fetchLSPCompletions(start, e.completion == nil) }()
+	seen := map[string]bool{}
+	var matches []completionMatch
+	for _, p := range completionProviders {
+		for _, item := range p.completions(e, prefix) {
+			if seen[item.text] || item.text == prefix {
+				continue
+			}
+			seen[item.text] = true
+			if prefix == "" {
+				matches = append(matches, completionMatch{completionItem: item})
+			} else if score, matched, ok := fuzzyMatch(prefix, item.text); ok {
+				matches = append(matches, completionMatch{completionItem: item, score: score, matched: matched})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		e.completion = nil
+		if requested {
+			e.message = "No completions"
+		}
+		return
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].text < matches[j].text
+	})
+	e.completion = &suggestions{line: e.cursorLine, start: start, matches: matches}
+}
+
+// reopenCompletion refreshes the popup for the word from start on line
+// when new candidates arrive, if the cursor is still in that word and the
+// popup is open or found nothing before
+func (e *Editor) reopenCompletion(line, start int, wasEmpty bool) {
+	if e.mode != Interactive || e.cursorLine != line {
+		return
+	}
+	if at, _ := e.wordBeforeCursor(); at != start {
+		return
+	}
+	if c := e.completion; c != nil && c.line == line && c.start == start || c == nil && wasEmpty {
+		selected := ""
+		if c != nil && c.moved {
+			selected = c.matches[c.selected].text
+		}
+		e.openCompletion(false)
+		if c := e.completion; c != nil && selected != "" {
+			for i, m := range c.matches {
+				if m.text == selected {
+					c.selected, c.moved = i, true
+				}
+			}
+		}
+	}
+}
+
+// handleCompletionKey handles the keys the open popup takes over, and
+// reports whether the key was one of them. Tab accepts the selected
+// candidate, and so does Enter once Up or Down has picked one.
+func (e *Editor) handleCompletionKey(key *tcell.EventKey) bool {
+	c := e.completion
+	switch key.Key() {
+	case tcell.KeyEsc:
+		e.completion = nil
+	case tcell.KeyUp, tcell.KeyCtrlP:
+		c.selected = (c.selected - 1 + len(c.matches)) % len(c.matches)
+		c.moved = true
+	case tcell.KeyDown, tcell.KeyCtrlN:
+		c.selected = (c.selected + 1) % len(c.matches)
+		c.moved = true
+	case tcell.KeyPgUp:
+		c.selected = max(c.selected-completionRows, 0)
+		c.moved = true
+	case tcell.KeyPgDn:
+		c.selected = min(c.selected+completionRows, len(c.matches)-1)
+		c.moved = true
+	case tcell.KeyTab:
+		e.acceptCompletionItem(c.matches[c.selected].completionItem)
+	case tcell.KeyEnter:
+		// Enter only accepts a pick, so it still ends lines while words are
+		// being typed with the popup open
+		if !c.moved {
+			return false
+		}
+		e.acceptCompletionItem(c.matches[c.selected].completionItem)
+	default:
+		return false
+	}
+	return true
+}
+
+// acceptCompletionItem replaces the word before the cursor with the
+// item, expanding it if it's a snippet's trigger
+func (e *Editor) acceptCompletionItem(item completionItem) {
+	c := e.completion
+	e.completion = nil
+	line := e.lines[e.cursorLine]
+	if c.line != e.cursorLine || c.start > e.cursorCol {
+		return
+	}
+	e.recordUndo(undoStep)
+	e.lines[e.cursorLine] = line[:c.start] + item.text + line[e.cursorCol:]
+	e.cursorCol = c.start + len(item.text)
+	e.dirty = true
+	e.updateLineTokens(e.cursorLine)
+	e.updateCursorVisualCol()
+	if item.kind == "snippet" {
+		e.expandSnippet()
+	}
+}
+
+// completeAfterKey keeps the popup in step with what was typed: typing a
+// word refilters it, or opens it once the word is long enough, and any
+// other key closes it
+func (e *Editor) completeAfterKey(key *tcell.EventKey) {
+	if e.mode != Interactive {
+		e.completion = nil
+		return
+	}
+	start, prefix := e.wordBeforeCursor()
+	switch key.Key() {
+	case tcell.KeyCtrlSpace:
+		return
+	case tcell.KeyRune:
+		r := key.Rune()
+		if r >= utf8.RuneSelf || !isWordByte(byte(r)) {
+			e.completion = nil
+			return
+		}
+		if e.completion != nil || options.AutoComplete > 0 && len(prefix) >= options.AutoComplete {
+			e.openCompletion(false)
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if c := e.completion; c != nil {
+			if c.line != e.cursorLine || start != c.start || prefix == "" {
+				e.completion = nil
+				return
+			}
+			e.openCompletion(false)
+		}
+	default:
+		e.completion = nil
+	}
+}
+
+// drawCompletion draws the popup under the word being completed, or over
+// it when there's no room below. x and y are where the cursor is on screen
+// and the buffer takes rows top to bottom.
+func (e *Editor) drawCompletion(x, y, top, bottom, w int) {
+	c := e.completion
+	if c == nil || c.line != e.cursorLine {
+		return
+	}
+	// Line the candidates up with the word, after the popup's left margin
+	x -= visualColForByteCol(e.lines[c.line], e.cursorCol) - visualColForByteCol(e.lines[c.line], c.start) + 1
+	rows := min(len(c.matches), completionRows)
+	textWidth, kindWidth := 0, 0
+	for _, m := range c.matches {
+		textWidth = max(textWidth, utf8.RuneCountInString(m.text))
+		kindWidth = max(kindWidth, len(m.kind))
+	}
+	width := min(textWidth+kindWidth+3, w-1)
+	x = max(min(x, w-1-width), 0)
+	first := y + 1
+	if first+rows > bottom && y-rows >= top {
+		first = y - rows
+	}
+	rows = min(rows, bottom-first)
+
+	if c.selected < c.scroll {
+		c.scroll = c.selected
+	}
+	if c.selected >= c.scroll+rows {
+		c.scroll = c.selected - rows + 1
+	}
+	for i := 0; i < rows && c.scroll+i < len(c.matches); i++ {
+		idx := c.scroll + i
+		m := c.matches[idx]
+		bg := tcell.NewRGBColor(35, 42, 58)
+		if idx == c.selected {
+			bg = tcell.NewRGBColor(70, 80, 110)
+		}
+		style := tcell.StyleDefault.Background(bg).Foreground(tcell.NewRGBColor(210, 215, 225))
+		matchStyle := style.Foreground(tcell.NewRGBColor(110, 190, 255)).Bold(true)
+		kindStyle := style.Foreground(tcell.NewRGBColor(130, 140, 160))
+		for col := 0; col < width; col++ {
+			e.screen.SetContent(x+col, first+i, ' ', nil, style)
+		}
+		col, mi := 1, 0
+		for bi, r := range m.text {
+			if col >= width-kindWidth-1 {
+				break
+			}
+			s := style
+			if mi < len(m.matched) && m.matched[mi] == bi {
+				s = matchStyle
+				mi++
+			}
+			e.screen.SetContent(x+col, first+i, r, nil, s)
+			col++
+		}
+		for j, r := range m.kind {
+			e.screen.SetContent(x+width-1-len(m.kind)+j, first+i, r, nil, kindStyle)
+		}
+	}
+}
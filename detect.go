@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ----------------- CONTENT DETECTION -----------------
+
+var (
+	vimModelinePattern   = regexp.MustCompile(`(?:^|\s)(?:vi|vim|Vim|ex)(?:[<=>]?\d+)?:\s*(?:se(?:t)?\s+)?(.*)`)
+	vimFiletypePattern   = regexp.MustCompile(`(?:^|[\s:])(?:ft|filetype|syn|syntax)=([\w+#.-]+)`)
+	emacsModelinePattern = regexp.MustCompile(`-\*-\s*(.*?)\s*-\*-`)
+	emacsModePattern     = regexp.MustCompile(`(?i)(?:^|;)\s*mode:\s*([\w+#.-]+)`)
+	xmlTagPattern        = regexp.MustCompile(`^<([A-Za-z_][\w:.-]*)[\s>/]`)
+	jsonStartPattern     = regexp.MustCompile(`^[\[{]\s*(?:"|[\[{\]}]|-?\d|true\b|false\b|null\b|$)`)
+)
+
+// modelineScanLines is how many lines at each end of a file Vim checks for a modeline
+const modelineScanLines = 5
+
+// sniffLimit caps how much of a buffer is validated when sniffing JSON
+const sniffLimit = 1 << 20
+
+// detectFileFormat works out a file's format. An explicit Vim or Emacs
+// modeline wins, then the name or extension (of the symlink's target too),
+// then the interpreter on a #! line and finally a sniff of the content.
+func detectFileFormat(filename string, lines []string) FileFormat {
+	if format, ok := formatFromModeline(lines); ok {
+		return format
+	}
+
+	if format := grammars.formatForFile(filename); format != PlainText {
+		return format
+	}
+	if target, err := filepath.EvalSymlinks(filename); err == nil && target != filename {
+		if format := grammars.formatForFile(target); format != PlainText {
+			return format
+		}
+	}
+
+	if format, ok := formatFromShebang(lines); ok {
+		return format
+	}
+
+	return sniffFormat(lines)
+}
+
+// formatFromModeline looks for "vim: set ft=python:" style modelines in the
+// first and last lines and an Emacs "-*- mode: python -*-" on the first two.
+func formatFromModeline(lines []string) (FileFormat, bool) {
+	for i, line := range lines {
+		if i >= modelineScanLines && i < len(lines)-modelineScanLines {
+			continue
+		}
+		if m := vimModelinePattern.FindStringSubmatch(line); m != nil {
+			if ft := vimFiletypePattern.FindStringSubmatch(m[1]); ft != nil {
+				if format, ok := grammars.lookup(ft[1]); ok {
+					return format, true
+				}
+			}
+		}
+		if i < 2 {
+			if m := emacsModelinePattern.FindStringSubmatch(line); m != nil {
+				mode := m[1]
+				if strings.Contains(mode, ":") {
+					mode = ""
+					if mm := emacsModePattern.FindStringSubmatch(m[1]); mm != nil {
+						mode = mm[1]
+					}
+				}
+				mode = strings.TrimSuffix(strings.ToLower(mode), "-mode")
+				if format, ok := grammars.lookup(mode); ok {
+					return format, true
+				}
+			}
+		}
+	}
+	return PlainText, false
+}
+
+// formatFromShebang maps the interpreter named on a #! line, looking
+// through /usr/bin/env and its flags, to a format.
+func formatFromShebang(lines []string) (FileFormat, bool) {
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "#!") {
+		return PlainText, false
+	}
+	fields := strings.Fields(lines[0][2:])
+	if len(fields) == 0 {
+		return PlainText, false
+	}
+
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "-") || strings.Contains(field, "=") {
+				continue
+			}
+			interpreter = filepath.Base(field)
+			break
+		}
+	}
+	return grammars.formatForInterpreter(interpreter)
+}
+
+// sniffFormat recognises JSON, HTML and XML from the start of the content
+func sniffFormat(lines []string) FileFormat {
+	first := ""
+	for _, line := range lines {
+		if trimmed := strings.TrimSpace(strings.TrimPrefix(line, "\ufeff")); trimmed != "" {
+			first = trimmed
+			break
+		}
+	}
+	if first == "" {
+		return PlainText
+	}
+	lower := strings.ToLower(first)
+
+	switch {
+	case strings.HasPrefix(lower, "<!doctype html"), strings.HasPrefix(lower, "<html"):
+		return HTML
+	case strings.HasPrefix(lower, "<?xml"):
+		// XHTML documents start with an XML declaration too
+		for i := 0; i < len(lines) && i < modelineScanLines; i++ {
+			l := strings.ToLower(lines[i])
+			if strings.Contains(l, "<!doctype html") || strings.Contains(l, "<html") {
+				return HTML
+			}
+		}
+		return XML
+	case strings.HasPrefix(first, "<"):
+		if m := xmlTagPattern.FindStringSubmatch(first); m != nil {
+			if g := grammars.grammar(HTML); g != nil {
+				for _, tag := range g.Keywords {
+					if strings.EqualFold(tag, m[1]) {
+						return HTML
+					}
+				}
+			}
+			return XML
+		}
+	case strings.HasPrefix(first, "{"), strings.HasPrefix(first, "["):
+		content := strings.Join(lines, "\n")
+		if len(content) <= sniffLimit {
+			if json.Valid([]byte(content)) {
+				return JSON
+			}
+		} else if jsonStartPattern.MatchString(first) {
+			return JSON
+		}
+	}
+	return PlainText
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- DIAGNOSTICS -----------------
+
+// Diagnostic is a problem reported by a build, a test run or a language
+// server. Positions are 0-based byte offsets; the end is exclusive and the
+// same as the start when the tool only gave a point.
+type Diagnostic struct {
+	File            string
+	Line, Col       int
+	EndLine, EndCol int
+	Severity        string // error, warning, info or hint
+	Source          string // the tool that reported it
+	Message         string
+}
+
+// severityName maps the severities tools print onto the four we show
+func severityName(severity string) string {
+	switch s := strings.ToLower(severity); s {
+	case "warning", "warn":
+		return "warning"
+	case "info", "information", "note":
+		return "info"
+	case "hint":
+		return "hint"
+	}
+	return "error"
+}
+
+// severityLevel ranks a severity, the most severe first
+func severityLevel(severity string) int {
+	switch severity {
+	case "warning":
+		return 1
+	case "info":
+		return 2
+	case "hint":
+		return 3
+	}
+	return 0
+}
+
+// severityLabel is the status line prefix for a severity
+func severityLabel(severity string) string {
+	switch severity {
+	case "warning":
+		return "Warning: "
+	case "info":
+		return "Info: "
+	case "hint":
+		return "Hint: "
+	}
+	return "Error: "
+}
+
+// severityColor is the theme's color for a severity
+func severityColor(severity string) tcell.Color {
+	t := options.Theme
+	switch severity {
+	case "warning":
+		return themeColor(t.DiagnosticWarning, tcell.NewRGBColor(230, 190, 80))
+	case "info":
+		return themeColor(t.DiagnosticInfo, tcell.NewRGBColor(150, 180, 230))
+	case "hint":
+		return themeColor(t.DiagnosticHint, tcell.NewRGBColor(130, 140, 160))
+	}
+	return themeColor(t.DiagnosticError, tcell.NewRGBColor(240, 90, 90))
+}
+
+// setErrorList replaces the problems next-error walks through, usually the
+// output of a build or a test run
+func (e *Editor) setErrorList(diags []Diagnostic) {
+	e.trackDiagnostics()
+	e.errorList = diags
+	e.errorIndex = -1
+	e.refreshDiagnostics()
+}
+
+// refreshDiagnostics gathers the buffer's diagnostics from the error list
+// and the language server, in order of position
+func (e *Editor) refreshDiagnostics() {
+	var diags []Diagnostic
+	for _, d := range e.errorList {
+		if sameFile(d.File, e.filename) {
+			diags = append(diags, d)
+		}
+	}
+	if e.lsp != nil {
+		diags = append(diags, e.lsp.diagnostics...)
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Col < diags[j].Col
+	})
+	e.diagnostics = diags
+}
+
+// diagnosticAt returns the most severe diagnostic covering a line
+func (e *Editor) diagnosticAt(line int) (Diagnostic, bool) {
+	var found Diagnostic
+	ok := false
+	for _, d := range e.diagnostics {
+		if d.Line > line {
+			break
+		}
+		if line > max(d.EndLine, d.Line) {
+			continue
+		}
+		if !ok || severityLevel(d.Severity) < severityLevel(found.Severity) {
+			found, ok = d, true
+		}
+	}
+	return found, ok
+}
+
+// drawDiagnosticMark marks a line with problems in the gutter column at x
+func (e *Editor) drawDiagnosticMark(lineIdx, x, y int) {
+	if d, ok := e.diagnosticAt(lineIdx); ok {
+		style := tcell.StyleDefault.Background(editorBackground).Foreground(severityColor(d.Severity))
+		e.screen.SetContent(x, y, '●', nil, style)
+	}
+}
+
+// drawDiagnostics underlines the problems on a drawn line and, with
+// InlineDiagnostics on, writes the first one's message after the text
+func (e *Editor) drawDiagnostics(lineIdx, x, y, maxWidth int) {
+	line := e.lines[lineIdx]
+	var first *Diagnostic
+	for i := range e.diagnostics {
+		d := &e.diagnostics[i]
+		if d.Line > lineIdx {
+			break
+		}
+		endLine := max(d.EndLine, d.Line)
+		if lineIdx > endLine {
+			continue
+		}
+		from, to := 0, len(line)
+		if lineIdx == d.Line {
+			from = min(d.Col, len(line))
+		}
+		if lineIdx == endLine && (d.EndLine > d.Line || d.EndCol > d.Col) {
+			to = min(d.EndCol, len(line))
+		} else if lineIdx == endLine {
+			// A point: underline the word there
+			for to = from; to < len(line) && isWordByte(line[to]); to++ {
+			}
+		}
+		start := visualColForByteCol(line, from)
+		end := max(visualColForByteCol(line, to), start+1)
+		e.underline(x, y, start, end, maxWidth, severityColor(d.Severity))
+
+		if lineIdx == d.Line && (first == nil || severityLevel(d.Severity) < severityLevel(first.Severity)) {
+			first = d
+		}
+	}
+	if first == nil || !options.InlineDiagnostics {
+		return
+	}
+	col := visualColForByteCol(line, len(line)) + 2 - e.horizOffset
+	style := tcell.StyleDefault.Background(editorBackground).Foreground(severityColor(first.Severity)).Italic(true)
+	for _, r := range "● " + firstLine(first.Message) {
+		if col >= maxWidth {
+			break
+		}
+		if col >= 0 {
+			e.screen.SetContent(x+col, y, r, nil, style)
+		}
+		col++
+	}
+}
+
+// underline underlines the visual columns [start, end) of a drawn line
+func (e *Editor) underline(x, y, start, end, maxWidth int, color tcell.Color) {
+	for vis := max(start-e.horizOffset, 0); vis < end-e.horizOffset && vis < maxWidth; vis++ {
+		r, comb, style, _ := e.screen.GetContent(x+vis, y)
+		e.screen.SetContent(x+vis, y, r, comb, style.Underline(tcell.UnderlineStyleCurly, color))
+	}
+}
+
+// drawDiagnosticTicks marks where the buffer's problems are on the scroll
+// bar, which runs from top for height rows in column x
+func (e *Editor) drawDiagnosticTicks(x, top, height int) {
+	rows := map[int]string{}
+	for _, d := range e.diagnostics {
+		// Diagnostics can trail the buffer until they're refreshed
+		line := min(d.Line, len(e.lines)-1)
+		row := int(float64(line) / float64(max(1, len(e.lines)-1)) * float64(height-1))
+		if s, ok := rows[row]; !ok || severityLevel(d.Severity) < severityLevel(s) {
+			rows[row] = d.Severity
+		}
+	}
+	for row, severity := range rows {
+		style := tcell.StyleDefault.Background(editorBackground).Foreground(severityColor(severity))
+		e.screen.SetContent(x, top+row, '■', nil, style)
+	}
+}
+
+// diagnosticsPanel lists the buffer's diagnostics, then the rest of the
+// error list
+func (e *Editor) diagnosticsPanel() *panel {
+	p := &panel{title: "Diagnostics"}
+	add := func(d Diagnostic) {
+		text := fmt.Sprintf("%s:%d:%d: %s: %s", relativePath(d.File), d.Line+1, d.Col+1, d.Severity, firstLine(d.Message))
+		if d.Source != "" {
+			text += " [" + d.Source + "]"
+		}
+		p.items = append(p.items, panelItem{text: text, kind: d.Severity, file: d.File, line: d.Line, col: d.Col})
+	}
+	for _, d := range e.diagnostics {
+		add(d)
+	}
+	for _, d := range e.errorList {
+		if !sameFile(d.File, e.filename) {
+			add(d)
+		}
+	}
+	return p
+}
+
+// diagnosticsCommand shows the diagnostics panel
+func (e *Editor) diagnosticsCommand() {
+	p := e.diagnosticsPanel()
+	if len(p.items) == 0 {
+		e.message = "No diagnostics"
+		return
+	}
+	e.showPanel(p)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ----------------- FORMATTERS -----------------
+
+// formatter rewrites a buffer's source; filename helps tools pick a style
+type formatter func(src, filename string) (string, error)
+
+// builtinFormatters need no external tool
+var builtinFormatters = map[FileFormat]formatter{
+	Go:   func(src, _ string) (string, error) { return formatSourceGo(src) },
+	JSON: func(src, _ string) (string, error) { return formatJSON(src) },
+}
+
+// defaultFormatters are the commands buffers are piped through, by grammar
+// name. "{file}" is replaced with the buffer's file name. config.json's
+// formatters add to or replace them, and replace the built-in ones too.
+var defaultFormatters = map[string][]string{
+	"Python":     {"black", "--quiet", "-"},
+	"Rust":       {"rustfmt", "--emit", "stdout"},
+	"C":          {"clang-format", "--assume-filename={file}"},
+	"CPP":        {"clang-format", "--assume-filename={file}"},
+	"Java":       {"clang-format", "--assume-filename={file}"},
+	"JavaScript": {"prettier", "--stdin-filepath", "{file}"},
+	"TypeScript": {"prettier", "--stdin-filepath", "{file}"},
+	"CSS":        {"prettier", "--stdin-filepath", "{file}"},
+	"HTML":       {"prettier", "--stdin-filepath", "{file}"},
+	"Markdown":   {"prettier", "--stdin-filepath", "{file}"},
+	"YAML":       {"prettier", "--stdin-filepath", "{file}"},
+	"Shell":      {"shfmt", "--filename", "{file}"},
+}
+
+// formatterFor returns how to format a format's buffers, if it can be
+func formatterFor(format FileFormat) (formatter, bool) {
+	if command, ok := forLanguage(options.Formatters, format); ok {
+		return commandFormatter(command), len(command) > 0
+	}
+	if builtin, ok := builtinFormatters[format]; ok {
+		return builtin, true
+	}
+	if g := grammars.grammar(format); g != nil {
+		if command := defaultFormatters[g.Name]; len(command) > 0 {
+			return commandFormatter(command), true
+		}
+	}
+	return nil, false
+}
+
+// commandFormatter pipes the source through command's stdin and stdout,
+// giving up after the configured timeout, or the default one if that isn't
+// positive
+func commandFormatter(command []string) formatter {
+	seconds := options.FormatTimeout
+	if seconds <= 0 {
+		seconds = defaultOptions.FormatTimeout
+	}
+	timeout := time.Duration(seconds) * time.Second
+	return func(src, filename string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		args := make([]string, len(command))
+		for i, arg := range command {
+			args[i] = strings.ReplaceAll(arg, "{file}", filename)
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		if filename != "" {
+			cmd.Dir = filepath.Dir(filename)
+		}
+		var stdout, stderr bytes.Buffer
+		cmd.Stdin = strings.NewReader(src)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+		err := cmd.Run()
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			return "", fmt.Errorf("%s timed out after %v", args[0], timeout)
+		case err != nil:
+			if msg := firstLine(stderr.String()); msg != "" {
+				return "", fmt.Errorf("%s: %s", args[0], msg)
+			}
+			return "", err
+		case stdout.Len() == 0 && len(src) > 0:
+			return "", errors.New(args[0] + " printed nothing")
+		}
+		return stdout.String(), nil
+	}
+}
+
+// firstLine returns the first non-blank line of s
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// ----------------- CURSOR MAPPING -----------------
+
+// maxDiffCells bounds the table used to match lines between two versions
+const maxDiffCells = 1 << 21
+
+// mapPosition finds where a position in old ended up in lines. Unchanged
+// lines map straight across; inside a changed stretch the position keeps
+// its count of non-blank characters from the stretch's start, since
+// formatters mostly move whitespace around.
+func mapPosition(old, lines []string, line, col int) (int, int) {
+	prefix := 0
+	for prefix < len(old) && prefix < len(lines) && old[prefix] == lines[prefix] {
+		prefix++
+	}
+	if line < prefix {
+		return line, col
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(lines)-prefix && old[len(old)-1-suffix] == lines[len(lines)-1-suffix] {
+		suffix++
+	}
+	if line >= len(old)-suffix {
+		return line - len(old) + len(lines), col
+	}
+
+	// Find the stretch around the line between lines both versions share
+	a, b := old[prefix:len(old)-suffix], lines[prefix:len(lines)-suffix]
+	i := line - prefix
+	fromA, fromB, toB := 0, 0, len(b)
+	for _, m := range matchLines(a, b) {
+		if m[0] == i {
+			return prefix + m[1], col
+		}
+		if m[0] < i {
+			fromA, fromB = m[0]+1, m[1]+1
+		} else {
+			toB = m[1]
+			break
+		}
+	}
+	if fromB >= toB {
+		// The stretch was deleted
+		return prefix + fromB, 0
+	}
+
+	n := 0
+	for l := fromA; l <= i; l++ {
+		text := a[l]
+		if l == i {
+			text = text[:min(col, len(text))]
+		}
+		n += countNonSpace(text)
+	}
+	for l := fromB; l < toB; l++ {
+		for c, r := range b[l] {
+			if unicode.IsSpace(r) {
+				continue
+			}
+			if n == 0 {
+				return prefix + l, c
+			}
+			n--
+		}
+	}
+	return prefix + toB - 1, len(b[toB-1])
+}
+
+func countNonSpace(s string) int {
+	n := 0
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// matchLines returns the index pairs of a longest common subsequence of
+// lines, or nothing when the versions are too big to compare
+func matchLines(a, b []string) [][2]int {
+	if len(a) == 0 || len(b) == 0 || len(a)*len(b) > maxDiffCells {
+		return nil
+	}
+	w := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*w)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			} else {
+				lcs[i*w+j] = max32(lcs[(i+1)*w+j], lcs[i*w+j+1])
+			}
+		}
+	}
+	var pairs [][2]int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			pairs = append(pairs, [2]int{i, j})
+			i++
+			j++
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return pairs
+}
+
+func max32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
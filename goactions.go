@@ -0,0 +1,647 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ----------------- GO IMPORTS -----------------
+
+// goStdPackages indexes the standard library's packages by name, built
+// the first time an import is looked for
+var goStdPackages map[string][]string
+
+// goPackageExports caches the exported names of the standard library's
+// packages, by directory; the module's are read afresh as they change
+var goPackageExports = map[string]map[string]bool{}
+
+// goImportsMu guards goStdPackages and goPackageExports, as imports are
+// organized in the background
+var goImportsMu sync.Mutex
+
+// stdPackages returns the standard library packages with a name
+func stdPackages(name string) []string {
+	goImportsMu.Lock()
+	defer goImportsMu.Unlock()
+	if goStdPackages == nil {
+		goStdPackages = map[string][]string{}
+		src := filepath.Join(build.Default.GOROOT, "src")
+		filepath.WalkDir(src, func(dir string, d os.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			base := d.Name()
+			if base == "internal" || base == "vendor" || base == "testdata" || dir == filepath.Join(src, "cmd") {
+				return filepath.SkipDir
+			}
+			if dir == src {
+				return nil
+			}
+			importPath := filepath.ToSlash(strings.TrimPrefix(dir, src+string(filepath.Separator)))
+			if pkg := goPackageName(dir); pkg != "" {
+				goStdPackages[pkg] = append(goStdPackages[pkg], importPath)
+			}
+			return nil
+		})
+	}
+	return goStdPackages[name]
+}
+
+// goPackageName reads the package name from a directory's Go files,
+// leaving out tests and commands
+func goPackageName(dir string) string {
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if match, err := build.Default.MatchFile(dir, name); err != nil || !match {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, name), nil, parser.PackageClauseOnly)
+		if err == nil && f.Name.Name != "main" && f.Name.Name != "documentation" {
+			return f.Name.Name
+		}
+	}
+	return ""
+}
+
+// goExports returns the names a package directory exports
+func goExports(dir string) map[string]bool {
+	std := strings.HasPrefix(dir, filepath.Join(build.Default.GOROOT, "src")+string(filepath.Separator))
+	if std {
+		goImportsMu.Lock()
+		names, ok := goPackageExports[dir]
+		goImportsMu.Unlock()
+		if ok {
+			return names
+		}
+	}
+	names := map[string]bool{}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if match, err := build.Default.MatchFile(dir, name); err != nil || !match {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		for name := range topLevelNames(f) {
+			if token.IsExported(name) {
+				names[name] = true
+			}
+		}
+	}
+	if std {
+		goImportsMu.Lock()
+		goPackageExports[dir] = names
+		goImportsMu.Unlock()
+	}
+	return names
+}
+
+// topLevelNames lists the package-level names a file declares
+func topLevelNames(f *ast.File) map[string]bool {
+	names := map[string]bool{}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				names[d.Name.Name] = true
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					names[s.Name.Name] = true
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						names[name.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// modulePackages maps the names of a module's packages to their import
+// paths and directories
+func modulePackages(root, module string) map[string][][2]string {
+	packages := map[string][][2]string{}
+	filepath.WalkDir(root, func(dir string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if dir != root {
+			base := d.Name()
+			if strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") || base == "testdata" || base == "vendor" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		if pkg := goPackageName(dir); pkg != "" {
+			rel, _ := filepath.Rel(root, dir)
+			importPath := module
+			if rel != "." {
+				importPath = module + "/" + filepath.ToSlash(rel)
+			}
+			packages[pkg] = append(packages[pkg], [2]string{importPath, dir})
+		}
+		return nil
+	})
+	return packages
+}
+
+// importName is the name an import spec brings into the file
+func importName(spec *ast.ImportSpec, dir string) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	importPath, _ := strconv.Unquote(spec.Path.Value)
+	if pkg, err := build.Default.Import(importPath, dir, 0); err == nil && pkg.Name != "" {
+		return pkg.Name
+	}
+	// Guess the way go-foo and foo/v2 are usually named
+	name := path.Base(importPath)
+	if len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = path.Base(path.Dir(importPath))
+	}
+	name = strings.TrimPrefix(strings.TrimSuffix(name, ".go"), "go-")
+	return strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// organizeGoImports removes a file's unused imports and adds those it
+// refers to and are missing, looking for them in the standard library
+// and in the module. It returns the formatted source, how many imports were
+// added and removed, and the names no package was found for.
+func organizeGoImports(src, filename string) (string, int, int, []string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	dir := filepath.Dir(filename)
+
+	// Names used as package qualifiers, with what's selected from them
+	qualifiers := map[string]map[string]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil {
+				if qualifiers[x.Name] == nil {
+					qualifiers[x.Name] = map[string]bool{}
+				}
+				qualifiers[x.Name][sel.Sel.Name] = true
+			}
+		}
+		return true
+	})
+
+	// Unused imports go, whole lines at a time
+	lines := strings.Split(src, "\n")
+	deleted := map[int]bool{}
+	imported := map[string]bool{}
+	removed := 0
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.IMPORT {
+			continue
+		}
+		kept := 0
+		for _, spec := range d.Specs {
+			s := spec.(*ast.ImportSpec)
+			name := importName(s, dir)
+			if name == "_" || name == "." || s.Path.Value == `"C"` || qualifiers[name] != nil {
+				imported[name] = true
+				kept++
+				continue
+			}
+			from, to := fset.Position(s.Pos()).Line, fset.Position(s.End()).Line
+			if s.Doc != nil {
+				from = fset.Position(s.Doc.Pos()).Line
+			}
+			for l := from; l <= to; l++ {
+				deleted[l-1] = true
+			}
+			removed++
+		}
+		if kept == 0 {
+			from := fset.Position(d.Pos()).Line
+			if d.Doc != nil {
+				from = fset.Position(d.Doc.Pos()).Line
+			}
+			for l := from; l <= fset.Position(d.End()).Line; l++ {
+				deleted[l-1] = true
+			}
+		}
+	}
+
+	// Missing ones are found by the names selected from them
+	var std, local, unresolved []string
+	var siblings map[string]bool
+	var moduleIndex map[string][][2]string
+	names := make([]string, 0, len(qualifiers))
+	for name := range qualifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if imported[name] || types.Universe.Lookup(name) != nil {
+			continue
+		}
+		if siblings == nil {
+			siblings = packageNames(dir, filename, f.Name.Name)
+		}
+		if siblings[name] {
+			continue
+		}
+		if moduleIndex == nil {
+			moduleIndex = map[string][][2]string{}
+			if root, module, ok := goModule(dir); ok && module != "" {
+				moduleIndex = modulePackages(root, module)
+			}
+		}
+		// The module's candidates come first, then the standard library's
+		var candidates [][2]string
+		for _, c := range moduleIndex[name] {
+			if c[1] != dir {
+				candidates = append(candidates, c)
+			}
+		}
+		inModule := len(candidates)
+		for _, p := range stdPackages(name) {
+			candidates = append(candidates, [2]string{p, filepath.Join(build.Default.GOROOT, "src", filepath.FromSlash(p))})
+		}
+		found := -1
+		for i, c := range candidates {
+			exports := goExports(c[1])
+			all := true
+			for sel := range qualifiers[name] {
+				all = all && exports[sel]
+			}
+			if all && (found < 0 || len(c[0]) < len(candidates[found][0])) {
+				found = i
+			}
+		}
+		switch {
+		case found < 0:
+			unresolved = append(unresolved, name)
+		case found < inModule:
+			local = append(local, candidates[found][0])
+		default:
+			std = append(std, candidates[found][0])
+		}
+	}
+
+	// Standard library imports go first in the file's import group, the
+	// module's in a group of their own at its end
+	specs := func(paths []string) []string {
+		var specs []string
+		for _, p := range paths {
+			specs = append(specs, "\t"+strconv.Quote(p))
+		}
+		return specs
+	}
+	group := specs(std)
+	if len(std) > 0 && len(local) > 0 {
+		group = append(group, "")
+	}
+	group = append(group, specs(local)...)
+	var kept *ast.GenDecl
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT && !deleted[fset.Position(d.Pos()).Line-1] {
+			kept = d
+			break
+		}
+	}
+	var out []string
+	for i, line := range lines {
+		if deleted[i] {
+			continue
+		}
+		switch {
+		case len(group) == 0:
+			out = append(out, line)
+		case kept == nil:
+			out = append(out, line)
+			if i == fset.Position(f.Name.End()).Line-1 {
+				out = append(out, "", "import (")
+				out = append(out, group...)
+				out = append(out, ")")
+			}
+		case !kept.Lparen.IsValid() && i == fset.Position(kept.Pos()).Line-1:
+			out = append(out, "import (", "\t"+strings.TrimSpace(strings.TrimPrefix(line, "import")))
+			out = append(out, group...)
+			out = append(out, ")")
+		case kept.Lparen.IsValid() && i == fset.Position(kept.Lparen).Line-1:
+			out = append(out, line)
+			out = append(out, specs(std)...)
+		case kept.Lparen.IsValid() && i == fset.Position(kept.Rparen).Line-1 && len(local) > 0:
+			out = append(out, "")
+			out = append(out, specs(local)...)
+			out = append(out, line)
+		default:
+			out = append(out, line)
+		}
+	}
+	formatted, err := format.Source([]byte(strings.Join(out, "\n")))
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	return string(formatted), len(std) + len(local), removed, unresolved, nil
+}
+
+// packageNames lists the package-level names the other files of a file's
+// package declare
+func packageNames(dir, filename, pkg string) map[string]bool {
+	names := map[string]bool{}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		file := filepath.Join(dir, entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(file, ".go") || file == filename {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.SkipObjectResolution)
+		if err != nil || f.Name.Name != pkg {
+			continue
+		}
+		for name := range topLevelNames(f) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// importsCommand organizes the buffer's imports in the background, as
+// looking for packages reads the module and the standard library
+func (e *Editor) importsCommand() {
+	if e.format != Go {
+		e.message = "imports only works on Go files"
+		return
+	}
+	file := e.filename
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	filename, src := e.filename, strings.Join(e.lines, "\n")
+	e.message = "Imports: looking for packages"
+
+	screen := e.screen
+	go func() {
+		out, added, removed, unresolved, err := organizeGoImports(src, file)
+		postFuncEvent(screen, func(e *Editor) {
+			if e.filename != filename || strings.Join(e.lines, "\n") != src {
+				e.message = "Imports: the buffer changed, run imports again"
+				return
+			}
+			if err != nil {
+				e.showFormatError(err)
+				return
+			}
+			if added+removed > 0 {
+				e.replaceBuffer(out)
+			}
+			e.message = fmt.Sprintf("Imports: %d added, %d removed", added, removed)
+			if len(unresolved) > 0 {
+				e.message += "; no package found for " + strings.Join(unresolved, ", ")
+			}
+		})
+	}()
+}
+
+// ----------------- GO TEST SKELETONS -----------------
+
+// genTestCommand writes a table-driven test for the function under the
+// cursor into the file's _test.go file, creating it if need be
+func (e *Editor) genTestCommand() {
+	if e.format != Go || e.filename == "" || strings.HasSuffix(e.filename, "_test.go") {
+		e.message = "gen-test works on a saved Go file that isn't a test"
+		return
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, e.filename, strings.Join(e.lines, "\n"), parser.SkipObjectResolution)
+	if err != nil {
+		e.showFormatError(err)
+		return
+	}
+	var fn *ast.FuncDecl
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && fset.Position(d.Pos()).Line-1 <= e.cursorLine && e.cursorLine <= fset.Position(d.End()).Line-1 {
+			fn = d
+		}
+	}
+	switch {
+	case fn == nil:
+		e.message = "The cursor isn't in a function"
+		return
+	case fn.Type.TypeParams != nil || genericReceiver(fn):
+		e.message = "Can't generate tests for generic functions"
+		return
+	case fn.Recv == nil && fn.Name.Name == "init":
+		e.message = "init functions can't be called from a test"
+		return
+	}
+
+	testFile := strings.TrimSuffix(e.filename, ".go") + "_test.go"
+	name, body := goTestSkeleton(fn)
+	e.message = "gen-test: writing " + name
+
+	// Organizing the test file's imports can read the whole standard library
+	screen, pkg := e.screen, f.Name.Name
+	go func() {
+		err := writeGoTest(testFile, pkg, name, body)
+		postFuncEvent(screen, func(e *Editor) {
+			if err != nil {
+				e.message = err.Error()
+				return
+			}
+			e.message = "Wrote " + name + " to " + filepath.Base(testFile)
+			if e.dirty {
+				return
+			}
+			e.pushJump()
+			if e.visitFile(testFile) {
+				for i, line := range e.lines {
+					if strings.HasPrefix(line, "func "+name+"(") {
+						e.jumpTo(testFile, i, 5)
+						break
+					}
+				}
+				e.message = "Wrote " + name
+			}
+		})
+	}()
+}
+
+// writeGoTest adds a test to the internal test file of package pkg,
+// creating it if need be, and organizes its imports
+func writeGoTest(testFile, pkg, name, body string) error {
+	src := "package " + pkg + "\n"
+	if data, err := os.ReadFile(testFile); err == nil {
+		src = string(data)
+		if f, err := parser.ParseFile(token.NewFileSet(), testFile, data, parser.PackageClauseOnly); err == nil && strings.HasSuffix(f.Name.Name, "_test") {
+			return errors.New(filepath.Base(testFile) + " is an external test package; gen-test only extends internal tests")
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.New("gen-test: " + err.Error())
+	}
+	if strings.Contains(src, "\nfunc "+name+"(") {
+		return errors.New(name + " already exists in " + filepath.Base(testFile))
+	}
+	src = strings.TrimRight(src, "\n") + "\n\n" + body
+	abs, err := filepath.Abs(testFile)
+	if err == nil {
+		src, _, _, _, err = organizeGoImports(src, abs)
+	}
+	if err == nil {
+		err = os.WriteFile(testFile, []byte(src), 0644)
+	}
+	if err != nil {
+		return errors.New("gen-test: " + err.Error())
+	}
+	return nil
+}
+
+// genericReceiver reports whether fn is a method of a generic type, whose
+// type parameters a test can't name
+func genericReceiver(fn *ast.FuncDecl) bool {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return false
+	}
+	recv := fn.Recv.List[0].Type
+	for {
+		switch t := recv.(type) {
+		case *ast.StarExpr:
+			recv = t.X
+		case *ast.ParenExpr:
+			recv = t.X
+		case *ast.IndexExpr, *ast.IndexListExpr:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// goTestSkeleton writes a table-driven test for a function or method,
+// returning its name and its source. The arguments are gathered in an
+// args struct so they can't collide with the table's own fields.
+func goTestSkeleton(fn *ast.FuncDecl) (string, string) {
+	expr := func(e ast.Expr) string {
+		var b strings.Builder
+		format.Node(&b, token.NewFileSet(), e)
+		return b.String()
+	}
+	name, call := fn.Name.Name, fn.Name.Name
+	var fields []string
+	if fn.Recv != nil && len(fn.Recv.List) > 0 {
+		recv := fn.Recv.List[0].Type
+		name = receiverType(recv) + "_" + name
+		call = "tt.receiver." + fn.Name.Name
+		fields = append(fields, "receiver "+expr(recv))
+	}
+	testName := "Test" + name
+	if r, _ := utf8.DecodeRuneInString(name); !unicode.IsUpper(r) {
+		testName = "Test_" + name
+	}
+
+	var params, args []string
+	for _, field := range fn.Type.Params.List {
+		names := field.Names
+		if len(names) == 0 {
+			names = []*ast.Ident{nil}
+		}
+		for _, id := range names {
+			param := fmt.Sprintf("arg%d", len(params))
+			if id != nil && id.Name != "_" {
+				param = id.Name
+			}
+			typ, arg := field.Type, "tt.args."+param
+			if ellipsis, ok := typ.(*ast.Ellipsis); ok {
+				typ, arg = &ast.ArrayType{Elt: ellipsis.Elt}, arg+"..."
+			}
+			params = append(params, param+" "+expr(typ))
+			args = append(args, arg)
+		}
+	}
+	if len(params) > 0 {
+		fields = append(fields, "args args")
+	}
+
+	var results, checks []string
+	returnsErr := false
+	if fn.Type.Results != nil {
+		var types []ast.Expr
+		for _, field := range fn.Type.Results.List {
+			for range max(len(field.Names), 1) {
+				types = append(types, field.Type)
+			}
+		}
+		if n := len(types); n > 0 && expr(types[n-1]) == "error" {
+			types, returnsErr = types[:n-1], true
+		}
+		for i, typ := range types {
+			got, want := "got", "want"
+			if i > 0 {
+				got, want = fmt.Sprintf("got%d", i), fmt.Sprintf("want%d", i)
+			}
+			fields = append(fields, want+" "+expr(typ))
+			results = append(results, got)
+			checks = append(checks, fmt.Sprintf("\t\t\tif !reflect.DeepEqual(%s, tt.%s) {\n\t\t\t\tt.Errorf(\"%s() %s = %%v, want %%v\", %s, tt.%s)\n\t\t\t}\n", got, want, fn.Name.Name, got, got, want))
+		}
+		if returnsErr {
+			fields = append(fields, "wantErr bool")
+			results = append(results, "err")
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "func %s(t *testing.T) {\n", testName)
+	if len(params) > 0 {
+		fmt.Fprintf(&b, "\ttype args struct {\n\t\t%s\n\t}\n", strings.Join(params, "\n\t\t"))
+	}
+	fmt.Fprintf(&b, "\ttests := []struct {\n\t\tname string\n")
+	for _, field := range fields {
+		fmt.Fprintf(&b, "\t\t%s\n", field)
+	}
+	b.WriteString("\t}{\n\t\t// TODO: add test cases.\n\t}\n")
+	b.WriteString("\tfor _, tt := range tests {\n\t\tt.Run(tt.name, func(t *testing.T) {\n\t\t\t")
+	if len(results) > 0 {
+		b.WriteString(strings.Join(results, ", ") + " := ")
+	}
+	fmt.Fprintf(&b, "%s(%s)\n", call, strings.Join(args, ", "))
+	if returnsErr {
+		fmt.Fprintf(&b, "\t\t\tif (err != nil) != tt.wantErr {\n\t\t\t\tt.Fatalf(\"%s() error = %%v, wantErr %%v\", err, tt.wantErr)\n\t\t\t}\n", fn.Name.Name)
+	}
+	b.WriteString(strings.Join(checks, ""))
+	b.WriteString("\t\t})\n\t}\n}\n")
+	return testName, b.String()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"testing"
+)
+
+// TestOrganizeGoImportsDotlessModule checks that a module whose path has
+// no dot still gets its packages grouped after the standard library's
+func TestOrganizeGoImportsDotlessModule(t *testing.T) {
+	root := writeModule(t, map[string]string{
+		"go.mod":       "module site\n\ngo 1.21\n",
+		"util/util.go": "package util\n\nfunc Reverse(s string) string { return s }\n",
+	})
+	src := "package main\n\nfunc main() {\n\tprintln(strings.ToUpper(util.Reverse(\"x\")))\n}\n"
+	out, added, removed, unresolved, err := organizeGoImports(src, filepath.Join(root, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package main\n\nimport (\n\t\"strings\"\n\n\t\"site/util\"\n)\n\nfunc main() {\n\tprintln(strings.ToUpper(util.Reverse(\"x\")))\n}\n"
+	if out != want || added != 2 || removed != 0 || len(unresolved) != 0 {
+		t.Errorf("got %d added, %d removed, unresolved %q:\n%s\nwant:\n%s", added, removed, unresolved, out, want)
+	}
+}
+
+func TestGenericReceiver(t *testing.T) {
+	src := `package p
+
+type Stack[T any] struct{ items []T }
+type Pair[K comparable, V any] struct{}
+type Plain struct{}
+
+func (s *Stack[T]) Push(v T) {}
+func (p Pair[K, V]) Key() K   { var k K; return k }
+func (p *Plain) Do()         {}
+func Free()                  {}
+`
+	f, err := parser.ParseFile(token.NewFileSet(), "p.go", src, parser.SkipObjectResolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"Push": true, "Key": true, "Do": false, "Free": false}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			if got := genericReceiver(fn); got != want[fn.Name.Name] {
+				t.Errorf("genericReceiver(%s) = %v, want %v", fn.Name.Name, got, want[fn.Name.Name])
+			}
+		}
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- GO NAVIGATION -----------------
+
+// goNavigator answers definition, reference and signature queries about Go
+// code without a language server, by type-checking the module from source.
+// The standard library comes from the source importer, which keeps what
+// it has loaded, so only the first query pays for it. The module's files
+// are kept parsed too, and parsed again only when they change.
+type goNavigator struct {
+	mu    sync.Mutex
+	fset  *token.FileSet
+	std   types.ImporterFrom
+	files map[string]*goParsedFile
+}
+
+// goParsedFile is a module file as parsed, from disk or from the buffer
+type goParsedFile struct {
+	modTime time.Time
+	size    int64
+	text    string // the buffer's text, when it came from the buffer
+	buffer  bool
+	f       *ast.File
+}
+
+// goNavigators are kept by module root
+var goNavigators = map[string]*goNavigator{}
+
+func newGoNavigator() *goNavigator {
+	fset := token.NewFileSet()
+	return &goNavigator{fset: fset, std: importer.ForCompiler(fset, "source", nil).(types.ImporterFrom), files: map[string]*goParsedFile{}}
+}
+
+// goUnit is a set of files type-checked together: a package, the package
+// with its in-package tests, or its external test package
+type goUnit struct {
+	path      string
+	dir       string
+	files     []*ast.File
+	filenames []string
+	pkg       *types.Package
+	info      *types.Info
+	checking  bool
+	checked   bool
+}
+
+// goLoad is the module as type-checked for one query
+type goLoad struct {
+	nav        *goNavigator
+	units      []*goUnit
+	importable map[string]*goUnit // the units other packages import, by path
+	sources    map[string][]string
+	parsed     map[string]bool // the files this load used
+}
+
+// goNavQuery is what a query knows about the buffer
+type goNavQuery struct {
+	file      string
+	lines     []string
+	line, col int
+}
+
+// goNavRequest type-checks the buffer's module in the background and hands
+// the result to answer, whose returned function runs on the editor
+func (e *Editor) goNavRequest(what string, answer func(l *goLoad, q goNavQuery) func(*Editor)) {
+	if e.filename == "" {
+		e.message = "Save the buffer first"
+		return
+	}
+	file, err := filepath.Abs(e.filename)
+	if err != nil {
+		e.message = what + ": " + err.Error()
+		return
+	}
+	root, module, ok := goModule(filepath.Dir(file))
+	if !ok {
+		root, module = filepath.Dir(file), ""
+	}
+	nav := goNavigators[root]
+	if nav == nil {
+		nav = newGoNavigator()
+		goNavigators[root] = nav
+	}
+	q := goNavQuery{file: file, lines: append([]string(nil), e.lines...), line: e.cursorLine, col: e.cursorCol}
+	e.message = what + ": loading packages"
+
+	screen := e.screen
+	go func() {
+		nav.mu.Lock()
+		l := nav.load(root, module, ok, q)
+		apply := answer(l, q)
+		nav.mu.Unlock()
+		postFuncEvent(screen, apply)
+	}()
+}
+
+// load parses the module's packages, with the buffer's text in place of
+// its file, and type-checks them all. Packages that don't build still give
+// what could be made of them.
+func (n *goNavigator) load(root, module string, isModule bool, q goNavQuery) *goLoad {
+	l := &goLoad{nav: n, importable: map[string]*goUnit{}, sources: map[string][]string{q.file: q.lines}, parsed: map[string]bool{}}
+	var dirs []string
+	if isModule {
+		filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			name := d.Name()
+			if path != root {
+				if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" {
+					return filepath.SkipDir
+				}
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					return filepath.SkipDir // another module
+				}
+			}
+			dirs = append(dirs, path)
+			return nil
+		})
+	} else {
+		dirs = []string{root}
+	}
+
+	for _, dir := range dirs {
+		path := module
+		if rel, _ := filepath.Rel(root, dir); rel != "." {
+			path = strings.TrimPrefix(module+"/"+filepath.ToSlash(rel), "/")
+		}
+		if path == "" {
+			path = "main"
+		}
+		l.addDir(dir, path)
+	}
+	// Files that are gone are forgotten
+	for filename, p := range n.files {
+		if !l.parsed[filename] {
+			n.forget(p)
+			delete(n.files, filename)
+		}
+	}
+	for _, u := range l.units {
+		l.check(u)
+	}
+	return l
+}
+
+// parse returns a file's syntax tree, parsing it again only if it changed
+// since the last load. The old tree's file leaves the FileSet, so repeated
+// queries don't pile up copies of the module.
+func (n *goNavigator) parse(filename string, text *string) *ast.File {
+	p := n.files[filename]
+	var info os.FileInfo
+	if text != nil {
+		if p != nil && p.buffer && p.text == *text {
+			return p.f
+		}
+	} else {
+		var err error
+		if info, err = os.Stat(filename); err != nil {
+			return nil
+		}
+		if p != nil && !p.buffer && p.modTime.Equal(info.ModTime()) && p.size == info.Size() {
+			return p.f
+		}
+	}
+	if p != nil {
+		n.forget(p)
+		delete(n.files, filename)
+	}
+
+	var src any
+	if text != nil {
+		src = *text
+	}
+	f, _ := parser.ParseFile(n.fset, filename, src, parser.ParseComments|parser.SkipObjectResolution)
+	if f == nil {
+		return nil
+	}
+	p = &goParsedFile{f: f, buffer: text != nil}
+	if text != nil {
+		p.text = *text
+	} else {
+		p.modTime, p.size = info.ModTime(), info.Size()
+	}
+	n.files[filename] = p
+	return f
+}
+
+// forget removes a parsed file's positions from the FileSet
+func (n *goNavigator) forget(p *goParsedFile) {
+	if tf := n.fset.File(p.f.FileStart); tf != nil {
+		n.fset.RemoveFile(tf)
+	}
+}
+
+// addDir parses a directory's Go files into up to three units: the
+// package, the package with its tests, and the external test package
+func (l *goLoad) addDir(dir, path string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	pkg := &goUnit{path: path, dir: dir}
+	withTests := &goUnit{path: path, dir: dir}
+	xtest := &goUnit{path: path + "_test", dir: dir}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		if match, err := build.Default.MatchFile(dir, name); err != nil || !match {
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		var text *string
+		if lines, ok := l.sources[filename]; ok {
+			joined := strings.Join(lines, "\n")
+			text = &joined
+		}
+		f := l.nav.parse(filename, text)
+		if f == nil {
+			continue
+		}
+		l.parsed[filename] = true
+		switch {
+		case !strings.HasSuffix(name, "_test.go"):
+			pkg.add(f, filename)
+			withTests.add(f, filename)
+		case strings.HasSuffix(f.Name.Name, "_test"):
+			xtest.add(f, filename)
+		default:
+			withTests.add(f, filename)
+		}
+	}
+	if len(pkg.files) > 0 {
+		l.units = append(l.units, pkg)
+		l.importable[path] = pkg
+	}
+	for _, u := range []*goUnit{withTests, xtest} {
+		if len(u.files) > len(pkg.files) || u == xtest && len(u.files) > 0 {
+			l.units = append(l.units, u)
+		}
+	}
+}
+
+func (u *goUnit) add(f *ast.File, filename string) {
+	u.files = append(u.files, f)
+	u.filenames = append(u.filenames, filename)
+}
+
+// check type-checks a unit, first checking the module packages it imports
+func (l *goLoad) check(u *goUnit) (*types.Package, error) {
+	if u.checked {
+		return u.pkg, nil
+	}
+	if u.checking {
+		return nil, fmt.Errorf("import cycle through %s", u.path)
+	}
+	u.checking = true
+	u.info = &types.Info{
+		Defs: map[*ast.Ident]types.Object{},
+		Uses: map[*ast.Ident]types.Object{},
+	}
+	conf := types.Config{
+		Importer:    (*goImporter)(l),
+		Error:       func(error) {}, // keep going past errors
+		FakeImportC: true,
+	}
+	u.pkg, _ = conf.Check(u.path, l.nav.fset, u.files, u.info)
+	u.checking, u.checked = false, true
+	return u.pkg, nil
+}
+
+// goImporter imports the module's packages from the load and anything
+// else through the source importer
+type goImporter goLoad
+
+func (imp *goImporter) Import(path string) (*types.Package, error) {
+	return imp.ImportFrom(path, "", 0)
+}
+
+func (imp *goImporter) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	l := (*goLoad)(imp)
+	if u := l.importable[path]; u != nil {
+		return l.check(u)
+	}
+	return l.nav.std.ImportFrom(path, dir, mode)
+}
+
+// identAt finds the identifier at the query's cursor, with the unit its
+// file was checked in. A test file is looked up in its test unit.
+func (l *goLoad) identAt(q goNavQuery) (*ast.Ident, *goUnit) {
+	for i := len(l.units) - 1; i >= 0; i-- {
+		u := l.units[i]
+		for fi, filename := range u.filenames {
+			if filename != q.file {
+				continue
+			}
+			f := u.files[fi]
+			tf := l.nav.fset.File(f.Pos())
+			if tf == nil || q.line >= tf.LineCount() {
+				return nil, nil
+			}
+			pos := tf.LineStart(q.line+1) + token.Pos(q.col)
+			var found *ast.Ident
+			ast.Inspect(f, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok && id.Pos() <= pos && pos <= id.End() {
+					found = id
+				}
+				return found == nil
+			})
+			return found, u
+		}
+	}
+	return nil, nil
+}
+
+// objectAt returns what the identifier at the cursor refers to
+func (l *goLoad) objectAt(q goNavQuery) (types.Object, *goUnit, string) {
+	id, u := l.identAt(q)
+	if id == nil {
+		return nil, nil, "No identifier under the cursor"
+	}
+	obj := u.info.Uses[id]
+	if obj == nil {
+		obj = u.info.Defs[id]
+	}
+	if obj == nil {
+		return nil, nil, "Nothing known about " + id.Name
+	}
+	return obj, u, ""
+}
+
+// objectKey identifies an object by where it's declared, so the same
+// declaration seen through different units is the same object
+func (l *goLoad) objectKey(obj types.Object) string {
+	switch o := obj.(type) {
+	case *types.Var:
+		obj = o.Origin()
+	case *types.Func:
+		obj = o.Origin()
+	}
+	if !obj.Pos().IsValid() {
+		return "builtin " + obj.Name()
+	}
+	p := l.nav.fset.Position(obj.Pos())
+	return fmt.Sprintf("%s:%d:%s", p.Filename, p.Offset, obj.Name())
+}
+
+// lines returns a file's lines, read once per load
+func (l *goLoad) lines(file string) []string {
+	if lines, ok := l.sources[file]; ok {
+		return lines
+	}
+	data, _ := os.ReadFile(file)
+	lines := strings.Split(string(data), "\n")
+	l.sources[file] = lines
+	return lines
+}
+
+// goDefinition jumps to the declaration of the identifier at the cursor
+func (e *Editor) goDefinition() {
+	e.goNavRequest("Definition", func(l *goLoad, q goNavQuery) func(*Editor) {
+		obj, _, problem := l.objectAt(q)
+		if obj == nil {
+			return func(e *Editor) { e.message = problem }
+		}
+		if !obj.Pos().IsValid() {
+			return func(e *Editor) { e.message = obj.Name() + " is built in" }
+		}
+		p := l.nav.fset.Position(obj.Pos())
+		return func(e *Editor) {
+			e.message = ""
+			e.pushJump()
+			e.jumpTo(p.Filename, p.Line-1, p.Column-1)
+		}
+	})
+}
+
+// goRef is an identifier referring to an object, and a unit it was
+// checked in
+type goRef struct {
+	id   *ast.Ident
+	unit *goUnit
+	pos  token.Position
+}
+
+// references finds the identifiers declaring or using obj across the
+// module, in order of position. A type's references include the
+// selectors of fields embedding it.
+func (l *goLoad) references(obj types.Object) []goRef {
+	keys := map[string]bool{l.objectKey(obj): true}
+	seen := map[*ast.Ident]bool{}
+	var refs []goRef
+	collect := func() {
+		for _, u := range l.units {
+			for _, uses := range []map[*ast.Ident]types.Object{u.info.Defs, u.info.Uses} {
+				for id, o := range uses {
+					if o == nil || seen[id] || !keys[l.objectKey(o)] {
+						continue
+					}
+					seen[id] = true
+					refs = append(refs, goRef{id: id, unit: u, pos: l.nav.fset.Position(id.Pos())})
+				}
+			}
+		}
+	}
+	collect()
+	if _, ok := obj.(*types.TypeName); ok {
+		// Fields embedding the type are declared by one of its references
+		embedded := false
+		for _, u := range l.units {
+			for id, o := range u.info.Defs {
+				if v, ok := o.(*types.Var); ok && v.Embedded() && seen[id] {
+					keys[l.objectKey(v)] = true
+					embedded = true
+				}
+			}
+		}
+		if embedded {
+			collect()
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := refs[i].pos, refs[j].pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	return refs
+}
+
+// goReferences lists every use of the identifier at the cursor across the
+// module, its declaration included
+func (e *Editor) goReferences() {
+	e.goNavRequest("References", func(l *goLoad, q goNavQuery) func(*Editor) {
+		obj, _, problem := l.objectAt(q)
+		if obj == nil {
+			return func(e *Editor) { e.message = problem }
+		}
+		refs := l.references(obj)
+		p := &panel{title: "References to " + obj.Name()}
+		for _, ref := range refs {
+			r := ref.pos
+			text := ""
+			if lines := l.lines(r.Filename); r.Line-1 < len(lines) {
+				text = strings.TrimSpace(lines[r.Line-1])
+			}
+			item := panelItem{text: fmt.Sprintf("%s:%d: %s", relativePath(r.Filename), r.Line, text), file: r.Filename, line: r.Line - 1, col: r.Column - 1}
+			if item.line == q.line && r.Filename == q.file && item.col <= q.col && q.col <= item.col+len(obj.Name()) {
+				p.selected = len(p.items)
+			}
+			p.items = append(p.items, item)
+		}
+		return func(e *Editor) {
+			if len(p.items) == 0 {
+				e.message = "No references to " + obj.Name()
+				return
+			}
+			e.message = fmt.Sprintf("%d reference(s) to %s", len(p.items), obj.Name())
+			e.showPanel(p)
+		}
+	})
+}
+
+// goSignature shows the type of the identifier at the cursor, and the
+// start of its documentation, in a popup
+func (e *Editor) goSignature() {
+	e.goNavRequest("Signature", func(l *goLoad, q goNavQuery) func(*Editor) {
+		obj, u, problem := l.objectAt(q)
+		if obj == nil {
+			return func(e *Editor) { e.message = problem }
+		}
+		popup := []string{types.ObjectString(obj, types.RelativeTo(u.pkg))}
+		if obj.Pos().IsValid() {
+			p := l.nav.fset.Position(obj.Pos())
+			popup = append(popup, goDoc(p.Filename, l.lines(p.Filename), p.Line)...)
+		}
+		return func(e *Editor) {
+			e.message = ""
+			e.popup = popup
+		}
+	})
+}
+
+// goDocLines bounds how much of a declaration's documentation is shown
+const goDocLines = 6
+
+// goDoc returns the first lines of the comment above the declaration
+// naming something on line (1-based), or above its group when a type,
+// const or var has none of its own
+func goDoc(filename string, lines []string, line int) []string {
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, filename, strings.Join(lines, "\n"), parser.ParseComments|parser.SkipObjectResolution)
+	if f == nil {
+		return nil
+	}
+	named := func(names ...*ast.Ident) bool {
+		for _, name := range names {
+			if fset.Position(name.Pos()).Line == line {
+				return true
+			}
+		}
+		return false
+	}
+	var doc, group *ast.CommentGroup
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if found || n == nil || fset.Position(n.Pos()).Line > line || fset.Position(n.End()).Line < line {
+			return false
+		}
+		switch d := n.(type) {
+		case *ast.GenDecl:
+			group = d.Doc
+		case *ast.FuncDecl:
+			found, doc = named(d.Name), d.Doc
+		case *ast.TypeSpec:
+			found, doc = named(d.Name), d.Doc
+			if doc == nil {
+				doc = group
+			}
+		case *ast.ValueSpec:
+			found, doc = named(d.Names...), d.Doc
+			if doc == nil {
+				doc = group
+			}
+		case *ast.Field:
+			found, doc = named(d.Names...), d.Doc
+		}
+		return !found
+	})
+	if !found || doc == nil {
+		return nil
+	}
+	var out []string
+	for _, text := range strings.Split(strings.TrimSpace(doc.Text()), "\n") {
+		if len(out) == goDocLines {
+			out = append(out, "…")
+			break
+		}
+		out = append(out, text)
+	}
+	return out
+}
+
+// ----------------- POPUP -----------------
+
+// drawPopup draws the popup lines in a box under the cursor, or over it
+// when there's no room below. x and y are where the cursor is on screen
+// and the buffer takes rows top to bottom.
+func (e *Editor) drawPopup(x, y, top, bottom, w int) {
+	if len(e.popup) == 0 || e.mode != Interactive {
+		return
+	}
+	width := 0
+	for _, line := range e.popup {
+		width = max(width, len([]rune(line))+2)
+	}
+	width = min(width, w-1)
+	rows := len(e.popup)
+	x = max(min(x, w-1-width), 0)
+	first := y + 1
+	if first+rows > bottom && y-rows >= top {
+		first = y - rows
+	}
+	rows = min(rows, bottom-first)
+	style := tcell.StyleDefault.Background(tcell.NewRGBColor(35, 42, 58)).Foreground(tcell.NewRGBColor(210, 215, 225))
+	for i := 0; i < rows; i++ {
+		s := style
+		if i == 0 {
+			s = s.Foreground(tcell.NewRGBColor(110, 190, 255))
+		}
+		for col := 0; col < width; col++ {
+			e.screen.SetContent(x+col, first+i, ' ', nil, s)
+		}
+		col := 1
+		for _, r := range e.popup[i] {
+			if col >= width-1 {
+				break
+			}
+			e.screen.SetContent(x+col, first+i, r, nil, s)
+			col++
+		}
+	}
+}
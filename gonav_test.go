@@ -0,0 +1,74 @@
+package main
+
+import (
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeModule writes files, by slash-separated path, into a new module,
+// named example.com/m unless they include a go.mod, and returns its root
+func writeModule(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	if _, ok := files["go.mod"]; !ok {
+		files["go.mod"] = "module example.com/m\n\ngo 1.21\n"
+	}
+	for name, text := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// TestGoNavigatorReparsesOnlyChanges loads a module repeatedly and checks
+// the FileSet holds one copy of each file, with edits on disk and in the
+// buffer seen and deleted files dropped
+func TestGoNavigatorReparsesOnlyChanges(t *testing.T) {
+	root := writeModule(t, map[string]string{
+		"a.go":      "package m\n\nfunc A() int { return B() }\n",
+		"b.go":      "package m\n\nfunc B() int { return 1 }\n",
+		"util/u.go": "package util\n\nfunc U() {}\n",
+	})
+	a := filepath.Join(root, "a.go")
+	n := newGoNavigator()
+	query := func(text string) (*goLoad, int) {
+		l := n.load(root, "example.com/m", true, goNavQuery{file: a, lines: strings.Split(text, "\n")})
+		count := 0
+		n.fset.Iterate(func(tf *token.File) bool {
+			if strings.HasPrefix(tf.Name(), root) {
+				count++
+			}
+			return true
+		})
+		return l, count
+	}
+
+	l1, count := query("package m\n\nfunc A() int { return B() }\n")
+	if count != 3 {
+		t.Fatalf("the FileSet holds %d module file(s), want 3", count)
+	}
+	l2, count := query("package m\n\nfunc A() int { return B() }\n")
+	if count != 3 || l1.units[0].files[0] != l2.units[0].files[0] {
+		t.Errorf("an unchanged module was parsed again: %d file(s)", count)
+	}
+
+	os.WriteFile(filepath.Join(root, "b.go"), []byte("package m\n\nfunc B() int { return 2 }\n\nfunc C() {}\n"), 0644)
+	os.Remove(filepath.Join(root, "util", "u.go"))
+	l3, count := query("package m\n\nfunc A() int { C(); return B() }\n")
+	if count != 2 {
+		t.Errorf("after an edit and a delete the FileSet holds %d module file(s), want 2", count)
+	}
+	if scope := l3.importable["example.com/m"].pkg.Scope(); scope.Lookup("C") == nil {
+		t.Error("the edit to b.go wasn't seen")
+	}
+	if l3.importable["example.com/m/util"] != nil {
+		t.Error("the deleted package is still loaded")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ----------------- GO RENAME -----------------
+
+// goRename renames the object under the cursor throughout the module. It
+// refuses when the new name would clash with or shadow another, or change
+// what some identifier refers to; otherwise it previews the changed lines
+// in the panel, and y writes them all.
+func (e *Editor) goRename(newName string) {
+	if !token.IsIdentifier(newName) || newName == "_" {
+		e.message = newName + " isn't a valid Go identifier"
+		return
+	}
+	e.goNavRequest("Rename", func(l *goLoad, q goNavQuery) func(*Editor) {
+		obj, u, problem := l.objectAt(q)
+		if obj == nil {
+			return func(e *Editor) { e.message = problem }
+		}
+		refs := l.references(obj)
+		if problem := l.renameProblem(obj, u, refs, newName); problem != "" {
+			return func(e *Editor) { e.message = "Can't rename: " + problem }
+		}
+
+		// The files' new text, changing each line from its last reference
+		edited := map[string][]string{}
+		original := map[string][]string{}
+		for i := len(refs) - 1; i >= 0; i-- {
+			r := refs[i].pos
+			lines, ok := edited[r.Filename]
+			if !ok {
+				original[r.Filename] = l.lines(r.Filename)
+				lines = append([]string(nil), original[r.Filename]...)
+				edited[r.Filename] = lines
+			}
+			line := lines[r.Line-1]
+			col := r.Column - 1
+			lines[r.Line-1] = line[:col] + newName + line[col+len(refs[i].id.Name):]
+		}
+
+		p := &panel{title: fmt.Sprintf("Rename %s to %s", obj.Name(), newName)}
+		files := make([]string, 0, len(edited))
+		for file := range edited {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			p.items = append(p.items, panelItem{text: relativePath(file), kind: "heading"})
+			for i, line := range edited[file] {
+				if line != original[file][i] {
+					p.items = append(p.items, panelItem{text: fmt.Sprintf("  %d: %s", i+1, strings.TrimSpace(line)), file: file, line: i})
+				}
+			}
+		}
+		p.confirm = func(e *Editor) {
+			e.applyRename(q, original, edited, newName)
+		}
+		return func(e *Editor) {
+			e.message = fmt.Sprintf("Rename %s to %s in %d file(s)? y applies it", obj.Name(), newName, len(files))
+			e.showPanel(p)
+			p.selected = 1
+		}
+	})
+}
+
+// renameProblem explains why renaming obj, found in unit u, to newName
+// would break the program or change its meaning, or returns ""
+func (l *goLoad) renameProblem(obj types.Object, u *goUnit, refs []goRef, newName string) string {
+	switch {
+	case obj.Name() == newName:
+		return obj.Name() + " already has that name"
+	case !obj.Pos().IsValid() || obj.Pkg() == nil:
+		return obj.Name() + " is built in"
+	}
+	if _, ok := obj.(*types.PkgName); ok {
+		return "imports can't be renamed"
+	}
+	for _, r := range refs {
+		if !l.inModule(r.pos.Filename) {
+			return obj.Name() + " is declared outside the module"
+		}
+	}
+	at := func(o types.Object) string {
+		p := l.nav.fset.Position(o.Pos())
+		return fmt.Sprintf("%s:%d", relativePath(p.Filename), p.Line)
+	}
+
+	// Other packages can only use exported names
+	if obj.Exported() && !token.IsExported(newName) {
+		for _, r := range refs {
+			if r.unit.pkg.Path() != obj.Pkg().Path() {
+				return fmt.Sprintf("%s is used by %s, outside its package", obj.Name(), r.unit.pkg.Path())
+			}
+		}
+	}
+
+	scope := obj.Parent()
+	if scope == nil {
+		return l.memberProblem(obj, newName)
+	}
+	if other := scope.Lookup(newName); other != nil {
+		return fmt.Sprintf("%s is already declared at %s", newName, at(other))
+	}
+	if scope == obj.Pkg().Scope() {
+		for i := 0; i < scope.NumChildren(); i++ {
+			if other := scope.Child(i).Lookup(newName); other != nil {
+				return fmt.Sprintf("%s is imported at %s", newName, at(other))
+			}
+		}
+	}
+
+	// A use of the new name that would find the renamed object instead
+	for id, o := range u.info.Uses {
+		if id.Name != newName || o == nil || o.Parent() == nil || withinScope(o.Parent(), scope) {
+			continue
+		}
+		if scope == obj.Pkg().Scope() || scope.Contains(id.Pos()) && id.Pos() > obj.Pos() {
+			p := l.nav.fset.Position(id.Pos())
+			return fmt.Sprintf("%s at %s:%d would refer to the renamed %s", newName, relativePath(p.Filename), p.Line, obj.Name())
+		}
+	}
+
+	// A use of the object that a declaration of the new name would hide
+	for _, r := range refs {
+		if r.unit.pkg.Path() != obj.Pkg().Path() {
+			continue // qualified with the package name
+		}
+		for s := r.unit.pkg.Scope().Innermost(r.id.Pos()); s != nil && !sameScope(s, scope); s = s.Parent() {
+			if other := s.Lookup(newName); other != nil && other.Pos() < r.id.Pos() {
+				return fmt.Sprintf("%s at %s would hide %s at %s:%d", newName, at(other), obj.Name(), relativePath(r.pos.Filename), r.pos.Line)
+			}
+		}
+	}
+	return ""
+}
+
+// memberProblem checks renaming a field or method: its type mustn't have
+// the new name already, and no type in the module may stop satisfying an
+// interface in it because of it
+func (l *goLoad) memberProblem(obj types.Object, newName string) string {
+	owner := l.memberOwner(obj)
+	if owner == nil {
+		return ""
+	}
+	if other, _, _ := types.LookupFieldOrMethod(owner, true, obj.Pkg(), newName); other != nil {
+		return fmt.Sprintf("%s already has %s", types.TypeString(owner, types.RelativeTo(obj.Pkg())), newName)
+	}
+	fn, ok := obj.(*types.Func)
+	if !ok {
+		return ""
+	}
+	iface, isInterface := owner.Underlying().(*types.Interface)
+	for _, named := range l.namedTypes() {
+		if isInterface {
+			if _, ok := named.Underlying().(*types.Interface); !ok && (types.Implements(named, iface) || types.Implements(types.NewPointer(named), iface)) {
+				return fmt.Sprintf("%s implements %s, so its %s would need renaming too", named.Obj().Name(), types.TypeString(owner, types.RelativeTo(obj.Pkg())), fn.Name())
+			}
+			continue
+		}
+		other, ok := named.Underlying().(*types.Interface)
+		if !ok {
+			continue
+		}
+		if m, _, _ := types.LookupFieldOrMethod(other, false, fn.Pkg(), fn.Name()); m != nil && types.Implements(types.NewPointer(owner), other) {
+			return fmt.Sprintf("%s satisfies %s, which needs its %s", types.TypeString(owner, types.RelativeTo(obj.Pkg())), named.Obj().Name(), fn.Name())
+		}
+	}
+	return ""
+}
+
+// memberOwner returns the type a method is declared on or a field is in
+func (l *goLoad) memberOwner(obj types.Object) types.Type {
+	if fn, ok := obj.(*types.Func); ok {
+		recv := fn.Type().(*types.Signature).Recv()
+		if recv == nil {
+			return nil
+		}
+		if ptr, ok := recv.Type().(*types.Pointer); ok {
+			return ptr.Elem()
+		}
+		return recv.Type()
+	}
+	key := l.objectKey(obj)
+	for _, named := range l.namedTypes() {
+		if s, ok := named.Underlying().(*types.Struct); ok {
+			for i := 0; i < s.NumFields(); i++ {
+				if l.objectKey(s.Field(i)) == key {
+					return named
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// namedTypes lists the types declared at package level in the module
+func (l *goLoad) namedTypes() []*types.Named {
+	var named []*types.Named
+	for _, u := range l.units {
+		if u.pkg == nil {
+			continue
+		}
+		scope := u.pkg.Scope()
+		for _, name := range scope.Names() {
+			if t, ok := scope.Lookup(name).(*types.TypeName); ok {
+				if n, ok := t.Type().(*types.Named); ok {
+					named = append(named, n)
+				}
+			}
+		}
+	}
+	return named
+}
+
+// withinScope reports whether inner is outer or nested in it
+func withinScope(inner, outer *types.Scope) bool {
+	for s := inner; s != nil; s = s.Parent() {
+		if sameScope(s, outer) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameScope reports whether two scopes are the same one, though they may
+// come from checking the same files in different units
+func sameScope(a, b *types.Scope) bool {
+	if a == b {
+		return true
+	}
+	if a.Parent() == types.Universe && b.Parent() == types.Universe {
+		return true // both package scopes
+	}
+	return a.Pos().IsValid() && a.Pos() == b.Pos() && a.End() == b.End()
+}
+
+// inModule reports whether a file is one of those the load parsed
+func (l *goLoad) inModule(file string) bool {
+	for _, u := range l.units {
+		for _, name := range u.filenames {
+			if name == file {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyRename writes a previewed rename, first checking that none of the
+// files changed since. The buffer is edited in place; other files are
+// written to temporary files that replace them only once all are written.
+func (e *Editor) applyRename(q goNavQuery, original, edited map[string][]string, newName string) {
+	if !sameFile(q.file, e.filename) || linesChanged(q.lines, e.lines) {
+		e.message = "Rename: the buffer changed since the preview"
+		return
+	}
+	type pending struct{ temp, file string }
+	var writes []pending
+	cleanUp := func() {
+		for _, w := range writes {
+			os.Remove(w.temp)
+		}
+	}
+	for file, lines := range edited {
+		if file == q.file {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		info, statErr := os.Stat(file)
+		if err == nil {
+			err = statErr
+		}
+		if err == nil && string(data) != strings.Join(original[file], "\n") {
+			err = fmt.Errorf("%s changed since the preview", relativePath(file))
+		}
+		var temp *os.File
+		if err == nil {
+			temp, err = os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".rename-*")
+		}
+		if err == nil {
+			writes = append(writes, pending{temp.Name(), file})
+			_, err = temp.WriteString(strings.Join(lines, "\n"))
+			if closeErr := temp.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Chmod(temp.Name(), info.Mode())
+			}
+		}
+		if err != nil {
+			cleanUp()
+			e.message = "Rename: " + err.Error()
+			return
+		}
+	}
+	for i, w := range writes {
+		if err := os.Rename(w.temp, w.file); err != nil {
+			cleanUp()
+			e.message = fmt.Sprintf("Rename: %v; %d of %d file(s) were written", err, i, len(writes))
+			return
+		}
+	}
+
+	if lines, ok := edited[q.file]; ok {
+		e.recordUndo(undoStep)
+		e.lines = append([]string(nil), lines...)
+		e.cursorLine = min(e.cursorLine, len(e.lines)-1)
+		e.cursorCol = min(e.cursorCol, len(e.lines[e.cursorLine]))
+		e.dirty = true
+		e.afterBulkEdit()
+	}
+	e.message = fmt.Sprintf("Renamed to %s in %d file(s)", newName, len(edited))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// renameModule is a module with a second package using the first, an
+// interface with an implementation, and functions with nested scopes
+var renameModule = map[string]string{
+	"shapes/shapes.go": `package shapes
+
+type Shape interface {
+	Area() int
+}
+
+type Square struct{ Side int }
+
+func (s Square) Area() int { return s.Side * s.Side }
+
+func Total(shapes []Shape) int {
+	total := 0
+	for _, s := range shapes {
+		total += s.Area()
+	}
+	return total
+}
+
+func scopes() int {
+	a, b := 1, 2
+	{
+		inner := 3
+		a += inner
+	}
+	return a + b
+}
+`,
+	"main.go": `package main
+
+import "example.com/m/shapes"
+
+func main() {
+	println(shapes.Total([]shapes.Shape{shapes.Square{Side: 2}}))
+}
+`,
+}
+
+// renameAt loads the module and checks renaming old, with the cursor on
+// it in the first line of file holding at
+func renameAt(t *testing.T, root, file, at, old, newName string) string {
+	path := filepath.Join(root, filepath.FromSlash(file))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	q := goNavQuery{file: path, lines: lines, line: -1}
+	for i, line := range lines {
+		if col := strings.Index(line, at); col >= 0 {
+			q.line, q.col = i, col+strings.Index(at, old)
+			break
+		}
+	}
+	if q.line < 0 {
+		t.Fatalf("%q isn't in %s", at, file)
+	}
+	l := newGoNavigator().load(root, "example.com/m", true, q)
+	obj, u, problem := l.objectAt(q)
+	if obj == nil || obj.Name() != old {
+		t.Fatalf("%s at %q: found %v, %s", file, at, obj, problem)
+	}
+	return l.renameProblem(obj, u, l.references(obj), newName)
+}
+
+func TestRenameProblem(t *testing.T) {
+	root := writeModule(t, renameModule)
+	tests := []struct {
+		name, at, old, newName string
+		want                   string // a part of the problem, "" if there's none
+	}{
+		{"clash in the same scope", "a, b := 1, 2", "a", "b", "b is already declared at "},
+		{"shadowed by an inner declaration", "a, b := 1, 2", "a", "inner", "would hide a at "},
+		{"unexported while used by another package", "func Total", "Total", "total", "Total is used by example.com/m, outside its package"},
+		{"interface method", "\tArea() int", "Area", "Size", "Square implements Shape, so its Area would need renaming too"},
+		{"method satisfying an interface", "Square) Area", "Area", "Size", "satisfies Shape, which needs its Area"},
+		{"field clashing with a method", "Side int", "Side", "Area", "Square already has Area"},
+		{"renamable", "total := 0", "total", "sum", ""},
+		{"exported rename used by another package", "func Total", "Total", "Sum", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renameAt(t, root, "shapes/shapes.go", tt.at, tt.old, tt.newName)
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Errorf("renaming %s to %s: got %q, want %q", tt.old, tt.newName, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestApplyRename writes a rename to the buffer and another file, and
+// refuses one whose other file changed after the preview, writing nothing
+func TestApplyRename(t *testing.T) {
+	s := tcell.NewSimulationScreen("")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Fini()
+	s.SetSize(80, 24)
+	root := writeModule(t, map[string]string{
+		"a.go": "package m\n\nfunc Old() {}\n",
+		"b.go": "package m\n\nfunc b() { Old() }\n",
+	})
+	a, b := filepath.Join(root, "a.go"), filepath.Join(root, "b.go")
+	preview := func() (*Editor, goNavQuery, map[string][]string, map[string][]string) {
+		lines := []string{"package m", "", "func Old() {}", ""}
+		e := &Editor{screen: s, filename: a, lines: append([]string(nil), lines...)}
+		e.updateSyntaxHighlighting()
+		original := map[string][]string{a: lines, b: {"package m", "", "func b() { Old() }", ""}}
+		edited := map[string][]string{a: {"package m", "", "func New() {}", ""}, b: {"package m", "", "func b() { New() }", ""}}
+		return e, goNavQuery{file: a, lines: lines, line: 2, col: 5}, original, edited
+	}
+
+	e, q, original, edited := preview()
+	os.WriteFile(b, []byte("package m\n\nfunc b() { Old(); Old() }\n"), 0644)
+	e.applyRename(q, original, edited, "New")
+	if !strings.Contains(e.message, "b.go changed since the preview") {
+		t.Errorf("a stale file gave %q", e.message)
+	}
+	if data, _ := os.ReadFile(b); string(data) != "package m\n\nfunc b() { Old(); Old() }\n" || e.lines[2] != "func Old() {}" || e.dirty {
+		t.Errorf("a refused rename wrote b.go as %q and the buffer as %q", data, e.lines)
+	}
+
+	os.WriteFile(b, []byte("package m\n\nfunc b() { Old() }\n"), 0644)
+	e, q, original, edited = preview()
+	e.applyRename(q, original, edited, "New")
+	if e.message != "Renamed to New in 2 file(s)" {
+		t.Errorf("the rename said %q", e.message)
+	}
+	if data, _ := os.ReadFile(b); string(data) != "package m\n\nfunc b() { New() }\n" || e.lines[2] != "func New() {}" || !e.dirty {
+		t.Errorf("the rename wrote b.go as %q and the buffer as %q", data, e.lines)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 3 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	// The buffer changing since the preview refuses it too
+	e, q, original, edited = preview()
+	e.lines[0] = "package n"
+	e.applyRename(q, original, edited, "New")
+	if e.message != "Rename: the buffer changed since the preview" {
+		t.Errorf("a changed buffer gave %q", e.message)
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------- GO SEMANTIC HIGHLIGHTING -----------------
+
+// semanticTokenizer highlights a whole buffer at once, replacing the
+// line-by-line grammar tokens when it can make sense of the buffer.
+type semanticTokenizer interface {
+	tokens(lines []string, filename string) [][]Token
+}
+
+// goHighlighter tokenizes Go with go/scanner and classifies identifiers from
+// go/parser's syntax tree. The buffer is split into top-level declarations
+// that are parsed separately and cached by their text, so an edit only
+// reparses the declaration it touched.
+type goHighlighter struct {
+	chunks map[string]*goChunk
+	pkg    goPackageDecls
+}
+
+// goChunk is one parsed top-level declaration. Positions are relative to
+// the chunk's first line.
+type goChunk struct {
+	pkg     string
+	tokens  []goToken
+	pending []goIdent
+	decls   map[string]TokenType // package-level names the chunk declares
+	lexOK   bool
+}
+
+type goToken struct {
+	line, start, end int
+	kind             TokenType
+}
+
+type goIdentContext int
+
+const (
+	goValue goIdentContext = iota
+	goCall
+	goTypeExpr
+)
+
+// goIdent is an identifier the chunk couldn't resolve on its own, left for
+// the package scope: a name, or the selector of a qualifier like pkg.Name.
+type goIdent struct {
+	line, start, end int
+	name             string
+	qualifier        string
+	ctx              goIdentContext
+}
+
+// goDeclStart matches lines that begin a top-level declaration
+var goDeclStart = regexp.MustCompile(`^(?:func|type|var|const|import)[\s(]`)
+
+// goPackageRefresh is how often the other files of the package are rechecked
+const goPackageRefresh = 2 * time.Second
+
+func newGoHighlighter() *goHighlighter {
+	return &goHighlighter{chunks: make(map[string]*goChunk)}
+}
+
+func (g *goHighlighter) tokens(lines []string, filename string) [][]Token {
+	starts := []int{0}
+	for i := 1; i < len(lines); i++ {
+		if goDeclStart.MatchString(lines[i]) {
+			starts = append(starts, i)
+		}
+	}
+
+	chunks, ok := g.parseChunks(lines, starts)
+	if !ok && len(starts) > 1 {
+		// A raw string or comment crosses a declaration boundary
+		starts = []int{0}
+		chunks, _ = g.parseChunks(lines, starts)
+	}
+	if chunks[0].pkg == "" {
+		return nil
+	}
+
+	scope := make(map[string]TokenType)
+	for name, kind := range g.pkg.decls(filename, chunks[0].pkg) {
+		scope[name] = kind
+	}
+	for _, chunk := range chunks {
+		for name, kind := range chunk.decls {
+			scope[name] = kind
+		}
+	}
+
+	result := make([][]Token, len(lines))
+	for i, chunk := range chunks {
+		offset := starts[i]
+		for _, t := range chunk.tokens {
+			result[offset+t.line] = append(result[offset+t.line], Token{Type: t.kind, Start: t.start, End: t.end, Context: Go})
+		}
+		for _, id := range chunk.pending {
+			kind := resolveGoIdent(id, scope)
+			if kind != TokenNormal {
+				result[offset+id.line] = append(result[offset+id.line], Token{Type: kind, Start: id.start, End: id.end, Context: Go})
+			}
+		}
+	}
+	for i := range result {
+		sortTokens(result[i])
+	}
+	return result
+}
+
+// parseChunks parses the declarations starting at starts, reusing cached
+// results for unchanged text; ok is false if one didn't scan cleanly.
+func (g *goHighlighter) parseChunks(lines []string, starts []int) ([]*goChunk, bool) {
+	ok := true
+	used := make(map[string]*goChunk, len(starts))
+	chunks := make([]*goChunk, len(starts))
+	for i, start := range starts {
+		end := len(lines)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		text := strings.Join(lines[start:end], "\n")
+		chunk, cached := g.chunks[text]
+		if !cached {
+			chunk = parseGoChunk(text, i == 0)
+		}
+		used[text] = chunk
+		chunks[i] = chunk
+		ok = ok && chunk.lexOK
+	}
+	g.chunks = used
+	return chunks, ok
+}
+
+// resolveGoIdent classifies an identifier against the package scope
+func resolveGoIdent(id goIdent, scope map[string]TokenType) TokenType {
+	if id.qualifier != "" {
+		switch lookupGoName(id.qualifier, scope) {
+		case TokenNamespace:
+			switch id.ctx {
+			case goTypeExpr:
+				return TokenType_
+			case goCall:
+				return TokenFunction
+			}
+			return TokenNormal
+		case TokenType_:
+			return TokenMethod
+		}
+		if id.ctx == goCall {
+			return TokenMethod
+		}
+		return TokenProperty
+	}
+
+	kind := lookupGoName(id.name, scope)
+	if kind == TokenVariable {
+		return TokenNormal
+	}
+	return kind
+}
+
+// lookupGoName finds a name in the package scope or the universe
+func lookupGoName(name string, scope map[string]TokenType) TokenType {
+	if kind, ok := scope[name]; ok {
+		return kind
+	}
+	switch types.Universe.Lookup(name).(type) {
+	case *types.Builtin:
+		return TokenBuiltin
+	case *types.TypeName:
+		return TokenType_
+	case *types.Const, *types.Nil:
+		return TokenConstant
+	}
+	return TokenUnresolved
+}
+
+// parseGoChunk scans and parses one declaration. Chunks after the first get
+// a package clause of their own so the parser accepts them.
+func parseGoChunk(text string, header bool) *goChunk {
+	prefix := 0
+	src := text
+	if !header {
+		prefix = 1
+		src = "package p\n" + text
+	}
+
+	chunk := &goChunk{decls: make(map[string]TokenType), lexOK: true}
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(src))
+	lines := strings.Split(src, "\n")
+
+	var s scanner.Scanner
+	s.Init(file, []byte(src), func(token.Position, string) { chunk.lexOK = false }, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		var kind TokenType
+		switch {
+		case tok == token.COMMENT:
+			kind = TokenComment
+		case tok == token.STRING || tok == token.CHAR:
+			kind = TokenString
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			kind = TokenNumber
+		case tok.IsKeyword():
+			kind = TokenKeyword
+		case tok.IsOperator() && !isGoDelimiter(tok):
+			kind = TokenOperator
+		default:
+			continue
+		}
+		if lit == "" {
+			lit = tok.String()
+		}
+		p := fset.Position(pos)
+		chunk.addSpan(lines, p.Line-1, prefix, p.Column-1, lit, kind)
+	}
+
+	// Object resolution is left on: goClassifier relies on it
+	f, _ := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if f == nil {
+		return chunk
+	}
+	if header && f.Name != nil && f.Name.Name != "_" {
+		chunk.pkg = f.Name.Name
+	}
+	c := &goClassifier{
+		chunk:  chunk,
+		fset:   fset,
+		prefix: prefix,
+		seen:   make(map[*ast.Ident]bool),
+		calls:  make(map[ast.Expr]bool),
+	}
+	c.classify(f)
+	return chunk
+}
+
+// addSpan records a token that may run over several lines (raw strings and
+// block comments). line is 0-based in the chunk's source, including the
+// package clause added to it.
+func (c *goChunk) addSpan(lines []string, line, prefix, col int, lit string, kind TokenType) {
+	parts := strings.Split(lit, "\n")
+	for i, part := range parts {
+		l := line + i
+		if l >= len(lines) {
+			break
+		}
+		start, end := 0, len(part)
+		if i == 0 {
+			start, end = col, col+len(part)
+		}
+		if i < len(parts)-1 {
+			// Raw strings drop carriage returns, so run to the end of the line
+			end = len(lines[l])
+		}
+		if l >= prefix {
+			c.tokens = append(c.tokens, goToken{line: l - prefix, start: start, end: end, kind: kind})
+		}
+	}
+}
+
+func isGoDelimiter(tok token.Token) bool {
+	switch tok {
+	case token.LPAREN, token.RPAREN, token.LBRACK, token.RBRACK, token.LBRACE, token.RBRACE,
+		token.COMMA, token.SEMICOLON, token.PERIOD, token.COLON:
+		return true
+	}
+	return false
+}
+
+// goClassifier walks a chunk's syntax tree. Identifiers the parser resolved
+// inside the chunk are classified straight away; the rest are left pending.
+//
+// This uses the parser's deprecated ast.Object resolution rather than
+// go/types, which gonav and gorename use. A chunk is one declaration parsed
+// on its own, often halfway through an edit: type-checking it would need
+// the rest of the package and its imports loaded on every keystroke, and
+// gives up on code that doesn't compile, while the parser resolves names
+// within the chunk from its text alone. Where that resolution is wrong, as
+// for keys of composite literals of unknown type, only a color is at stake.
+type goClassifier struct {
+	chunk      *goChunk
+	fset       *token.FileSet
+	prefix     int
+	seen       map[*ast.Ident]bool
+	calls      map[ast.Expr]bool
+	typeIdents map[*ast.Ident]bool
+	typeSels   map[*ast.SelectorExpr]bool
+}
+
+func (c *goClassifier) classify(f *ast.File) {
+	c.typeIdents = make(map[*ast.Ident]bool)
+	c.typeSels = make(map[*ast.SelectorExpr]bool)
+
+	c.mark(f.Name, TokenNamespace)
+	for _, spec := range f.Imports {
+		if spec.Name != nil {
+			c.mark(spec.Name, TokenNamespace)
+		}
+		if name := goImportName(spec); name != "_" && name != "." {
+			c.chunk.decls[name] = TokenNamespace
+		}
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil {
+				c.mark(d.Name, TokenMethod)
+				continue
+			}
+			c.mark(d.Name, TokenFunction)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					c.mark(s.Name, TokenType_)
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						if d.Tok == token.CONST {
+							c.mark(name, TokenConstant)
+						} else {
+							c.mark(name, TokenNormal)
+						}
+					}
+				}
+			}
+		}
+	}
+	addGoDecls(f, c.chunk.decls)
+
+	ast.Inspect(f, c.visit)
+}
+
+func (c *goClassifier) visit(n ast.Node) bool {
+	switch n := n.(type) {
+	case *ast.CallExpr:
+		c.calls[goCallee(n.Fun)] = true
+	case *ast.Field:
+		c.typeExpr(n.Type)
+	case *ast.TypeSpec:
+		c.typeExpr(n.Type)
+	case *ast.ValueSpec:
+		c.typeExpr(n.Type)
+	case *ast.TypeAssertExpr:
+		c.typeExpr(n.Type)
+	case *ast.StructType:
+		for _, field := range n.Fields.List {
+			for _, name := range field.Names {
+				c.mark(name, TokenProperty)
+			}
+		}
+	case *ast.InterfaceType:
+		for _, field := range n.Methods.List {
+			for _, name := range field.Names {
+				c.mark(name, TokenMethod)
+			}
+		}
+	case *ast.CompositeLit:
+		c.typeExpr(n.Type)
+		switch n.Type.(type) {
+		case *ast.MapType, *ast.ArrayType:
+			// Keys are values here, not field names
+		default:
+			for _, elt := range n.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if key, ok := kv.Key.(*ast.Ident); ok && key.Obj == nil {
+						c.mark(key, TokenProperty)
+					}
+				}
+			}
+		}
+	case *ast.LabeledStmt:
+		c.mark(n.Label, TokenNormal)
+	case *ast.BranchStmt:
+		if n.Label != nil {
+			c.mark(n.Label, TokenNormal)
+		}
+	case *ast.SelectorExpr:
+		c.selector(n)
+	case *ast.Ident:
+		c.ident(n)
+	}
+	return true
+}
+
+// typeExpr notes the identifiers and selectors used as types in expr
+func (c *goClassifier) typeExpr(expr ast.Expr) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		c.typeIdents[t] = true
+	case *ast.SelectorExpr:
+		c.typeSels[t] = true
+	case *ast.StarExpr:
+		c.typeExpr(t.X)
+	case *ast.ParenExpr:
+		c.typeExpr(t.X)
+	case *ast.ArrayType:
+		c.typeExpr(t.Elt)
+	case *ast.Ellipsis:
+		c.typeExpr(t.Elt)
+	case *ast.MapType:
+		c.typeExpr(t.Key)
+		c.typeExpr(t.Value)
+	case *ast.ChanType:
+		c.typeExpr(t.Value)
+	case *ast.IndexExpr:
+		c.typeExpr(t.X)
+		c.typeExpr(t.Index)
+	case *ast.IndexListExpr:
+		c.typeExpr(t.X)
+		for _, index := range t.Indices {
+			c.typeExpr(index)
+		}
+	}
+}
+
+func (c *goClassifier) selector(sel *ast.SelectorExpr) {
+	if c.seen[sel.Sel] {
+		return
+	}
+	ctx := goValue
+	if c.calls[sel] {
+		ctx = goCall
+	} else if c.typeSels[sel] {
+		ctx = goTypeExpr
+	}
+
+	if x, ok := sel.X.(*ast.Ident); ok {
+		if x.Obj == nil {
+			// pkg.Name, or a name declared elsewhere in the package
+			c.pending(sel.Sel, ctx, x.Name)
+			return
+		}
+		if x.Obj.Kind == ast.Typ {
+			// Method expression
+			c.mark(sel.Sel, TokenMethod)
+			return
+		}
+	}
+	if ctx == goCall {
+		c.mark(sel.Sel, TokenMethod)
+	} else {
+		c.mark(sel.Sel, TokenProperty)
+	}
+}
+
+func (c *goClassifier) ident(id *ast.Ident) {
+	if c.seen[id] || id.Name == "_" {
+		return
+	}
+	if id.Obj == nil {
+		ctx := goValue
+		if c.typeIdents[id] {
+			ctx = goTypeExpr
+		}
+		c.pending(id, ctx, "")
+		return
+	}
+	switch id.Obj.Kind {
+	case ast.Con:
+		c.mark(id, TokenConstant)
+	case ast.Typ:
+		c.mark(id, TokenType_)
+	case ast.Fun:
+		c.mark(id, TokenFunction)
+	case ast.Pkg:
+		c.mark(id, TokenNamespace)
+	default:
+		c.mark(id, TokenNormal)
+	}
+}
+
+// mark classifies an identifier; TokenNormal just marks it as handled
+func (c *goClassifier) mark(id *ast.Ident, kind TokenType) {
+	if id == nil || c.seen[id] {
+		return
+	}
+	c.seen[id] = true
+	if kind == TokenNormal {
+		return
+	}
+	line, col := c.position(id)
+	if line >= 0 {
+		c.chunk.tokens = append(c.chunk.tokens, goToken{line: line, start: col, end: col + len(id.Name), kind: kind})
+	}
+}
+
+func (c *goClassifier) pending(id *ast.Ident, ctx goIdentContext, qualifier string) {
+	c.seen[id] = true
+	line, col := c.position(id)
+	if line >= 0 {
+		c.chunk.pending = append(c.chunk.pending, goIdent{
+			line: line, start: col, end: col + len(id.Name),
+			name: id.Name, qualifier: qualifier, ctx: ctx,
+		})
+	}
+}
+
+// position returns an identifier's line in the chunk and its byte column
+func (c *goClassifier) position(id *ast.Ident) (int, int) {
+	p := c.fset.Position(id.Pos())
+	return p.Line - 1 - c.prefix, p.Column - 1
+}
+
+// goCallee strips parentheses and type arguments from a call's function
+func goCallee(fun ast.Expr) ast.Expr {
+	for {
+		switch f := fun.(type) {
+		case *ast.ParenExpr:
+			fun = f.X
+		case *ast.IndexExpr:
+			fun = f.X
+		case *ast.IndexListExpr:
+			fun = f.X
+		default:
+			return fun
+		}
+	}
+}
+
+// goMajorVersion matches the /v2 style suffix of a module path
+var goMajorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// goImportName guesses the name an import is used by: its explicit name, or
+// the last path element without version suffixes and go- prefixes.
+func goImportName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	path, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return "_"
+	}
+	parts := strings.Split(path, "/")
+	name := parts[len(parts)-1]
+	if len(parts) > 1 && goMajorVersion.MatchString(name) {
+		name = parts[len(parts)-2]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	if i := strings.IndexAny(name, ".-"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// addGoDecls records the functions, types, constants and variables a file
+// declares at package level
+func addGoDecls(f *ast.File, decls map[string]TokenType) {
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil && d.Name.Name != "init" {
+				decls[d.Name.Name] = TokenFunction
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					decls[s.Name.Name] = TokenType_
+				case *ast.ValueSpec:
+					kind := TokenVariable
+					if d.Tok == token.CONST {
+						kind = TokenConstant
+					}
+					for _, name := range s.Names {
+						if name.Name != "_" {
+							decls[name.Name] = kind
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// goPackageDecls caches the package-level names declared by the other files
+// of a buffer's package, so uses of them don't show as unresolved.
+type goPackageDecls struct {
+	self     string
+	pkg      string
+	checked  time.Time
+	modTimes map[string]time.Time
+	names    map[string]TokenType
+}
+
+func (p *goPackageDecls) decls(filename, pkg string) map[string]TokenType {
+	if filename == "" {
+		return nil
+	}
+	self, err := filepath.Abs(filename)
+	if err != nil {
+		return nil
+	}
+	if self == p.self && pkg == p.pkg && time.Since(p.checked) < goPackageRefresh {
+		return p.names
+	}
+	p.checked = time.Now()
+
+	entries, err := os.ReadDir(filepath.Dir(self))
+	if err != nil {
+		return nil
+	}
+	modTimes := make(map[string]time.Time)
+	for _, entry := range entries {
+		path := filepath.Join(filepath.Dir(self), entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".go") || path == self {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	if self == p.self && pkg == p.pkg && maps.Equal(modTimes, p.modTimes) {
+		return p.names
+	}
+
+	names := make(map[string]TokenType)
+	fset := token.NewFileSet()
+	for path := range modTimes {
+		f, _ := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+		if f != nil && f.Name != nil && f.Name.Name == pkg {
+			addGoDecls(f, names)
+		}
+	}
+	p.self, p.pkg, p.modTimes, p.names = self, pkg, modTimes, names
+	return names
+}
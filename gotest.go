@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- GO TESTS -----------------
+
+var (
+	testFuncPattern  = regexp.MustCompile(`^func ((?:Test|Benchmark|Fuzz|Example)\w*)\(`)
+	testAssertion    = regexp.MustCompile(`^\s+([\w./-]+\.go):(\d+): (.*)$`)
+	testPanicFrame   = regexp.MustCompile(`^\s+(\S+_test\.go):(\d+)`)
+	goBuildErrFormat = []ErrorFormat{{Name: "go", Pattern: `^(?P<file>[^:\s]+\.go):(?P<line>\d+):(?:(?P<col>\d+):)?\s*(?P<message>.*)$`}}
+)
+
+// goTestEvent is a line of go test -json output
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// goTestResult is how a package or a single test came out
+type goTestResult struct {
+	pkg, test string
+	action    string // pass, fail or skip; empty if it never finished
+	elapsed   float64
+	output    []string
+}
+
+// testStatuses holds the outcome of top-level tests, keyed by testKey
+type testStatuses map[string]string
+
+// goModule finds the module holding dir: its root and module path
+func goModule(dir string) (string, string, bool) {
+	for {
+		if data, err := os.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "module" {
+					return dir, strings.Trim(fields[1], `"`), true
+				}
+			}
+			return dir, "", true
+		}
+		if filepath.Dir(dir) == dir {
+			return "", "", false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// testCommand handles test, test-pkg and test-func
+func (e *Editor) testCommand(scope string) {
+	if e.testing {
+		e.message = "Tests are already running"
+		return
+	}
+	dir, _ := os.Getwd()
+	if e.filename != "" {
+		if abs, err := filepath.Abs(e.filename); err == nil {
+			dir = filepath.Dir(abs)
+		}
+	}
+	root, module, ok := goModule(dir)
+	if !ok {
+		e.message = "No go.mod found"
+		return
+	}
+
+	args := []string{"test", "-json"}
+	pkg := "./..."
+	if scope != "all" {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			e.message = err.Error()
+			return
+		}
+		pkg = "./" + filepath.ToSlash(rel)
+	}
+	if scope == "func" {
+		name := e.testAtCursor()
+		if name == "" {
+			e.message = "The cursor isn't in a test function"
+			return
+		}
+		args = append(args, "-run", "^"+name+"$")
+		if strings.HasPrefix(name, "Benchmark") {
+			args = append(args, "-bench", "^"+name+"$")
+		}
+	}
+	args = append(args, pkg)
+
+	e.testing = true
+	e.message = "Running go " + strings.Join(args, " ")
+	screen := e.screen
+	go func() {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = root
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		packages, tests, build := parseGoTestJSON(stdout.Bytes())
+		p, diags, statuses := goTestResults(root, module, packages, tests, build, stderr.String())
+		postFuncEvent(screen, func(e *Editor) {
+			e.testing = false
+			e.finishTests(p, diags, statuses, tests, err)
+		})
+	}()
+}
+
+// testAtCursor names the test function the cursor is in
+func (e *Editor) testAtCursor() string {
+	for i := min(e.cursorLine, len(e.lines)-1); i >= 0; i-- {
+		if m := testFuncPattern.FindStringSubmatch(e.lines[i]); m != nil {
+			return m[1]
+		}
+		if i < e.cursorLine && strings.HasPrefix(e.lines[i], "}") {
+			break
+		}
+	}
+	return ""
+}
+
+// parseGoTestJSON gathers go test -json events into results per package
+// and per test, in the order they started, plus any build output
+func parseGoTestJSON(out []byte) ([]*goTestResult, []*goTestResult, []string) {
+	var packages, tests []*goTestResult
+	var build []string
+	byKey := map[string]*goTestResult{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var ev goTestEvent
+		if json.Unmarshal(scanner.Bytes(), &ev) != nil {
+			build = append(build, scanner.Text())
+			continue
+		}
+		if ev.Action == "build-output" {
+			build = append(build, strings.TrimSuffix(ev.Output, "\n"))
+			continue
+		}
+		if ev.Package == "" {
+			continue
+		}
+		key := ev.Package + "\x00" + ev.Test
+		r := byKey[key]
+		if r == nil {
+			r = &goTestResult{pkg: ev.Package, test: ev.Test}
+			byKey[key] = r
+			if ev.Test == "" {
+				packages = append(packages, r)
+			} else {
+				tests = append(tests, r)
+			}
+		}
+		switch ev.Action {
+		case "output":
+			r.output = append(r.output, strings.TrimSuffix(ev.Output, "\n"))
+		case "pass", "fail", "skip":
+			r.action, r.elapsed = ev.Action, ev.Elapsed
+		}
+	}
+	return packages, tests, build
+}
+
+// packageDir is where a package of the module lives
+func packageDir(root, module, pkg string) string {
+	if pkg == module {
+		return root
+	}
+	if rel := strings.TrimPrefix(pkg, module+"/"); rel != pkg {
+		return filepath.Join(root, filepath.FromSlash(rel))
+	}
+	return root
+}
+
+// findTestFunc locates a test function among a package's test files
+func findTestFunc(dir, name string) (string, int) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			if m := testFuncPattern.FindStringSubmatch(line); m != nil && m[1] == name {
+				return file, i
+			}
+		}
+	}
+	return "", 0
+}
+
+// goTestResults lays the results out for the panel, collects the failed
+// assertions as diagnostics and records each top-level test's outcome
+func goTestResults(root, module string, packages, tests []*goTestResult, build []string, stderr string) (*panel, []Diagnostic, testStatuses) {
+	p := &panel{title: "Test results"}
+	var diags []Diagnostic
+	statuses := testStatuses{}
+
+	formats, _ := compileErrorFormats(goBuildErrFormat)
+	for _, d := range parseErrors(strings.Join(build, "\n")+"\n"+stderr, root, formats) {
+		diags = append(diags, d)
+		p.items = append(p.items, panelItem{text: fmt.Sprintf("%s:%d: %s", relativePath(d.File), d.Line+1, d.Message), kind: "error", file: d.File, line: d.Line, col: d.Col})
+	}
+
+	for _, pkg := range packages {
+		dir := packageDir(root, module, pkg.pkg)
+		kind, label := "pass", "ok  "
+		switch pkg.action {
+		case "fail", "":
+			kind, label = "error", "FAIL"
+		case "skip":
+			kind, label = "skip", "?   "
+		}
+		p.items = append(p.items, panelItem{text: fmt.Sprintf("%s %s (%.2fs)", label, pkg.pkg, pkg.elapsed), kind: kind})
+
+		for _, t := range tests {
+			if t.pkg != pkg.pkg {
+				continue
+			}
+			top := strings.SplitN(t.test, "/", 2)[0]
+			if t.test == top {
+				statuses[testKey(dir, top)] = t.action
+			}
+			if t.action == "pass" {
+				continue
+			}
+			item := panelItem{text: fmt.Sprintf("  --- %s: %s (%.2fs)", strings.ToUpper(t.action), t.test, t.elapsed), kind: "error"}
+			if t.action == "skip" {
+				item.kind = "skip"
+			}
+			if file, line := findTestFunc(dir, top); file != "" {
+				item.file, item.line = file, line
+			}
+			p.items = append(p.items, item)
+			if t.action == "skip" {
+				continue
+			}
+
+			// Failed assertions, or where a panic went through the test
+			found := false
+			for _, out := range t.output {
+				m := testAssertion.FindStringSubmatch(out)
+				if m == nil {
+					continue
+				}
+				d := Diagnostic{File: filepath.Join(dir, m[1]), Severity: "error", Source: "go test", Message: m[3]}
+				fmt.Sscan(m[2], &d.Line)
+				d.Line--
+				d.EndLine = d.Line
+				diags = append(diags, d)
+				p.items = append(p.items, panelItem{text: "      " + strings.TrimSpace(out), kind: "error", file: d.File, line: d.Line})
+				found = true
+			}
+			for _, out := range t.output {
+				if found {
+					break
+				}
+				if m := testPanicFrame.FindStringSubmatch(out); m != nil {
+					d := Diagnostic{File: m[1], Severity: "error", Source: "go test", Message: t.test + " panicked"}
+					fmt.Sscan(m[2], &d.Line)
+					d.Line--
+					d.EndLine = d.Line
+					diags = append(diags, d)
+					p.items = append(p.items, panelItem{text: "      panic at " + relativePath(m[1]) + ":" + m[2], kind: "error", file: d.File, line: d.Line})
+					found = true
+				}
+			}
+		}
+	}
+	return p, diags, statuses
+}
+
+// testKey identifies a top-level test by its package directory and name
+func testKey(dir, name string) string {
+	return dir + "\x00" + name
+}
+
+// finishTests shows a test run's results
+func (e *Editor) finishTests(p *panel, diags []Diagnostic, statuses testStatuses, tests []*goTestResult, err error) {
+	if e.testStatus == nil {
+		e.testStatus = testStatuses{}
+	}
+	for key, status := range statuses {
+		e.testStatus[key] = status
+	}
+	e.setErrorList(diags)
+
+	counts := map[string]int{}
+	for _, t := range tests {
+		counts[t.action]++
+	}
+	switch {
+	case len(p.items) == 0 && err != nil:
+		e.message = "go test: " + err.Error()
+		return
+	case counts["fail"] > 0 || len(diags) > 0 || err != nil:
+		e.message = fmt.Sprintf("Tests failed: %d passed, %d failed, %d skipped", counts["pass"], counts["fail"], counts["skip"])
+		e.showPanel(p)
+		// Start on the first failure
+		for i, item := range p.items {
+			if item.kind == "error" && item.file != "" {
+				p.selected = i
+				break
+			}
+		}
+	default:
+		e.panel = p
+		e.message = fmt.Sprintf("Tests passed: %d passed, %d skipped", counts["pass"], counts["skip"])
+	}
+}
+
+// drawTestMark marks a failed test function's line in the gutter
+func (e *Editor) drawTestMark(lineIdx, x, y int) {
+	if len(e.testStatus) == 0 || !strings.HasSuffix(e.filename, "_test.go") {
+		return
+	}
+	m := testFuncPattern.FindStringSubmatch(e.lines[lineIdx])
+	if m == nil {
+		return
+	}
+	abs, err := filepath.Abs(e.filename)
+	if err != nil || e.testStatus[testKey(filepath.Dir(abs), m[1])] != "fail" {
+		return
+	}
+	style := tcell.StyleDefault.Background(editorBackground).Foreground(panelColor("error")).Bold(true)
+	e.screen.SetContent(x, y, '✗', nil, style)
+}
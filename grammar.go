@@ -0,0 +1,519 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ----------------- GRAMMARS -----------------
+
+// Built-in grammars ship inside the binary; user grammars with the same name
+// override them and new names register additional formats.
+//
+//go:embed grammars/*.json
+var builtinGrammarFS embed.FS
+
+// Grammar is the data-driven description of a language: how files are
+// recognised, which words are keywords, which regexes produce which tokens,
+// how to indent, which other languages can be embedded in it and how to
+// find its symbols.
+type Grammar struct {
+	Name         string         `json:"name"`
+	Aliases      []string       `json:"aliases"`
+	Extensions   []string       `json:"extensions"`
+	Filenames    []string       `json:"filenames"`
+	Shebangs     []string       `json:"shebangs"` // interpreters named on a #! line
+	LineComment  string         `json:"lineComment"`
+	BlockComment []string       `json:"blockComment"`
+	Strings      []string       `json:"strings"`
+	IgnoreCase   bool           `json:"ignoreCase"` // keywords match regardless of case, as in SQL
+	Indent       IndentRules    `json:"indent"`
+	Keywords     []string       `json:"keywords"`
+	Rules        []GrammarRule  `json:"rules"`
+	Embedded     []EmbeddedRule `json:"embedded"`
+	Regions      []RegionRule   `json:"regions"`
+	Symbols      []SymbolRule   `json:"symbols"`
+
+	format FileFormat
+	rules  []highlightRule
+}
+
+// GrammarRule maps a regex to a token type. Group selects the capture group
+// to highlight; when omitted the first group that matched is used, falling
+// back to the whole match.
+type GrammarRule struct {
+	Token   string `json:"token"`
+	Pattern string `json:"pattern"`
+	Group   *int   `json:"group,omitempty"`
+}
+
+// EmbeddedRule marks the first capture group of Pattern as code written in
+// another language, e.g. the body of a <script> tag.
+type EmbeddedRule struct {
+	Language string `json:"language"`
+	Pattern  string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// RegionRule spans whole lines: it opens after a line matching Start and
+// closes at the next line matching End. The lines in between are highlighted
+// as Language when that names a known grammar, otherwise painted as Token.
+// $1..$9 in End and Language stand for Start's capture groups, so a heredoc
+// can close on its own delimiter and a fence can name its language.
+//
+// A region normally starts at its opening delimiter, like a block comment.
+// A Linewise one starts on the next line, like a heredoc body, and an
+// Exclusive one ends just before the line matching End, for blocks that only
+// end when something else begins, like a YAML block scalar.
+type RegionRule struct {
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Language  string `json:"language"`
+	Token     string `json:"token"`
+	Linewise  bool   `json:"linewise"`
+	Exclusive bool   `json:"exclusive"`
+
+	re    *regexp.Regexp
+	token TokenType
+}
+
+// SymbolRule finds a symbol for the outline: a line matching Pattern
+// declares one named by its first capture group that matched, of the given
+// Kind, such as function or class.
+type SymbolRule struct {
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// IndentRules describes when a new line should be indented one level deeper
+// than the previous one and what one level of indentation is.
+type IndentRules struct {
+	Unit          string   `json:"unit"`          // one level of indentation, default "\t"
+	OpenChars     string   `json:"openChars"`     // trailing characters that open a block, default "{[("
+	BlockKeywords []string `json:"blockKeywords"` // trailing words that open a block
+	KeywordSuffix string   `json:"keywordSuffix"` // text required after a block keyword, e.g. ":"
+	Pattern       string   `json:"pattern"`       // regex matched against the whole line, e.g. a Makefile target
+	MarkupTags    bool     `json:"markupTags"`    // indent after an unclosed <tag>
+
+	re *regexp.Regexp
+}
+
+type highlightRule struct {
+	token   TokenType
+	pattern *regexp.Regexp
+	group   int // capture group to highlight, -1 for the first one that matched
+}
+
+var tokenTypeNames = map[string]TokenType{
+	"normal":       TokenNormal,
+	"keyword":      TokenKeyword,
+	"string":       TokenString,
+	"comment":      TokenComment,
+	"number":       TokenNumber,
+	"operator":     TokenOperator,
+	"function":     TokenFunction,
+	"type":         TokenType_,
+	"variable":     TokenVariable,
+	"constant":     TokenConstant,
+	"class":        TokenClass,
+	"method":       TokenMethod,
+	"property":     TokenProperty,
+	"tag":          TokenTag,
+	"attribute":    TokenAttribute,
+	"value":        TokenValue,
+	"doctype":      TokenDoctype,
+	"entity":       TokenEntity,
+	"selector":     TokenSelector,
+	"pseudo":       TokenPseudo,
+	"important":    TokenImportant,
+	"unit":         TokenUnit,
+	"preprocessor": TokenPreprocessor,
+	"regex":        TokenRegex,
+	"escape":       TokenEscape,
+	"delimiter":    TokenDelimiter,
+	"namespace":    TokenNamespace,
+	"annotation":   TokenAnnotation,
+	"macro":        TokenMacro,
+	"heading":      TokenHeading,
+	"emphasis":     TokenEmphasis,
+	"strong":       TokenStrong,
+	"link":         TokenLink,
+	"invalid":      TokenInvalid,
+	"builtin":      TokenBuiltin,
+	"unresolved":   TokenUnresolved,
+}
+
+// builtinFormats ties the names used in the built-in grammar files to the
+// FileFormat constants the rest of the editor switches on.
+var builtinFormats = map[string]FileFormat{
+	"Go":         Go,
+	"JavaScript": JavaScript,
+	"Python":     Python,
+	"HTML":       HTML,
+	"CSS":        CSS,
+	"JSON":       JSON,
+	"Markdown":   Markdown,
+	"Shell":      Shell,
+	"C":          C,
+	"CPP":        CPP,
+	"Rust":       Rust,
+	"Java":       Java,
+	"PHP":        PHP,
+	"SQU1D++":    SquidPlusPlus,
+	"YAML":       YAML,
+	"TOML":       TOML,
+	"SQL":        SQL,
+	"Dockerfile": Dockerfile,
+	"Makefile":   Makefile,
+	"TypeScript": TypeScript,
+	"Lua":        Lua,
+	"Ruby":       Ruby,
+	"XML":        XML,
+}
+
+type grammarRegistry struct {
+	byFormat   map[FileFormat]*Grammar
+	byName     map[string]FileFormat
+	byAlias    map[string]FileFormat
+	byExt      map[string]FileFormat
+	byFilename map[string]FileFormat
+	byGlob     []filenameGlob
+	byShebang  map[string]FileFormat
+	next       FileFormat
+	errors     []string
+}
+
+// filenameGlob maps a wildcard filename such as "Dockerfile.*" to its format
+type filenameGlob struct {
+	pattern string
+	format  FileFormat
+}
+
+// grammars is the registry every highlighter is built from.
+var grammars = loadGrammars(filepath.Join(configDir(), "grammars"))
+
+// configDir returns SITE's per-user configuration directory, e.g. ~/.config/site.
+func configDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "site")
+}
+
+// loadGrammars registers the built-in grammars and then every *.json file in
+// userDir. Files that fail to parse are skipped and reported in errors.
+func loadGrammars(userDir string) *grammarRegistry {
+	r := &grammarRegistry{
+		byFormat:   make(map[FileFormat]*Grammar),
+		byName:     make(map[string]FileFormat),
+		byAlias:    make(map[string]FileFormat),
+		byExt:      make(map[string]FileFormat),
+		byFilename: make(map[string]FileFormat),
+		byShebang:  make(map[string]FileFormat),
+		next:       firstUserFormat,
+	}
+
+	builtin, _ := fs.Glob(builtinGrammarFS, "grammars/*.json")
+	for _, name := range builtin {
+		data, err := builtinGrammarFS.ReadFile(name)
+		if err == nil {
+			err = r.add(data)
+		}
+		if err != nil {
+			r.errors = append(r.errors, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if userDir != "" {
+		user, _ := filepath.Glob(filepath.Join(userDir, "*.json"))
+		sort.Strings(user)
+		for _, name := range user {
+			data, err := os.ReadFile(name)
+			if err == nil {
+				err = r.add(data)
+			}
+			if err != nil {
+				r.errors = append(r.errors, fmt.Sprintf("%s: %v", filepath.Base(name), err))
+			}
+		}
+	}
+
+	return r
+}
+
+// add parses and compiles a grammar file and registers it, replacing any
+// grammar already registered under the same name.
+func (r *grammarRegistry) add(data []byte) error {
+	g := &Grammar{}
+	if err := json.Unmarshal(data, g); err != nil {
+		return err
+	}
+	if g.Name == "" {
+		return fmt.Errorf("grammar has no name")
+	}
+	if err := g.compile(); err != nil {
+		return err
+	}
+
+	key := strings.ToLower(g.Name)
+	if f, ok := r.byName[key]; ok {
+		g.format = f
+	} else if f, ok := builtinFormats[g.Name]; ok {
+		g.format = f
+	} else {
+		g.format = r.next
+		r.next++
+	}
+
+	r.byFormat[g.format] = g
+	r.byName[key] = g.format
+	for _, alias := range g.Aliases {
+		r.byAlias[strings.ToLower(alias)] = g.format
+	}
+	for _, ext := range g.Extensions {
+		r.byExt[strings.ToLower(ext)] = g.format
+	}
+	for _, interpreter := range g.Shebangs {
+		r.byShebang[interpreter] = g.format
+	}
+	for _, name := range g.Filenames {
+		if strings.ContainsAny(name, "*?[") {
+			r.byGlob = append(r.byGlob, filenameGlob{pattern: name, format: g.format})
+		} else {
+			r.byFilename[name] = g.format
+		}
+	}
+	return nil
+}
+
+// compile turns the textual rules into regexes, deriving comment and string
+// rules from the declared delimiters when the grammar doesn't spell them out.
+func (g *Grammar) compile() error {
+	hasToken := make(map[TokenType]bool)
+	for i, rule := range g.Rules {
+		tokenType, ok := tokenTypeNames[rule.Token]
+		if !ok {
+			return fmt.Errorf("rule %d: unknown token %q", i+1, rule.Token)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		group := -1
+		if rule.Group != nil {
+			group = *rule.Group
+			if group < 0 || group > re.NumSubexp() {
+				return fmt.Errorf("rule %d: pattern has no group %d", i+1, group)
+			}
+		}
+		g.rules = append(g.rules, highlightRule{token: tokenType, pattern: re, group: group})
+		hasToken[tokenType] = true
+	}
+
+	if !hasToken[TokenComment] {
+		var alts []string
+		if g.LineComment != "" {
+			alts = append(alts, regexp.QuoteMeta(g.LineComment)+`.*$`)
+		}
+		if len(g.BlockComment) == 2 {
+			alts = append(alts, regexp.QuoteMeta(g.BlockComment[0])+`[\s\S]*?`+regexp.QuoteMeta(g.BlockComment[1]))
+		}
+		if len(alts) > 0 {
+			g.rules = append(g.rules, highlightRule{token: TokenComment, pattern: regexp.MustCompile(strings.Join(alts, "|")), group: 0})
+		}
+	}
+
+	if !hasToken[TokenString] && len(g.Strings) > 0 {
+		var alts []string
+		for _, delim := range g.Strings {
+			q := regexp.QuoteMeta(delim)
+			if len(delim) == 1 {
+				alts = append(alts, q+`(?:[^`+q+`\\]|\\.)*`+q)
+			} else {
+				alts = append(alts, q+`[\s\S]*?`+q)
+			}
+		}
+		g.rules = append(g.rules, highlightRule{token: TokenString, pattern: regexp.MustCompile(strings.Join(alts, "|")), group: 0})
+	}
+
+	for i := range g.Embedded {
+		re, err := regexp.Compile(g.Embedded[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("embedded %s: %v", g.Embedded[i].Language, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("embedded %s: pattern needs a capture group", g.Embedded[i].Language)
+		}
+		g.Embedded[i].re = re
+	}
+
+	if g.Indent.Pattern != "" {
+		re, err := regexp.Compile(g.Indent.Pattern)
+		if err != nil {
+			return fmt.Errorf("indent pattern: %v", err)
+		}
+		g.Indent.re = re
+	}
+
+	if g.IgnoreCase {
+		for i, keyword := range g.Keywords {
+			g.Keywords[i] = strings.ToLower(keyword)
+		}
+	}
+
+	for i := range g.Regions {
+		region := &g.Regions[i]
+		re, err := regexp.Compile(region.Start)
+		if err != nil {
+			return fmt.Errorf("region %d: %v", i+1, err)
+		}
+		if region.End == "" {
+			return fmt.Errorf("region %d: no end pattern", i+1)
+		}
+		region.re = re
+		if region.Token != "" {
+			tokenType, ok := tokenTypeNames[region.Token]
+			if !ok {
+				return fmt.Errorf("region %d: unknown token %q", i+1, region.Token)
+			}
+			region.token = tokenType
+		}
+	}
+
+	for i := range g.Symbols {
+		symbol := &g.Symbols[i]
+		re, err := regexp.Compile(symbol.Pattern)
+		if err != nil {
+			return fmt.Errorf("symbol %d: %v", i+1, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("symbol %d: pattern needs a capture group for the name", i+1)
+		}
+		symbol.re = re
+	}
+
+	return nil
+}
+
+// grammar returns the grammar registered for format, or nil.
+func (r *grammarRegistry) grammar(format FileFormat) *Grammar {
+	return r.byFormat[format]
+}
+
+// lookup resolves a language name, alias or bare extension (as written after
+// a Markdown code fence), case-insensitively.
+func (r *grammarRegistry) lookup(name string) (FileFormat, bool) {
+	if name == "" {
+		return PlainText, false
+	}
+	key := strings.ToLower(name)
+	if f, ok := r.byName[key]; ok {
+		return f, true
+	}
+	if f, ok := r.byAlias[key]; ok {
+		return f, true
+	}
+	f, ok := r.byExt["."+key]
+	return f, ok
+}
+
+// formatForInterpreter resolves an interpreter name, ignoring a version
+// suffix such as python3.12 or lua5.4.
+func (r *grammarRegistry) formatForInterpreter(name string) (FileFormat, bool) {
+	if name == "" {
+		return PlainText, false
+	}
+	if format, ok := r.byShebang[name]; ok {
+		return format, true
+	}
+	format, ok := r.byShebang[strings.TrimRight(name, "0123456789.-")]
+	return format, ok
+}
+
+// formatForFile picks a format from a file's base name or extension.
+func (r *grammarRegistry) formatForFile(filename string) FileFormat {
+	base := filepath.Base(filename)
+	if f, ok := r.byFilename[base]; ok {
+		return f
+	}
+	for _, glob := range r.byGlob {
+		if ok, _ := filepath.Match(glob.pattern, base); ok {
+			return glob.format
+		}
+	}
+	if f, ok := r.byExt[strings.ToLower(filepath.Ext(filename))]; ok {
+		return f
+	}
+	return PlainText
+}
+
+func (f FileFormat) String() string {
+	if g := grammars.grammar(f); g != nil {
+		return g.Name
+	}
+	return "Plain Text"
+}
+
+// indentRules returns the indentation rules for format with defaults filled in.
+func indentRules(format FileFormat) IndentRules {
+	rules := IndentRules{MarkupTags: true}
+	if g := grammars.grammar(format); g != nil {
+		rules = g.Indent
+	}
+	if rules.Unit == "" {
+		rules.Unit = "\t"
+	}
+	if rules.OpenChars == "" {
+		rules.OpenChars = "{[("
+	}
+	return rules
+}
+
+// opensBlock reports whether line should indent the line after it.
+func (r IndentRules) opensBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return false
+	}
+
+	if r.re != nil && r.re.MatchString(line) {
+		return true
+	}
+
+	if strings.ContainsRune(r.OpenChars, rune(trimmed[len(trimmed)-1])) {
+		return true
+	}
+
+	lower := strings.ToLower(trimmed)
+	for _, keyword := range r.BlockKeywords {
+		if strings.HasSuffix(lower, keyword+r.KeywordSuffix) {
+			return true
+		}
+	}
+
+	// HTML/XML tag opening
+	if r.MarkupTags && strings.HasSuffix(trimmed, ">") && strings.Contains(trimmed, "<") {
+		// Check if it's not a self-closing tag or comment
+		if !strings.HasSuffix(trimmed, "/>") && !strings.HasSuffix(trimmed, "-->") &&
+			!strings.Contains(trimmed, "<!") {
+			// Look for opening tag without corresponding closing tag on same line
+			openTags := strings.Count(trimmed, "<") - strings.Count(trimmed, "</")
+			if openTags > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- INDENT GUIDES & CURRENT LINE -----------------
+
+// maxGuideScan caps how far a blank line looks for a neighbour to take its
+// indentation from
+const maxGuideScan = 100
+
+// indentGuides describes the guides on screen: the width of an indent level
+// and the guide of the scope the cursor is in
+type indentGuides struct {
+	unit                 int
+	activeCol            int // -1 when the cursor is at the top level
+	activeFrom, activeTo int // lines the active guide runs along
+}
+
+// lineIndent returns the visual width of a line's indentation, and whether
+// the line is blank
+func (e *Editor) lineIndent(idx int) (int, bool) {
+	line := e.lines[idx]
+	body := strings.TrimLeft(line, " \t")
+	if strings.TrimSpace(body) == "" {
+		return 0, true
+	}
+	return visualColForByteCol(line, len(line)-len(body)), false
+}
+
+// guideIndent is the indentation guides are drawn to on a line; blank lines
+// take the smaller indentation of the lines around them so guides run through
+func (e *Editor) guideIndent(idx int) int {
+	indent, blank := e.lineIndent(idx)
+	if !blank {
+		return indent
+	}
+	above, below := 0, 0
+	for i := idx - 1; i >= 0 && i >= idx-maxGuideScan; i-- {
+		if indent, blank := e.lineIndent(i); !blank {
+			above = indent
+			break
+		}
+	}
+	for i := idx + 1; i < len(e.lines) && i <= idx+maxGuideScan; i++ {
+		if indent, blank := e.lineIndent(i); !blank {
+			below = indent
+			break
+		}
+	}
+	return min(above, below)
+}
+
+// computeIndentGuides works out the guide of the cursor's scope: the level
+// the cursor line sits in, or the block it opens. Only the visible lines
+// are searched for the extent of the scope.
+func (e *Editor) computeIndentGuides() indentGuides {
+	g := indentGuides{unit: tabWidth, activeCol: -1}
+	if unit := e.indentUnit(); unit != "" && strings.Trim(unit, " ") == "" {
+		g.unit = len(unit)
+	}
+	if e.cursorLine >= len(e.lines) {
+		return g
+	}
+
+	cur := e.cursorLine
+	indent := e.guideIndent(cur)
+	active, from := indent-g.unit, cur
+	if _, blank := e.lineIndent(cur); !blank && cur+1 < len(e.lines) && e.guideIndent(cur+1) > indent {
+		// The cursor is on a line that opens a block
+		active, from = indent, cur+1
+	}
+	if active < 0 {
+		return g
+	}
+	g.activeCol = active / g.unit * g.unit
+
+	top, bottom := max(e.scrollOffset, 0), min(e.visibleEnd(), len(e.lines))-1
+	g.activeFrom = from
+	for g.activeFrom > top && e.guideIndent(g.activeFrom-1) > g.activeCol {
+		g.activeFrom--
+	}
+	g.activeTo = from
+	for g.activeTo < bottom && e.guideIndent(g.activeTo+1) > g.activeCol {
+		g.activeTo++
+	}
+	return g
+}
+
+// drawIndentGuides draws a guide at each indent level in a line's leading
+// whitespace; x is where the line's text starts on screen
+func (e *Editor) drawIndentGuides(g indentGuides, lineIdx, x, y, maxWidth int) {
+	indent := e.guideIndent(lineIdx)
+	r := glyph(options.IndentGuideGlyph, '│')
+	style := tcell.StyleDefault.Background(editorBackground).Foreground(themeColor(options.Theme.IndentGuide, tcell.NewRGBColor(42, 50, 66)))
+	activeStyle := style.Foreground(themeColor(options.Theme.ActiveIndentGuide, tcell.NewRGBColor(90, 106, 133)))
+	for col := 0; col < indent; col += g.unit {
+		vis := col - e.horizOffset
+		if vis < 0 || vis >= maxWidth {
+			continue
+		}
+		s := style
+		if col == g.activeCol && lineIdx >= g.activeFrom && lineIdx <= g.activeTo {
+			s = activeStyle
+		}
+		e.screen.SetContent(x+vis, y, r, nil, s)
+	}
+}
+
+// drawCurrentLine gives the cursor line's cells a background, leaving
+// cells that already have one of their own
+func (e *Editor) drawCurrentLine(x, y, width int) {
+	bg := themeColor(options.Theme.CurrentLine, tcell.NewRGBColor(28, 37, 54))
+	for col := x; col < x+width; col++ {
+		r, comb, style, _ := e.screen.GetContent(col, y)
+		if _, cellBg, _ := style.Decompose(); cellBg != editorBackground && cellBg != tcell.ColorDefault {
+			continue
+		}
+		if r == 0 {
+			r = ' '
+		}
+		e.screen.SetContent(col, y, r, comb, style.Background(bg))
+	}
+}
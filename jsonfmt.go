@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ----------------- JSON FORMATTING -----------------
+
+// jsonValue is a parsed JSON value that keeps its source text: object keys
+// stay in order and numbers and strings are written back as they were.
+type jsonValue struct {
+	kind    byte   // '{', '[' or 'v' for a scalar
+	text    string // a scalar's literal
+	keys    []string
+	members []*jsonValue // an object's values, in step with keys, or an array's items
+}
+
+// jsonSyntaxError locates a problem in JSON source, 1-based
+type jsonSyntaxError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (err *jsonSyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", err.Line, err.Col, err.Msg)
+}
+
+// maxJSONDepth bounds how deeply arrays and objects can nest, as
+// encoding/json does, so deep input can't overflow the stack
+const maxJSONDepth = 10000
+
+type jsonParser struct {
+	src   string
+	pos   int
+	depth int // arrays and objects open at pos
+}
+
+func parseJSON(src string) (*jsonValue, error) {
+	p := &jsonParser{src: src, pos: len(src) - len(strings.TrimPrefix(src, "\ufeff"))}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %s after the value", p.describe())
+	}
+	return v, nil
+}
+
+func (p *jsonParser) errorf(format string, args ...interface{}) error {
+	before := p.src[:min(p.pos, len(p.src))]
+	line := strings.Count(before, "\n") + 1
+	col := len(before) - strings.LastIndexByte(before, '\n')
+	return &jsonSyntaxError{Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// describe names what's at the current position, for error messages
+func (p *jsonParser) describe() string {
+	if p.pos >= len(p.src) {
+		return "end of input"
+	}
+	return strconv.QuoteRune(rune(p.src[p.pos]))
+}
+
+func (p *jsonParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *jsonParser) value() (*jsonValue, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end of input")
+	}
+	switch c := p.src[p.pos]; {
+	case (c == '{' || c == '[') && p.depth >= maxJSONDepth:
+		return nil, p.errorf("nested more than %d levels deep", maxJSONDepth)
+	case c == '{':
+		p.depth++
+		defer func() { p.depth-- }()
+		return p.object()
+	case c == '[':
+		p.depth++
+		defer func() { p.depth-- }()
+		return p.array()
+	case c == '"':
+		s, err := p.string()
+		return &jsonValue{kind: 'v', text: s}, err
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	}
+	for _, literal := range []string{"true", "false", "null"} {
+		if strings.HasPrefix(p.src[p.pos:], literal) {
+			p.pos += len(literal)
+			return &jsonValue{kind: 'v', text: literal}, nil
+		}
+	}
+	return nil, p.errorf("unexpected %s", p.describe())
+}
+
+func (p *jsonParser) object() (*jsonValue, error) {
+	v := &jsonValue{kind: '{'}
+	p.pos++
+	if p.skipSpace(); p.pos < len(p.src) && p.src[p.pos] == '}' {
+		p.pos++
+		return v, nil
+	}
+	for {
+		if p.skipSpace(); p.pos >= len(p.src) || p.src[p.pos] != '"' {
+			return nil, p.errorf("expected a string key, found %s", p.describe())
+		}
+		key, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		if p.skipSpace(); p.pos >= len(p.src) || p.src[p.pos] != ':' {
+			return nil, p.errorf("expected ':' after key, found %s", p.describe())
+		}
+		p.pos++
+		member, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, key)
+		v.members = append(v.members, member)
+		if done, err := p.next('}'); done || err != nil {
+			return v, err
+		}
+	}
+}
+
+func (p *jsonParser) array() (*jsonValue, error) {
+	v := &jsonValue{kind: '['}
+	p.pos++
+	if p.skipSpace(); p.pos < len(p.src) && p.src[p.pos] == ']' {
+		p.pos++
+		return v, nil
+	}
+	for {
+		item, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		v.members = append(v.members, item)
+		if done, err := p.next(']'); done || err != nil {
+			return v, err
+		}
+	}
+}
+
+// next consumes the ',' between members or the closing bracket
+func (p *jsonParser) next(closing byte) (bool, error) {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ',':
+			p.pos++
+			return false, nil
+		case closing:
+			p.pos++
+			return true, nil
+		}
+	}
+	return false, p.errorf("expected ',' or '%c', found %s", closing, p.describe())
+}
+
+// string scans a string literal and returns it as written
+func (p *jsonParser) string() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '"':
+			p.pos++
+			return p.src[start:p.pos], nil
+		case c == '\\':
+			p.pos++
+			if p.pos >= len(p.src) {
+				break
+			}
+			switch p.src[p.pos] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				p.pos++
+			case 'u':
+				hex := p.src[p.pos+1 : min(p.pos+5, len(p.src))]
+				if _, err := strconv.ParseUint(hex, 16, 16); err != nil || len(hex) < 4 {
+					return "", p.errorf("invalid \\u escape")
+				}
+				p.pos += 5
+			default:
+				return "", p.errorf("invalid escape '\\%c'", p.src[p.pos])
+			}
+		case c < 0x20:
+			return "", p.errorf("control character in string")
+		default:
+			p.pos++
+		}
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+func (p *jsonParser) number() (*jsonValue, error) {
+	start := p.pos
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '0' {
+		p.pos++
+	} else if digits() == 0 {
+		return nil, p.errorf("invalid number")
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		p.pos++
+		if digits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+	return &jsonValue{kind: 'v', text: p.src[start:p.pos]}, nil
+}
+
+// write prints v with indent per level, or all on one line when indent is empty
+func (v *jsonValue) write(b *strings.Builder, indent string, depth int) {
+	if v.kind == 'v' {
+		b.WriteString(v.text)
+		return
+	}
+	open, close := "[", "]"
+	if v.kind == '{' {
+		open, close = "{", "}"
+	}
+	b.WriteString(open)
+	if len(v.members) == 0 {
+		b.WriteString(close)
+		return
+	}
+	for i, member := range v.members {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if indent != "" {
+			b.WriteByte('\n')
+			b.WriteString(strings.Repeat(indent, depth+1))
+		}
+		if v.kind == '{' {
+			b.WriteString(v.keys[i])
+			b.WriteByte(':')
+			if indent != "" {
+				b.WriteByte(' ')
+			}
+		}
+		member.write(b, indent, depth+1)
+	}
+	if indent != "" {
+		b.WriteByte('\n')
+		b.WriteString(strings.Repeat(indent, depth))
+	}
+	b.WriteString(close)
+}
+
+// sortKeys orders every object's members by key, throughout v
+func (v *jsonValue) sortKeys() {
+	for _, member := range v.members {
+		member.sortKeys()
+	}
+	if v.kind != '{' {
+		return
+	}
+	order := make([]int, len(v.keys))
+	decoded := make([]string, len(v.keys))
+	for i, key := range v.keys {
+		order[i] = i
+		if s, err := strconv.Unquote(key); err == nil {
+			decoded[i] = s
+		} else {
+			decoded[i] = key
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return decoded[order[i]] < decoded[order[j]] })
+	keys := make([]string, len(order))
+	members := make([]*jsonValue, len(order))
+	for i, from := range order {
+		keys[i], members[i] = v.keys[from], v.members[from]
+	}
+	v.keys, v.members = keys, members
+}
+
+func rewriteJSON(src, indent string, sortKeys bool) (string, error) {
+	v, err := parseJSON(src)
+	if err != nil {
+		return "", err
+	}
+	if sortKeys {
+		v.sortKeys()
+	}
+	var b strings.Builder
+	v.write(&b, indent, 0)
+	return b.String(), nil
+}
+
+// formatJSON pretty-prints JSON with the configured indent, keeping key
+// order and literals as written
+func formatJSON(src string) (string, error) {
+	return rewriteJSON(src, options.JSONIndent, false)
+}
+
+func minifyJSON(src string) (string, error) {
+	return rewriteJSON(src, "", false)
+}
+
+func sortJSON(src string) (string, error) {
+	return rewriteJSON(src, options.JSONIndent, true)
+}
+
+// jsonCommand handles json-minify and json-sort
+func (e *Editor) jsonCommand(transform func(string) (string, error)) {
+	out, err := transform(strings.Join(e.lines, "\n"))
+	if err != nil {
+		e.showFormatError(err)
+		return
+	}
+	e.replaceBuffer(out)
+}
+
+// showFormatError reports a failed format, moving the cursor to a JSON
+// syntax error's position
+func (e *Editor) showFormatError(err error) {
+	e.message = "Format: " + err.Error()
+	var syntaxErr *jsonSyntaxError
+	if errors.As(err, &syntaxErr) && syntaxErr.Line <= len(e.lines) {
+		e.cursorLine = syntaxErr.Line - 1
+		e.cursorCol = min(syntaxErr.Col-1, len(e.lines[e.cursorLine]))
+		e.updateCursorVisualCol()
+		e.adjustScroll()
+	}
+}
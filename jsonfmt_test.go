@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRewriteJSON(t *testing.T) {
+	tests := []struct {
+		name, src string
+		indent    string
+		sortKeys  bool
+		want      string
+	}{
+		{
+			name:   "key order",
+			src:    `{"zeta": 1, "alpha": {"y": true, "x": null}, "mid": []}`,
+			indent: "  ",
+			want:   "{\n  \"zeta\": 1,\n  \"alpha\": {\n    \"y\": true,\n    \"x\": null\n  },\n  \"mid\": []\n}",
+		},
+		{
+			name:   "big numbers and literals as written",
+			src:    `[12345678901234567890123, 1.0, 1e400, -0.000, "é\/"]`,
+			indent: "\t",
+			want:   "[\n\t12345678901234567890123,\n\t1.0,\n\t1e400,\n\t-0.000,\n\t\"é\\/\"\n]",
+		},
+		{
+			name: "minify",
+			src:  "{\n  \"a\": [1, 2, {}],\n  \"b\": \"x y\"\n}\n",
+			want: `{"a":[1,2,{}],"b":"x y"}`,
+		},
+		{
+			name:     "sort",
+			src:      `{"b": {"d": 1, "c": 2}, "a": [{"z": 1, "y": 2}], "A": 0}`,
+			sortKeys: true,
+			want:     `{"A":0,"a":[{"y":2,"z":1}],"b":{"c":2,"d":1}}`,
+		},
+		{
+			name: "byte order mark",
+			src:  "\ufeff[true]",
+			want: `[true]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriteJSON(tt.src, tt.indent, tt.sortKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONErrors(t *testing.T) {
+	tests := []struct {
+		src       string
+		line, col int
+		msg       string
+	}{
+		{`{"a": 1,}`, 1, 9, `expected a string key, found '}'`},
+		{"{\n  \"a\" 1\n}", 2, 7, `expected ':' after key, found '1'`},
+		{"[1,\n 2\n 3]", 3, 2, `expected ',' or ']', found '3'`},
+		{`["abc`, 1, 2, "unterminated string"},
+		{`[01]`, 1, 3, `expected ',' or ']', found '1'`},
+		{`[1.]`, 1, 4, "invalid number"},
+		{`["\x"]`, 1, 4, `invalid escape '\x'`},
+		{`[tru]`, 1, 2, `unexpected 't'`},
+		{`{} {}`, 1, 4, `unexpected '{' after the value`},
+		{``, 1, 1, "unexpected end of input"},
+		{strings.Repeat("[", maxJSONDepth+1), 1, maxJSONDepth + 1, "nested more than 10000 levels deep"},
+	}
+	for _, tt := range tests {
+		_, err := parseJSON(tt.src)
+		var syntaxErr *jsonSyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%.20q: got %v, want a syntax error", tt.src, err)
+			continue
+		}
+		if syntaxErr.Line != tt.line || syntaxErr.Col != tt.col || syntaxErr.Msg != tt.msg {
+			t.Errorf("%.20q: got %d:%d %s, want %d:%d %s", tt.src, syntaxErr.Line, syntaxErr.Col, syntaxErr.Msg, tt.line, tt.col, tt.msg)
+		}
+	}
+}
+
+// TestParseJSONDeep checks that nesting as deep as allowed still parses,
+// and that far deeper input fails rather than overflowing the stack
+func TestParseJSONDeep(t *testing.T) {
+	src := strings.Repeat("[", maxJSONDepth) + strings.Repeat("]", maxJSONDepth)
+	if _, err := minifyJSON(src); err != nil {
+		t.Errorf("%d levels: %v", maxJSONDepth, err)
+	}
+	if _, err := parseJSON(strings.Repeat(`{"a":`, 10_000_000)); err == nil {
+		t.Error("ten million levels parsed")
+	}
+}
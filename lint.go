@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ----------------- LINTING -----------------
+
+// defaultLinters are the commands checking a saved file, by grammar name.
+// They run in the file's directory; "{file}" is replaced with its name, and
+// a linter without it checks the whole directory, as go vet does.
+var defaultLinters = map[string][]string{
+	"Go":         {"go", "vet", "."},
+	"Shell":      {"shellcheck", "-f", "gcc", "{file}"},
+	"Python":     {"flake8", "{file}"},
+	"JavaScript": {"eslint", "-f", "compact", "{file}"},
+	"TypeScript": {"eslint", "-f", "compact", "{file}"},
+}
+
+// linterFor returns the command linting a format's files, if there is one
+func linterFor(format FileFormat) ([]string, bool) {
+	if command, ok := forLanguage(options.Linters, format); ok {
+		return command, len(command) > 0
+	}
+	if g := grammars.grammar(format); g != nil {
+		command := defaultLinters[g.Name]
+		return command, len(command) > 0
+	}
+	return nil, false
+}
+
+// linterName is what diagnostics from a linter give as their source
+func linterName(command []string) string {
+	name := filepath.Base(command[0])
+	if name == "go" && len(command) > 1 {
+		name += " " + command[1]
+	}
+	return name
+}
+
+// lint runs the buffer's linter on the saved file in the background and
+// puts what it finds in the error list, in place of its earlier findings.
+// Only a lint asked for by command reports a missing or silent linter.
+func (e *Editor) lint(requested bool) {
+	command, ok := linterFor(e.format)
+	switch {
+	case !ok:
+		if requested {
+			e.message = "No linter for " + e.format.String()
+		}
+		return
+	case e.filename == "":
+		if requested {
+			e.message = "Save the buffer before linting it"
+		}
+		return
+	}
+	file, err := filepath.Abs(e.filename)
+	if err != nil {
+		e.message = "Lint: " + err.Error()
+		return
+	}
+	dir := filepath.Dir(file)
+	config, err := loadProjectConfig(workspaceRoot(file))
+	if err == nil {
+		var formats []compiledErrorFormat
+		if formats, err = compileErrorFormats(config.ErrorFormats); err == nil {
+			e.startLint(command, file, dir, formats, requested)
+			return
+		}
+	}
+	e.message = "Lint: " + err.Error()
+}
+
+func (e *Editor) startLint(command []string, file, dir string, formats []compiledErrorFormat, requested bool) {
+	perFile := false
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = strings.ReplaceAll(arg, "{file}", file)
+		perFile = perFile || args[i] != arg
+	}
+	source := linterName(args)
+	saved := append([]string(nil), e.lines...)
+	e.lintGen++
+	gen := e.lintGen
+	if requested {
+		e.message = "Running " + strings.Join(args, " ")
+	}
+
+	screen := e.screen
+	go func() {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		diags := parseErrors(string(out), dir, formats)
+		for i := range diags {
+			diags[i].Source = source
+		}
+		postFuncEvent(screen, func(e *Editor) {
+			if gen != e.lintGen {
+				return // a later save is being linted
+			}
+			var execErr *exec.Error
+			switch {
+			case errors.As(err, &execErr):
+				if requested {
+					e.message = "Lint: " + execErr.Error()
+				}
+				return
+			case err != nil && len(diags) == 0:
+				e.message = "Lint failed: " + err.Error()
+				if line := firstLine(string(out)); line != "" {
+					e.message = "Lint failed: " + line
+				}
+				return
+			}
+
+			// Findings in the buffer are about the saved text, which may
+			// have been edited since
+			if sameFile(file, e.filename) {
+				e.trackDiagnostics()
+				var moved []Diagnostic
+				for _, d := range diags {
+					if sameFile(d.File, file) {
+						moved = append(moved, moveDiagnostics([]Diagnostic{d}, saved, e.lines)...)
+					} else {
+						moved = append(moved, d)
+					}
+				}
+				diags = moved
+			}
+			list := diags
+			for _, d := range e.errorList {
+				linted := sameFile(d.File, file) || !perFile && filepath.Dir(d.File) == dir
+				if d.Source != source || !linted {
+					list = append(list, d)
+				}
+			}
+			e.setErrorList(list)
+			if requested || len(diags) > 0 {
+				e.message = fmt.Sprintf("%s: %d problem(s)", source, len(diags))
+			}
+		})
+	}()
+}
+
+// ----------------- DIAGNOSTIC TRACKING -----------------
+
+// trackDiagnostics keeps the buffer's diagnostics with their text as it's
+// edited: those on changed lines are dropped and those below move with
+// the lines after them
+func (e *Editor) trackDiagnostics() {
+	old := e.diagnosedLines
+	if old != nil && !linesChanged(old, e.lines) {
+		return
+	}
+	e.diagnosedLines = append(old[:0:0], e.lines...)
+	if old == nil {
+		return
+	}
+	var list []Diagnostic
+	for _, d := range e.errorList {
+		if sameFile(d.File, e.filename) {
+			list = append(list, moveDiagnostics([]Diagnostic{d}, old, e.lines)...)
+		} else {
+			list = append(list, d)
+		}
+	}
+	e.errorList = list
+	e.errorIndex = min(e.errorIndex, len(list)-1)
+	if e.lsp != nil {
+		e.lsp.diagnostics = moveDiagnostics(e.lsp.diagnostics, old, e.lines)
+	}
+	e.refreshDiagnostics()
+}
+
+func linesChanged(old, lines []string) bool {
+	if len(old) != len(lines) {
+		return true
+	}
+	for i := range old {
+		if old[i] != lines[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// moveDiagnostics carries diagnostics about old over to lines, which
+// differ from it in one stretch of lines
+func moveDiagnostics(diags []Diagnostic, old, lines []string) []Diagnostic {
+	prefix := 0
+	for prefix < len(old) && prefix < len(lines) && old[prefix] == lines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(lines)-prefix && old[len(old)-1-suffix] == lines[len(lines)-1-suffix] {
+		suffix++
+	}
+	changedTo := len(old) - suffix
+	delta := len(lines) - len(old)
+
+	var moved []Diagnostic
+	for _, d := range diags {
+		switch {
+		case max(d.EndLine, d.Line) < prefix:
+		case d.Line >= changedTo:
+			d.Line += delta
+			d.EndLine += delta
+		default:
+			continue
+		}
+		moved = append(moved, d)
+	}
+	return moved
+}
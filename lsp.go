@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------- JSON-RPC -----------------
+
+// lspTimeout bounds how long a request waits for the server's answer
+const lspTimeout = 10 * time.Second
+
+// errLSPClosed is returned by requests on a connection that has gone away
+var errLSPClosed = errors.New("language server connection closed")
+
+// lspMessage is any JSON-RPC 2.0 message: a request, a response or a notification
+type lspMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *lspError       `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *lspError) Error() string {
+	return fmt.Sprintf("%s (%d)", err.Message, err.Code)
+}
+
+// methodNotFound is the error for requests a handler doesn't know
+func methodNotFound(method string) *lspError {
+	return &lspError{Code: -32601, Message: "method not found: " + method}
+}
+
+// lspConn speaks JSON-RPC with Content-Length framing over any transport,
+// a language server's stdio or one end of a net.Pipe. Both ends of a
+// connection are the same type, so a fake server is an lspConn too.
+type lspConn struct {
+	rwc       io.ReadWriteCloser
+	writeLock sync.Mutex // one message on the wire at a time
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan *lspMessage
+	err     error // why the connection closed, once it has
+
+	// handle answers requests from the other end; notify receives its
+	// notifications. Both run on the reading goroutine.
+	handle func(method string, params json.RawMessage) (interface{}, error)
+	notify func(method string, params json.RawMessage)
+	done   chan struct{}
+}
+
+func newLSPConn(rwc io.ReadWriteCloser) *lspConn {
+	return &lspConn{rwc: rwc, pending: map[int]chan *lspMessage{}, done: make(chan struct{})}
+}
+
+// start reads messages until the transport fails or is closed
+func (c *lspConn) start() {
+	go func() {
+		r := bufio.NewReader(c.rwc)
+		for {
+			msg, err := readLSPMessage(r)
+			if err != nil {
+				c.shutdown(err)
+				return
+			}
+			c.dispatch(msg)
+		}
+	}()
+}
+
+func readLSPMessage(r *bufio.Reader) (*lspMessage, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("bad Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	msg := &lspMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *lspConn) dispatch(msg *lspMessage) {
+	switch {
+	case msg.Method != "" && msg.ID != nil:
+		var result interface{}
+		var err error = methodNotFound(msg.Method)
+		if c.handle != nil {
+			result, err = c.handle(msg.Method, msg.Params)
+		}
+		reply := &lspMessage{ID: msg.ID}
+		if rpcErr, ok := err.(*lspError); ok {
+			reply.Error = rpcErr
+		} else if err != nil {
+			reply.Error = &lspError{Code: -32603, Message: err.Error()}
+		} else if reply.Result, err = json.Marshal(result); err != nil {
+			reply.Result, reply.Error = nil, &lspError{Code: -32603, Message: err.Error()}
+		}
+		c.write(reply)
+	case msg.Method != "":
+		if c.notify != nil {
+			c.notify(msg.Method, msg.Params)
+		}
+	default:
+		id, err := strconv.Atoi(string(msg.ID))
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+func (c *lspConn) write(msg *lspMessage) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err = fmt.Fprintf(c.rwc, "Content-Length: %d\r\n\r\n", len(body)); err == nil {
+		_, err = c.rwc.Write(body)
+	}
+	return err
+}
+
+// call sends a request and decodes the answer into result, which may be nil
+func (c *lspConn) call(method string, params, result interface{}) error {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan *lspMessage, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	if err := c.write(&lspMessage{ID: json.RawMessage(strconv.Itoa(id)), Method: method, Params: raw}); err != nil {
+		c.shutdown(err)
+		return err
+	}
+
+	select {
+	case reply := <-ch:
+		if reply.Error != nil {
+			return reply.Error
+		}
+		if result == nil || len(reply.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(reply.Result, result)
+	case <-c.done:
+		return c.closedErr()
+	case <-time.After(lspTimeout):
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		c.notifyOther("$/cancelRequest", map[string]int{"id": id})
+		return fmt.Errorf("%s: no answer from language server", method)
+	}
+}
+
+// notifyOther sends a notification, which gets no answer
+func (c *lspConn) notifyOther(method string, params interface{}) error {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+	return c.write(&lspMessage{Method: method, Params: raw})
+}
+
+// marshalParams encodes params, leaving them out of the message when nil
+func marshalParams(params interface{}) (json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	return json.Marshal(params)
+}
+
+func (c *lspConn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// shutdown fails every waiting request and closes the transport
+func (c *lspConn) shutdown(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	if err == nil || err == io.EOF {
+		err = errLSPClosed
+	}
+	c.err = err
+	c.pending = map[int]chan *lspMessage{}
+	c.mu.Unlock()
+	close(c.done)
+	c.rwc.Close()
+}
+
+// ----------------- LSP PROTOCOL -----------------
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+// lspContentChange is one edit in a didChange notification; without a
+// range it replaces the whole document
+type lspContentChange struct {
+	Range *lspRange `json:"range,omitempty"`
+	Text  string    `json:"text"`
+}
+
+const (
+	lspSeverityError = iota + 1
+	lspSeverityWarning
+	lspSeverityInformation
+	lspSeverityHint
+)
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label      string `json:"label"`
+	Kind       int    `json:"kind"`
+	Detail     string `json:"detail"`
+	InsertText string `json:"insertText"`
+	FilterText string `json:"filterText"`
+	// TextEdit is decoded from either a TextEdit or an InsertReplaceEdit
+	TextEdit *lspTextEdit `json:"-"`
+}
+
+func (item *lspCompletionItem) UnmarshalJSON(data []byte) error {
+	type plain lspCompletionItem
+	var raw struct {
+		plain
+		TextEdit *struct {
+			Range   *lspRange `json:"range"`
+			Insert  *lspRange `json:"insert"`
+			NewText string    `json:"newText"`
+		} `json:"textEdit"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*item = lspCompletionItem(raw.plain)
+	if te := raw.TextEdit; te != nil {
+		if te.Range == nil {
+			te.Range = te.Insert
+		}
+		if te.Range != nil {
+			item.TextEdit = &lspTextEdit{Range: *te.Range, NewText: te.NewText}
+		}
+	}
+	return nil
+}
+
+// text is what accepting the item inserts
+func (item lspCompletionItem) text() string {
+	switch {
+	case item.TextEdit != nil:
+		return item.TextEdit.NewText
+	case item.InsertText != "":
+		return item.InsertText
+	}
+	return item.Label
+}
+
+type lspWorkspaceEdit struct {
+	Changes         map[string][]lspTextEdit `json:"changes"`
+	DocumentChanges []struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+		Edits []lspTextEdit `json:"edits"`
+	} `json:"documentChanges"`
+}
+
+// edits gathers the edits per document from either form of the edit;
+// file creates, renames and deletes aren't supported and are skipped
+func (we lspWorkspaceEdit) edits() map[string][]lspTextEdit {
+	all := map[string][]lspTextEdit{}
+	for uri, edits := range we.Changes {
+		all[uri] = append(all[uri], edits...)
+	}
+	for _, change := range we.DocumentChanges {
+		if change.TextDocument.URI != "" {
+			all[change.TextDocument.URI] = append(all[change.TextDocument.URI], change.Edits...)
+		}
+	}
+	return all
+}
+
+// ----------------- LSP CLIENT -----------------
+
+// lspSync is how the server wants document changes sent
+const (
+	lspSyncNone = iota
+	lspSyncFull
+	lspSyncIncremental
+)
+
+// lspClient is an initialized connection to one language server
+type lspClient struct {
+	conn *lspConn
+	name string // the server's name, for messages
+	utf8 bool   // positions count bytes rather than UTF-16 code units
+	sync int    // one of the lspSync kinds
+
+	// onDiagnostics receives the server's diagnostics for a document
+	onDiagnostics func(uri string, diags []lspDiagnostic)
+}
+
+// newLSPClient starts the LSP handshake over rwc. rootDir is the workspace
+// the server should index.
+func newLSPClient(rwc io.ReadWriteCloser, name, rootDir string, onDiagnostics func(string, []lspDiagnostic)) (*lspClient, error) {
+	client := &lspClient{conn: newLSPConn(rwc), name: name, sync: lspSyncFull, onDiagnostics: onDiagnostics}
+	client.conn.handle = client.handleRequest
+	client.conn.notify = client.handleNotification
+	client.conn.start()
+
+	rootURI := fileURI(rootDir)
+	params := map[string]interface{}{
+		"processId":        os.Getpid(),
+		"clientInfo":       map[string]string{"name": "site"},
+		"rootUri":          rootURI,
+		"workspaceFolders": []map[string]string{{"uri": rootURI, "name": filepath.Base(rootDir)}},
+		"capabilities": map[string]interface{}{
+			"general": map[string]interface{}{"positionEncodings": []string{"utf-8", "utf-16"}},
+			"workspace": map[string]interface{}{
+				"workspaceFolders": true,
+				"configuration":    true,
+				"workspaceEdit":    map[string]interface{}{"documentChanges": true},
+			},
+			"textDocument": map[string]interface{}{
+				"synchronization":    map[string]interface{}{"didSave": true},
+				"hover":              map[string]interface{}{"contentFormat": []string{"plaintext", "markdown"}},
+				"completion":         map[string]interface{}{"completionItem": map[string]bool{"snippetSupport": false}},
+				"definition":         map[string]interface{}{"linkSupport": true},
+				"references":         map[string]interface{}{},
+				"rename":             map[string]interface{}{},
+				"publishDiagnostics": map[string]interface{}{},
+			},
+		},
+	}
+	var result struct {
+		Capabilities struct {
+			PositionEncoding string          `json:"positionEncoding"`
+			TextDocumentSync json.RawMessage `json:"textDocumentSync"`
+		} `json:"capabilities"`
+		ServerInfo struct {
+			Name string `json:"name"`
+		} `json:"serverInfo"`
+	}
+	if err := client.conn.call("initialize", params, &result); err != nil {
+		client.conn.shutdown(err)
+		return nil, err
+	}
+	client.utf8 = result.Capabilities.PositionEncoding == "utf-8"
+	if result.ServerInfo.Name != "" {
+		client.name = result.ServerInfo.Name
+	}
+
+	// textDocumentSync is either the kind or an options object holding it
+	if sync := result.Capabilities.TextDocumentSync; len(sync) > 0 {
+		var kind int
+		var opts struct {
+			Change *int `json:"change"`
+		}
+		if json.Unmarshal(sync, &kind) == nil {
+			client.sync = kind
+		} else if json.Unmarshal(sync, &opts) == nil && opts.Change != nil {
+			client.sync = *opts.Change
+		}
+	}
+
+	if err := client.conn.notifyOther("initialized", struct{}{}); err != nil {
+		client.conn.shutdown(err)
+		return nil, err
+	}
+	return client, nil
+}
+
+// handleRequest answers what servers commonly ask of a client
+func (c *lspClient) handleRequest(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "workspace/configuration":
+		var p struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		json.Unmarshal(params, &p)
+		return make([]interface{}, len(p.Items)), nil
+	case "window/workDoneProgress/create", "client/registerCapability", "client/unregisterCapability":
+		return nil, nil
+	case "workspace/applyEdit":
+		return map[string]bool{"applied": false}, nil
+	case "workspace/workspaceFolders":
+		return nil, nil
+	}
+	return nil, methodNotFound(method)
+}
+
+func (c *lspClient) handleNotification(method string, params json.RawMessage) {
+	if method != "textDocument/publishDiagnostics" || c.onDiagnostics == nil {
+		return
+	}
+	var p struct {
+		URI         string          `json:"uri"`
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	if json.Unmarshal(params, &p) == nil {
+		c.onDiagnostics(p.URI, p.Diagnostics)
+	}
+}
+
+// alive reports whether the connection is still up
+func (c *lspClient) alive() bool {
+	return c.conn.closedErr() == nil
+}
+
+func (c *lspClient) didOpen(uri, languageID string, version int, text string) error {
+	return c.conn.notifyOther("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": languageID, "version": version, "text": text},
+	})
+}
+
+func (c *lspClient) didChange(uri string, version int, changes []lspContentChange) error {
+	return c.conn.notifyOther("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": version},
+		"contentChanges": changes,
+	})
+}
+
+func (c *lspClient) didSave(uri string) error {
+	return c.conn.notifyOther("textDocument/didSave", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+	})
+}
+
+func (c *lspClient) didClose(uri string) error {
+	return c.conn.notifyOther("textDocument/didClose", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+	})
+}
+
+func positionParams(uri string, pos lspPosition) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     pos,
+	}
+}
+
+// hover returns the server's hover text at pos as plain lines of text
+func (c *lspClient) hover(uri string, pos lspPosition) (string, error) {
+	var result *struct {
+		Contents json.RawMessage `json:"contents"`
+	}
+	if err := c.conn.call("textDocument/hover", positionParams(uri, pos), &result); err != nil || result == nil {
+		return "", err
+	}
+	return hoverText(result.Contents), nil
+}
+
+// hoverText flattens MarkupContent, a MarkedString or a list of them
+func hoverText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil {
+		var parts []string
+		for _, item := range list {
+			if text := hoverText(item); text != "" {
+				parts = append(parts, text)
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	var markup struct {
+		Value string `json:"value"`
+	}
+	json.Unmarshal(raw, &markup)
+	return markup.Value
+}
+
+// definition returns where the symbol at pos is declared
+func (c *lspClient) definition(uri string, pos lspPosition) ([]lspLocation, error) {
+	var result json.RawMessage
+	if err := c.conn.call("textDocument/definition", positionParams(uri, pos), &result); err != nil {
+		return nil, err
+	}
+	return decodeLocations(result), nil
+}
+
+// decodeLocations reads a Location, a list of them or a list of LocationLinks
+func decodeLocations(raw json.RawMessage) []lspLocation {
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		list = []json.RawMessage{raw}
+	}
+	var locations []lspLocation
+	for _, item := range list {
+		var loc struct {
+			lspLocation
+			TargetURI            string   `json:"targetUri"`
+			TargetSelectionRange lspRange `json:"targetSelectionRange"`
+		}
+		if json.Unmarshal(item, &loc) != nil {
+			continue
+		}
+		if loc.TargetURI != "" {
+			loc.URI, loc.Range = loc.TargetURI, loc.TargetSelectionRange
+		}
+		if loc.URI != "" {
+			locations = append(locations, loc.lspLocation)
+		}
+	}
+	return locations
+}
+
+// references returns every use of the symbol at pos, its declaration included
+func (c *lspClient) references(uri string, pos lspPosition) ([]lspLocation, error) {
+	params := positionParams(uri, pos)
+	params["context"] = map[string]bool{"includeDeclaration": true}
+	var result []lspLocation
+	err := c.conn.call("textDocument/references", params, &result)
+	return result, err
+}
+
+// completion returns the candidates the server offers at pos
+func (c *lspClient) completion(uri string, pos lspPosition) ([]lspCompletionItem, error) {
+	var result json.RawMessage
+	if err := c.conn.call("textDocument/completion", positionParams(uri, pos), &result); err != nil {
+		return nil, err
+	}
+	var items []lspCompletionItem
+	if json.Unmarshal(result, &items) == nil {
+		return items, nil
+	}
+	var list struct {
+		Items []lspCompletionItem `json:"items"`
+	}
+	err := json.Unmarshal(result, &list)
+	return list.Items, err
+}
+
+// rename asks for the edits that rename the symbol at pos to newName
+func (c *lspClient) rename(uri string, pos lspPosition, newName string) (lspWorkspaceEdit, error) {
+	params := positionParams(uri, pos)
+	params["newName"] = newName
+	var result lspWorkspaceEdit
+	err := c.conn.call("textDocument/rename", params, &result)
+	return result, err
+}
+
+// close shuts the server down politely, then drops the connection
+func (c *lspClient) close() {
+	if c.alive() {
+		c.conn.call("shutdown", nil, nil)
+		c.conn.notifyOther("exit", nil)
+	}
+	c.conn.shutdown(nil)
+}
+
+// ----------------- POSITIONS & URIS -----------------
+
+// lspCharacter converts a byte column in line to the server's character offset
+func (c *lspClient) lspCharacter(line string, col int) int {
+	col = min(max(col, 0), len(line))
+	if c.utf8 {
+		return col
+	}
+	units := 0
+	for _, r := range line[:col] {
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	return units
+}
+
+// byteCol converts the server's character offset in line to a byte column
+func (c *lspClient) byteCol(line string, character int) int {
+	if c.utf8 {
+		return min(max(character, 0), len(line))
+	}
+	units := 0
+	for i, r := range line {
+		if units >= character {
+			return i
+		}
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	return len(line)
+}
+
+// position converts a line and byte column in lines to an LSP position
+func (c *lspClient) position(lines []string, line, col int) lspPosition {
+	if line >= len(lines) {
+		return lspPosition{Line: line}
+	}
+	return lspPosition{Line: line, Character: c.lspCharacter(lines[line], col)}
+}
+
+func fileURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// uriPath returns the local path of a file:// URI
+func uriPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+// ----------------- SERVER PROCESSES -----------------
+
+// defaultLanguageServers are the commands started for each language, by
+// grammar name; config.json's languageServers adds to or replaces them
+var defaultLanguageServers = map[string][]string{
+	"Go":     {"gopls"},
+	"Python": {"pyright-langserver", "--stdio"},
+	"Rust":   {"rust-analyzer"},
+	"C":      {"clangd"},
+	"CPP":    {"clangd"},
+}
+
+// languageServerCommand returns the server command for a format, if any
+func languageServerCommand(format FileFormat) []string {
+	if argv, ok := forLanguage(options.LanguageServers, format); ok {
+		return argv
+	}
+	if g := grammars.grammar(format); g != nil {
+		return defaultLanguageServers[g.Name]
+	}
+	return nil
+}
+
+// languageID is the LSP identifier for a format's language
+func languageID(format FileFormat) string {
+	switch format {
+	case CPP:
+		return "cpp"
+	case Shell:
+		return "shellscript"
+	case SquidPlusPlus:
+		return "squidplusplus"
+	}
+	return strings.ToLower(format.String())
+}
+
+// workspaceMarkers identify the root directory of a project
+var workspaceMarkers = []string{"go.work", "go.mod", "Cargo.toml", "pyproject.toml", "setup.py", "compile_commands.json", ".git"}
+
+// workspaceRoot walks up from a file to the nearest directory holding a
+// project marker, or returns the file's directory
+func workspaceRoot(filename string) string {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return filepath.Dir(filename)
+	}
+	start := filepath.Dir(abs)
+	for dir := start; ; dir = filepath.Dir(dir) {
+		for _, marker := range workspaceMarkers {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				return dir
+			}
+		}
+		if filepath.Dir(dir) == dir {
+			return start
+		}
+	}
+}
+
+// lspProcess is a language server's stdio as a transport. Its output comes
+// through a pipe of our own rather than StdoutPipe, so waiting for the
+// server can't close it under a read.
+type lspProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	eof    chan struct{} // closed once reading the output fails
+	once   sync.Once
+}
+
+func (p *lspProcess) Read(b []byte) (int, error) {
+	n, err := p.stdout.Read(b)
+	if err != nil {
+		p.once.Do(func() { close(p.eof) })
+	}
+	return n, err
+}
+
+func (p *lspProcess) Write(b []byte) (int, error) { return p.stdin.Write(b) }
+
+// Close ends the server: its input closes, and once its output has ended
+// it's waited for. A server that doesn't exit within a moment is killed.
+func (p *lspProcess) Close() error {
+	p.stdin.Close()
+	select {
+	case <-p.eof:
+	case <-time.After(2 * time.Second):
+		p.cmd.Process.Kill()
+		// The reader may have stopped before the output ended
+		select {
+		case <-p.eof:
+		case <-time.After(time.Second):
+		}
+	}
+	p.cmd.Wait()
+	return p.stdout.Close()
+}
+
+// startLanguageServer runs argv in dir and connects to its stdio
+func startLanguageServer(argv []string, dir string) (io.ReadWriteCloser, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("no language server configured")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	// Stderr is left to go to the null device: discarding it through a
+	// goroutine would hold Wait up while anything the server started lives
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = writer
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, err
+	}
+	return &lspProcess{cmd: cmd, stdin: stdin, stdout: stdout, eof: make(chan struct{})}, nil
+}
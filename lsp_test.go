@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeServer is an in-process language server on one end of a net.Pipe.
+// It asks for incremental sync, answers rename with fixed edits and, on
+// every didChange, publishes a diagnostic carrying the change's text.
+type fakeServer struct {
+	conn    *lspConn
+	changes chan lspContentChange
+	rename  lspWorkspaceEdit
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, net.Conn) {
+	serverSide, clientSide := net.Pipe()
+	s := &fakeServer{conn: newLSPConn(serverSide), changes: make(chan lspContentChange, 10)}
+	s.conn.handle = func(method string, params json.RawMessage) (interface{}, error) {
+		switch method {
+		case "initialize":
+			return map[string]interface{}{
+				"capabilities": map[string]interface{}{"textDocumentSync": map[string]int{"change": lspSyncIncremental}},
+				"serverInfo":   map[string]string{"name": "fake"},
+			}, nil
+		case "textDocument/rename":
+			return s.rename, nil
+		case "shutdown":
+			return nil, nil
+		}
+		return nil, methodNotFound(method)
+	}
+	s.conn.notify = func(method string, params json.RawMessage) {
+		if method != "textDocument/didChange" {
+			return
+		}
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []lspContentChange `json:"contentChanges"`
+		}
+		json.Unmarshal(params, &p)
+		for _, change := range p.ContentChanges {
+			s.changes <- change
+			s.conn.notifyOther("textDocument/publishDiagnostics", map[string]interface{}{
+				"uri": p.TextDocument.URI,
+				"diagnostics": []lspDiagnostic{{
+					Range:    lspRange{Start: lspPosition{Line: 1}, End: lspPosition{Line: 1, Character: 3}},
+					Severity: lspSeverityWarning,
+					Message:  "changed to " + change.Text,
+				}},
+			})
+		}
+	}
+	s.conn.start()
+	t.Cleanup(func() { s.conn.shutdown(nil) })
+	return s, clientSide
+}
+
+func TestLSPClient(t *testing.T) {
+	server, clientSide := newFakeServer(t)
+	diagnostics := make(chan []lspDiagnostic, 10)
+	client, err := newLSPClient(clientSide, "fallback", t.TempDir(), func(uri string, diags []lspDiagnostic) {
+		diagnostics <- diags
+	})
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	defer client.close()
+	if client.name != "fake" || client.sync != lspSyncIncremental || client.utf8 {
+		t.Fatalf("after initialize: name %q, sync %d, utf8 %v; want fake, incremental, UTF-16", client.name, client.sync, client.utf8)
+	}
+
+	// An edit goes as a range covering only the characters that changed
+	uri := fileURI(filepath.Join(t.TempDir(), "a.go"))
+	old := []string{"package a", "var x = 1", "var y = x"}
+	lines := []string{"package a", "var xy = 1", "var y = x"}
+	if err := client.didOpen(uri, "go", 1, "package a\nvar x = 1\nvar y = x"); err != nil {
+		t.Fatal(err)
+	}
+	change, changed := client.contentChange(old, lines)
+	if !changed {
+		t.Fatal("contentChange found no change")
+	}
+	if err := client.didChange(uri, 2, []lspContentChange{change}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-server.changes:
+		want := lspContentChange{Range: &lspRange{Start: lspPosition{Line: 1, Character: 5}, End: lspPosition{Line: 1, Character: 5}}, Text: "y"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("didChange sent %+v (range %+v), want %+v (range %+v)", got, got.Range, want, want.Range)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the server got no didChange")
+	}
+	select {
+	case diags := <-diagnostics:
+		if len(diags) != 1 || diags[0].Message != "changed to y" || diags[0].Severity != lspSeverityWarning {
+			t.Errorf("publishDiagnostics gave %+v", diags)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no diagnostics were published")
+	}
+
+	// Rename edits the buffer's text and writes the other files
+	dir := t.TempDir()
+	other := filepath.Join(dir, "b.go")
+	if err := os.WriteFile(other, []byte("package a\n\nvar z = x + x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	at := func(line, start, end int) lspRange {
+		return lspRange{Start: lspPosition{Line: line, Character: start}, End: lspPosition{Line: line, Character: end}}
+	}
+	server.rename = lspWorkspaceEdit{Changes: map[string][]lspTextEdit{
+		uri:            {{Range: at(1, 4, 6), NewText: "w"}, {Range: at(2, 8, 9), NewText: "w"}},
+		fileURI(other): {{Range: at(2, 8, 9), NewText: "w"}, {Range: at(2, 12, 13), NewText: "w"}},
+	}}
+	edit, err := client.rename(uri, lspPosition{Line: 1, Character: 4}, "w")
+	if err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	edits := edit.edits()
+	if got, want := applyTextEdits(client, lines, edits[uri]), []string{"package a", "var w = 1", "var y = w"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("renamed buffer is %q, want %q", got, want)
+	}
+	files, err := writeTextEdits(client, edits, uri)
+	if err != nil || files != 1 {
+		t.Fatalf("writeTextEdits wrote %d file(s), %v; want 1", files, err)
+	}
+	data, _ := os.ReadFile(other)
+	if want := "package a\n\nvar z = w + w\n"; string(data) != want {
+		t.Errorf("renamed file is %q, want %q", data, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+// TestWriteTextEditsAllOrNothing checks that a file that can't be written
+// leaves the others untouched
+func TestWriteTextEditsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.go")
+	if err := os.WriteFile(good, []byte("var x = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &lspClient{}
+	edit := []lspTextEdit{{Range: lspRange{Start: lspPosition{Character: 4}, End: lspPosition{Character: 5}}, NewText: "y"}}
+	edits := map[string][]lspTextEdit{
+		fileURI(good):                          edit,
+		fileURI(filepath.Join(dir, "gone.go")): edit,
+	}
+	if _, err := writeTextEdits(client, edits, ""); err == nil {
+		t.Fatal("writeTextEdits succeeded with a missing file")
+	}
+	if data, _ := os.ReadFile(good); string(data) != "var x = 1\n" {
+		t.Errorf("good.go was changed to %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+// TestLSPProcessClose closes servers with a reader running on their output,
+// as the connection has: one that exits when its input ends and one that
+// has to be killed
+func TestLSPProcessClose(t *testing.T) {
+	for _, tt := range []struct {
+		script   string
+		min, max time.Duration
+	}{
+		{"cat", 0, time.Second},
+		{"exec 0<&-; sleep 30", 2 * time.Second, 4 * time.Second},
+	} {
+		rwc, err := startLanguageServer([]string{"sh", "-c", tt.script}, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := newLSPConn(rwc)
+		conn.start()
+		start := time.Now()
+		conn.shutdown(nil)
+		if took := time.Since(start); took < tt.min || took > tt.max {
+			t.Errorf("%q: closing took %s, want %s to %s", tt.script, took, tt.min, tt.max)
+		}
+		if state := rwc.(*lspProcess).cmd.ProcessState; state == nil {
+			t.Errorf("%q: the server wasn't waited for", tt.script)
+		}
+	}
+}
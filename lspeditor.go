@@ -0,0 +1,684 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- LANGUAGE SERVER INTEGRATION -----------------
+
+// lspSession is the buffer's document on its language server
+type lspSession struct {
+	client      *lspClient // nil while the server is starting
+	err         error      // why the server couldn't be started
+	command     []string
+	key         string // identifies the server in languageServers
+	uri         string
+	format      FileFormat
+	version     int
+	sent        []string // the buffer as the server last saw it
+	diagnostics []Diagnostic
+	completions []completionItem // the server's candidates for the word at completedAt
+	completedAt [2]int           // the line and start of the word they were asked for
+}
+
+// languageServers are the running servers, by command and workspace root,
+// so reopening a file reuses its server
+var languageServers = map[string]*lspClient{}
+
+// openLSP connects the buffer to the language server for its format,
+// starting the server in the background if it isn't running yet
+func (e *Editor) openLSP() {
+	uri := ""
+	if e.filename != "" {
+		uri = fileURI(e.filename)
+	}
+	if s := e.lsp; s != nil {
+		if s.uri == uri && s.format == e.format {
+			return
+		}
+		e.closeLSP()
+	}
+	command := languageServerCommand(e.format)
+	if uri == "" || len(command) == 0 || e.screen == nil {
+		return
+	}
+
+	root := workspaceRoot(e.filename)
+	s := &lspSession{command: command, key: strings.Join(command, " ") + "\x00" + root, uri: uri, format: e.format}
+	e.lsp = s
+	if client := languageServers[s.key]; client != nil && client.alive() {
+		e.attachLSP(s, client)
+		return
+	}
+
+	screen := e.screen
+	go func() {
+		client, err := connectLanguageServer(command, root, screen)
+		postFuncEvent(screen, func(e *Editor) {
+			if err != nil {
+				s.err = err
+				return
+			}
+			languageServers[s.key] = client
+			if e.lsp == s {
+				e.attachLSP(s, client)
+			}
+		})
+	}()
+}
+
+// connectLanguageServer starts a server and initializes it; its diagnostics
+// are handed to the event loop
+func connectLanguageServer(command []string, root string, screen tcell.Screen) (*lspClient, error) {
+	rwc, err := startLanguageServer(command, root)
+	if err != nil {
+		return nil, err
+	}
+	return newLSPClient(rwc, filepath.Base(command[0]), root, func(uri string, diags []lspDiagnostic) {
+		postFuncEvent(screen, func(e *Editor) {
+			if e.lsp != nil && e.lsp.uri == uri && e.lsp.client != nil {
+				e.trackDiagnostics()
+				e.lsp.diagnostics = e.lspDiagnostics(e.lsp.client, diags)
+				e.refreshDiagnostics()
+			}
+		})
+	})
+}
+
+// attachLSP opens the buffer on a running server
+func (e *Editor) attachLSP(s *lspSession, client *lspClient) {
+	registerCompletionProvider(lspCompletions{})
+	s.client = client
+	s.completedAt = [2]int{-1, -1}
+	s.version = 1
+	s.sent = append([]string(nil), e.lines...)
+	if err := client.didOpen(s.uri, languageID(s.format), s.version, strings.Join(e.lines, "\n")); err != nil {
+		s.err = err
+	}
+}
+
+// closeLSP closes the buffer's document; the server keeps running
+func (e *Editor) closeLSP() {
+	if s := e.lsp; s != nil && s.client != nil && s.client.alive() {
+		s.client.didClose(s.uri)
+	}
+	e.lsp = nil
+	e.refreshDiagnostics()
+}
+
+// syncLSP sends the server whatever changed in the buffer since it last
+// looked, as one edit covering the changed lines
+func (e *Editor) syncLSP() {
+	s := e.lsp
+	if s == nil || s.client == nil || s.client.sync == lspSyncNone {
+		return
+	}
+	change, changed := s.client.contentChange(s.sent, e.lines)
+	if !changed {
+		return
+	}
+	s.version++
+	if err := s.client.didChange(s.uri, s.version, []lspContentChange{change}); err != nil {
+		s.err = err
+	}
+	s.sent = append(s.sent[:0:0], e.lines...)
+}
+
+// contentChange describes how to turn old into lines: the whole text for
+// servers that want full syncs, else a single range replacement
+func (c *lspClient) contentChange(old, lines []string) (lspContentChange, bool) {
+	prefix := 0
+	for prefix < len(old) && prefix < len(lines) && old[prefix] == lines[prefix] {
+		prefix++
+	}
+	if prefix == len(old) && prefix == len(lines) {
+		return lspContentChange{}, false
+	}
+	if c.sync == lspSyncFull {
+		return lspContentChange{Text: strings.Join(lines, "\n")}, true
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(lines)-prefix && old[len(old)-1-suffix] == lines[len(lines)-1-suffix] {
+		suffix++
+	}
+	removed, added := old[prefix:len(old)-suffix], lines[prefix:len(lines)-suffix]
+	end := func(line int) lspPosition {
+		return c.position(old, line, len(old[line]))
+	}
+
+	var r lspRange
+	var text string
+	switch {
+	case len(removed) == 1 && len(added) == 1:
+		// An edit within one line, usually a keystroke
+		a, b := removed[0], added[0]
+		head := 0
+		for head < len(a) && head < len(b) && a[head] == b[head] {
+			head++
+		}
+		tail := 0
+		for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+			tail++
+		}
+		r = lspRange{Start: c.position(old, prefix, head), End: c.position(old, prefix, len(a)-tail)}
+		text = b[head : len(b)-tail]
+	case len(removed) > 0 && len(added) > 0:
+		r = lspRange{Start: lspPosition{Line: prefix}, End: end(prefix + len(removed) - 1)}
+		text = strings.Join(added, "\n")
+	case len(removed) == 0 && suffix > 0:
+		// Lines inserted before an unchanged line
+		r = lspRange{Start: lspPosition{Line: prefix}, End: lspPosition{Line: prefix}}
+		text = strings.Join(added, "\n") + "\n"
+	case len(removed) == 0:
+		// Lines appended at the end
+		r = lspRange{Start: end(len(old) - 1), End: end(len(old) - 1)}
+		text = "\n" + strings.Join(added, "\n")
+	case suffix > 0:
+		// Lines deleted before an unchanged line
+		r = lspRange{Start: lspPosition{Line: prefix}, End: lspPosition{Line: prefix + len(removed)}}
+	case prefix > 0:
+		// Lines deleted at the end
+		r = lspRange{Start: end(prefix - 1), End: end(len(old) - 1)}
+	default:
+		return lspContentChange{Text: strings.Join(lines, "\n")}, true
+	}
+	return lspContentChange{Range: &r, Text: text}, true
+}
+
+// lspSaved tells the server the buffer was written
+func (e *Editor) lspSaved() {
+	if s := e.lsp; s != nil && s.client != nil {
+		e.syncLSP()
+		s.client.didSave(s.uri)
+	}
+}
+
+// lspRequest runs a request on the buffer's server off the event loop; the
+// function it returns is applied to the editor when the answer arrives
+func (e *Editor) lspRequest(what string, request func(c *lspClient, uri string, pos lspPosition) (func(e *Editor), error)) {
+	s := e.lsp
+	switch {
+	case s == nil:
+		e.message = "No language server for " + e.format.String()
+		return
+	case s.err != nil:
+		e.message = "Language server: " + s.err.Error()
+		return
+	case s.client == nil:
+		e.message = "Language server is starting"
+		return
+	}
+	e.syncLSP()
+	client, uri, screen := s.client, s.uri, e.screen
+	pos := client.position(e.lines, e.cursorLine, e.cursorCol)
+	go func() {
+		apply, err := request(client, uri, pos)
+		if err != nil {
+			apply = func(e *Editor) { e.message = what + ": " + err.Error() }
+		}
+		postFuncEvent(screen, apply)
+	}()
+}
+
+// lspCommand handles "lsp", "lsp restart" and "lsp stop"
+func (e *Editor) lspCommand(args []string) {
+	s := e.lsp
+	if len(args) == 0 {
+		switch {
+		case s == nil:
+			e.message = "No language server for " + e.format.String()
+		case s.err != nil:
+			e.message = "Language server " + s.command[0] + ": " + s.err.Error()
+		case s.client == nil:
+			e.message = "Starting " + s.command[0]
+		default:
+			e.message = fmt.Sprintf("Language server: %s, %d diagnostic(s)", s.client.name, len(s.diagnostics))
+		}
+		return
+	}
+
+	switch args[0] {
+	case "restart", "stop":
+		if s != nil {
+			if client := languageServers[s.key]; client != nil {
+				delete(languageServers, s.key)
+				go client.close()
+			}
+			e.lsp = nil
+		}
+		if args[0] == "restart" {
+			e.openLSP()
+			e.message = "Language server restarted"
+		} else {
+			e.message = "Language server stopped"
+		}
+	default:
+		e.message = "Usage: lsp [restart|stop]"
+	}
+}
+
+// lspDiagnostics converts a server's diagnostics for the buffer
+func (e *Editor) lspDiagnostics(c *lspClient, diags []lspDiagnostic) []Diagnostic {
+	col := func(p lspPosition) int {
+		if p.Line < len(e.lines) {
+			return c.byteCol(e.lines[p.Line], p.Character)
+		}
+		return 0
+	}
+	var out []Diagnostic
+	for _, d := range diags {
+		severity := "error"
+		switch d.Severity {
+		case lspSeverityWarning:
+			severity = "warning"
+		case lspSeverityInformation:
+			severity = "info"
+		case lspSeverityHint:
+			severity = "hint"
+		}
+		source := d.Source
+		if source == "" {
+			source = c.name
+		}
+		out = append(out, Diagnostic{
+			File:     e.filename,
+			Line:     d.Range.Start.Line,
+			Col:      col(d.Range.Start),
+			EndLine:  d.Range.End.Line,
+			EndCol:   col(d.Range.End),
+			Severity: severity,
+			Source:   source,
+			Message:  d.Message,
+		})
+	}
+	return out
+}
+
+// ----------------- HOVER & NAVIGATION -----------------
+
+// hover shows the server's description of the symbol under the cursor
+func (e *Editor) hover() {
+	if e.goNavigation() {
+		e.goSignature()
+		return
+	}
+	e.lspRequest("Hover", func(c *lspClient, uri string, pos lspPosition) (func(*Editor), error) {
+		text, err := c.hover(uri, pos)
+		return func(e *Editor) {
+			var parts []string
+			for _, line := range strings.Split(text, "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "```") {
+					parts = append(parts, line)
+				}
+			}
+			e.message = strings.Join(parts, " ")
+			if e.message == "" {
+				e.message = "No information"
+			}
+		}, err
+	})
+}
+
+// gotoDefinition jumps to the declaration of the symbol under the cursor,
+// going by the tags file when there's no language server running
+func (e *Editor) gotoDefinition() {
+	if e.goNavigation() {
+		e.goDefinition()
+		return
+	}
+	if _, ok := findTagsFile(e.filename); ok && (e.lsp == nil || e.lsp.client == nil) {
+		e.tagCommand(nil)
+		return
+	}
+	e.lspRequest("Definition", func(c *lspClient, uri string, pos lspPosition) (func(*Editor), error) {
+		locations, err := c.definition(uri, pos)
+		return func(e *Editor) {
+			if len(locations) == 0 {
+				e.message = "No definition found"
+				return
+			}
+			e.pushJump()
+			e.gotoLocation(locations[0])
+		}, err
+	})
+}
+
+// findReferences jumps to the next use of the symbol under the cursor
+func (e *Editor) findReferences() {
+	if e.goNavigation() {
+		e.goReferences()
+		return
+	}
+	e.lspRequest("References", func(c *lspClient, uri string, pos lspPosition) (func(*Editor), error) {
+		locations, err := c.references(uri, pos)
+		return func(e *Editor) {
+			if len(locations) == 0 {
+				e.message = "No references found"
+				return
+			}
+			sort.Slice(locations, func(i, j int) bool {
+				a, b := locations[i], locations[j]
+				if a.URI != b.URI {
+					return a.URI < b.URI
+				}
+				if a.Range.Start.Line != b.Range.Start.Line {
+					return a.Range.Start.Line < b.Range.Start.Line
+				}
+				return a.Range.Start.Character < b.Range.Start.Character
+			})
+			// The first one after the cursor, wrapping around
+			next := 0
+			for i, loc := range locations {
+				if loc.URI == uri && (loc.Range.Start.Line > pos.Line || loc.Range.Start.Line == pos.Line && loc.Range.Start.Character > pos.Character) {
+					next = i
+					break
+				}
+			}
+			loc := locations[next]
+			if e.gotoLocation(loc) {
+				e.message = fmt.Sprintf("Reference %d/%d: %s:%d", next+1, len(locations), displayPath(loc.URI), loc.Range.Start.Line+1)
+			}
+		}, err
+	})
+}
+
+// goNavigation reports whether Go navigation stands in for a language
+// server that isn't running
+func (e *Editor) goNavigation() bool {
+	return e.format == Go && (e.lsp == nil || e.lsp.client == nil)
+}
+
+// gotoLocation moves the cursor to loc, opening its file if it's another one
+func (e *Editor) gotoLocation(loc lspLocation) bool {
+	path, ok := uriPath(loc.URI)
+	if !ok {
+		e.message = "Can't open " + loc.URI
+		return false
+	}
+	if !e.visitFile(path) {
+		return false
+	}
+	e.cursorLine = min(max(loc.Range.Start.Line, 0), len(e.lines)-1)
+	e.cursorCol = 0
+	if e.lsp != nil && e.lsp.client != nil {
+		e.cursorCol = e.lsp.client.byteCol(e.lines[e.cursorLine], loc.Range.Start.Character)
+	}
+	e.updateCursorVisualCol()
+	e.adjustScroll()
+	return true
+}
+
+// displayPath shortens a file URI to a path relative to the working directory
+func displayPath(uri string) string {
+	path, ok := uriPath(uri)
+	if !ok {
+		return uri
+	}
+	return relativePath(path)
+}
+
+// ----------------- COMPLETION & RENAME -----------------
+
+// complete inserts the server's completion for the word before the cursor,
+// or as much as all the candidates share, and lists them
+func (e *Editor) complete() {
+	e.lspRequest("Completion", func(c *lspClient, uri string, pos lspPosition) (func(*Editor), error) {
+		items, err := c.completion(uri, pos)
+		return func(e *Editor) {
+			line := e.lines[e.cursorLine]
+			start := e.cursorCol
+			for start > 0 && isWordByte(line[start-1]) {
+				start--
+			}
+			prefix := strings.ToLower(line[start:e.cursorCol])
+
+			var matches []lspCompletionItem
+			for _, item := range items {
+				filter := item.FilterText
+				if filter == "" {
+					filter = item.Label
+				}
+				if strings.HasPrefix(strings.ToLower(filter), prefix) {
+					matches = append(matches, item)
+				}
+			}
+			switch len(matches) {
+			case 0:
+				e.message = "No completions"
+			case 1:
+				e.acceptCompletion(c, matches[0], start)
+			default:
+				common := matches[0].text()
+				labels := make([]string, 0, len(matches))
+				for _, item := range matches {
+					text := item.text()
+					n := 0
+					for n < len(common) && n < len(text) && common[n] == text[n] {
+						n++
+					}
+					common = common[:n]
+					if len(labels) < 10 {
+						labels = append(labels, item.Label)
+					}
+				}
+				if len(common) > e.cursorCol-start {
+					e.acceptCompletion(c, lspCompletionItem{InsertText: common}, start)
+				}
+				e.message = strings.Join(labels, "  ")
+				if len(matches) > len(labels) {
+					e.message += fmt.Sprintf("  (+%d more)", len(matches)-len(labels))
+				}
+			}
+		}, err
+	})
+}
+
+// lspCompletions offers the candidates the language server sent for the
+// word being typed; fetchLSPCompletions asks for them
+type lspCompletions struct{}
+
+func (lspCompletions) completions(e *Editor, prefix string) []completionItem {
+	s := e.lsp
+	if s == nil || s.client == nil {
+		return nil
+	}
+	if start, _ := e.wordBeforeCursor(); s.completedAt != [2]int{e.cursorLine, start} {
+		return nil
+	}
+	return s.completions
+}
+
+// lspCompletionKinds names the server's kinds of completion items
+var lspCompletionKinds = map[int]string{
+	2: "method", 3: "function", 4: "constructor", 5: "field", 6: "variable",
+	7: "class", 8: "interface", 9: "module", 10: "property", 13: "enum",
+	14: "keyword", 21: "constant", 22: "struct", 25: "type",
+}
+
+// fetchLSPCompletions asks the server for candidates for the word from
+// start to the cursor, once per word, and refreshes the popup with them
+func (e *Editor) fetchLSPCompletions(start int, wasEmpty bool) {
+	s := e.lsp
+	at := [2]int{e.cursorLine, start}
+	if s == nil || s.client == nil || s.err != nil || s.completedAt == at {
+		return
+	}
+	s.completedAt, s.completions = at, nil
+	e.syncLSP()
+	client, uri, screen := s.client, s.uri, e.screen
+	pos := client.position(e.lines, e.cursorLine, start)
+	go func() {
+		items, err := client.completion(uri, pos)
+		if err != nil {
+			return
+		}
+		var candidates []completionItem
+		for _, item := range items {
+			text := strings.SplitN(item.text(), "\n", 2)[0]
+			kind := lspCompletionKinds[item.Kind]
+			if kind == "" {
+				kind = "lsp"
+			}
+			if text != "" {
+				candidates = append(candidates, completionItem{text: text, kind: kind})
+			}
+		}
+		postFuncEvent(screen, func(e *Editor) {
+			if e.lsp != s || s.completedAt != at {
+				return
+			}
+			s.completions = candidates
+			e.reopenCompletion(at[0], at[1], wasEmpty)
+		})
+	}()
+}
+
+// acceptCompletion inserts a completion item, replacing the word from start
+// to the cursor unless the item says which range it replaces
+func (e *Editor) acceptCompletion(c *lspClient, item lspCompletionItem, start int) {
+	line := e.lines[e.cursorLine]
+	from, to, text := start, e.cursorCol, item.text()
+	if te := item.TextEdit; te != nil && te.Range.Start.Line == e.cursorLine && te.Range.End.Line == e.cursorLine {
+		from, to = c.byteCol(line, te.Range.Start.Character), c.byteCol(line, te.Range.End.Character)
+		to = max(to, e.cursorCol)
+	}
+	text = strings.SplitN(text, "\n", 2)[0]
+	e.recordUndo(undoStep)
+	e.lines[e.cursorLine] = line[:from] + text + line[to:]
+	e.cursorCol = from + len(text)
+	e.dirty = true
+	e.updateLineTokens(e.cursorLine)
+	e.updateCursorVisualCol()
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= 0x80
+}
+
+// renameSymbol renames the symbol under the cursor everywhere the server
+// knows of it. Other files are rewritten on disk, all of them or none.
+func (e *Editor) renameSymbol(args []string) {
+	if len(args) != 1 {
+		e.message = "Usage: rename <new name>"
+		return
+	}
+	newName := args[0]
+	if e.goNavigation() {
+		e.goRename(newName)
+		return
+	}
+	e.lspRequest("Rename", func(c *lspClient, uri string, pos lspPosition) (func(*Editor), error) {
+		edit, err := c.rename(uri, pos, newName)
+		return func(e *Editor) {
+			edits := edit.edits()
+			bufferURI := ""
+			if e.lsp != nil {
+				bufferURI = e.lsp.uri
+			}
+			files, err := writeTextEdits(c, edits, bufferURI)
+			if err != nil {
+				e.message = "Rename: " + err.Error()
+				return
+			}
+			if bufferEdits, ok := edits[bufferURI]; ok && bufferURI != "" {
+				e.recordUndo(undoStep)
+				e.lines = applyTextEdits(c, e.lines, bufferEdits)
+				e.cursorLine = min(e.cursorLine, len(e.lines)-1)
+				e.afterBulkEdit()
+				files++
+			}
+			e.message = fmt.Sprintf("Renamed to %s in %d file(s)", newName, files)
+		}, err
+	})
+}
+
+// applyTextEdits applies a server's edits, which all refer to the text as
+// it was before any of them, to lines
+func applyTextEdits(c *lspClient, lines []string, edits []lspTextEdit) []string {
+	starts := make([]int, len(lines)+1)
+	for i, line := range lines {
+		starts[i+1] = starts[i] + len(line) + 1
+	}
+	offset := func(pos lspPosition) int {
+		if pos.Line >= len(lines) {
+			return starts[len(lines)] - 1
+		}
+		return starts[pos.Line] + c.byteCol(lines[pos.Line], pos.Character)
+	}
+
+	sorted := append([]lspTextEdit(nil), edits...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return offset(sorted[i].Range.Start) > offset(sorted[j].Range.Start)
+	})
+	text := strings.Join(lines, "\n")
+	for _, edit := range sorted {
+		start, end := offset(edit.Range.Start), offset(edit.Range.End)
+		if start > end || end > len(text) {
+			continue
+		}
+		text = text[:start] + edit.NewText + text[end:]
+	}
+	return strings.Split(text, "\n")
+}
+
+// writeTextEdits applies the edits to every file but the buffer's, skip,
+// all or none: each file's new text goes to a temporary file beside it, and
+// they replace the files only once all are written. It returns how many
+// files it changed.
+func writeTextEdits(c *lspClient, edits map[string][]lspTextEdit, skip string) (int, error) {
+	type pending struct{ temp, file string }
+	var writes []pending
+	cleanUp := func() {
+		for _, w := range writes {
+			os.Remove(w.temp)
+		}
+	}
+	for uri, fileEdits := range edits {
+		if uri == skip {
+			continue
+		}
+		path, ok := uriPath(uri)
+		if !ok {
+			cleanUp()
+			return 0, fmt.Errorf("can't edit %s", uri)
+		}
+		info, err := os.Stat(path)
+		var content []byte
+		if err == nil {
+			content, err = ioutil.ReadFile(path)
+		}
+		var temp *os.File
+		if err == nil {
+			temp, err = os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".rename-*")
+		}
+		if err == nil {
+			writes = append(writes, pending{temp.Name(), path})
+			lines := applyTextEdits(c, strings.Split(string(content), "\n"), fileEdits)
+			_, err = temp.WriteString(strings.Join(lines, "\n"))
+			if closeErr := temp.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Chmod(temp.Name(), info.Mode())
+			}
+		}
+		if err != nil {
+			cleanUp()
+			return 0, err
+		}
+	}
+	for i, w := range writes {
+		if err := os.Rename(w.temp, w.file); err != nil {
+			cleanUp()
+			return i, fmt.Errorf("%v; %d of %d file(s) were written", err, i, len(writes))
+		}
+	}
+	return len(writes), nil
+}
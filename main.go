@@ -2,16 +2,16 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
 	"go/format"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"golang.org/x/text/encoding"
@@ -27,6 +27,7 @@ const (
 	Find
 	PromptSave
 	PromptQuit
+	PanelMode
 )
 
 type FileFormat int
@@ -47,6 +48,19 @@ const (
 	Java
 	PHP
 	SquidPlusPlus
+	YAML
+	TOML
+	SQL
+	Dockerfile
+	Makefile
+	TypeScript
+	Lua
+	Ruby
+	XML
+
+	// firstUserFormat is the first value handed to grammars loaded from the
+	// user's config directory that don't replace a built-in language.
+	firstUserFormat
 )
 
 type TokenType int
@@ -81,6 +95,13 @@ const (
 	TokenNamespace
 	TokenAnnotation
 	TokenMacro
+	TokenHeading
+	TokenEmphasis
+	TokenStrong
+	TokenLink
+	TokenInvalid
+	TokenBuiltin
+	TokenUnresolved
 )
 
 type Token struct {
@@ -98,9 +119,20 @@ type EmbeddedContext struct {
 
 type SyntaxHighlighter struct {
 	format               FileFormat
+	grammar              *Grammar
 	keywords             map[string]bool
-	patterns             map[TokenType]*regexp.Regexp
+	rules                []highlightRule
 	embeddedHighlighters map[FileFormat]*SyntaxHighlighter
+	regionEnds           map[string]*regexp.Regexp
+	semantic             semanticTokenizer // whole-buffer highlighting, nil for most formats
+}
+
+// lineState is the highlighter state at the start of a line: the multi-line
+// region (code fence, heredoc, ...) the line belongs to, if any.
+type lineState struct {
+	region int        // 1-based index into the grammar's regions, 0 outside
+	format FileFormat // language of the region's body, PlainText when painted with its token
+	end    string     // end pattern with the opening line's captures substituted
 }
 
 type AutoClosePair struct {
@@ -135,6 +167,39 @@ type Editor struct {
 	autoClosePairs   []AutoClosePair
 	lineTokens       [][]Token
 	embeddedContexts [][]EmbeddedContext
+	lineStates       []lineState   // highlighter state at the start of each line
+	message          string        // one-off status message shown above the command line
+	syntaxOverride   bool          // format was chosen with the syntax command
+	overrideFormat   FileFormat    // format to use while syntaxOverride is set
+	semanticPending  bool          // lines changed since the semantic highlighter last ran
+	semanticRunning  bool          // a background semantic run hasn't reported back yet
+	semanticGen      int           // identifies the latest semantic run
+	highlightedTo    int           // lines before this have up-to-date tokens and states
+	highlightGen     int           // identifies the latest background highlighting job
+	highlightStop    chan struct{} // closed to stop the background job early
+	showWhitespace   bool          // draw glyphs for tabs, spaces and carriage returns
+	lsp              *lspSession   // the buffer's language server, nil without one
+	undoStack        []undoState   // steps to go back through, latest last
+	redoStack        []undoState   // steps undone since the last edit
+	undoGroup        string        // kind of the last edit, see recordUndo
+	undoBase         []string      // the buffer as the open step began, nil if none
+	undoCursor       [2]int        // the cursor's line and column as it began
+	building         bool          // a build command is running
+	errorList        []Diagnostic  // the last build's or test run's problems, in any file
+	errorIndex       int           // position in the error list
+	diagnostics      []Diagnostic  // the buffer's problems, see refreshDiagnostics
+	diagnosedLines   []string      // the buffer when diagnostics were last moved
+	lintGen          int           // identifies the latest lint run
+	completion       *suggestions  // the completion popup, nil when it's closed
+	outline          *symbolCache  // the buffer's symbols, found when the text changes
+	jumps            []jumpPoint   // where jumps to definitions were made from
+	popup            []string      // lines shown by the cursor until the next key
+	snippet          *tabStops     // the expanded snippet's tab stops being filled in
+	panel            *panel        // the last panel shown, such as test results
+	panelVisible     bool          // the panel is open below the buffer
+	testing          bool          // go test is running
+	running          *runProcess   // the program the run command started, while it runs
+	testStatus       testStatuses  // outcome of each test run
 }
 
 var fileFormat string
@@ -155,9 +220,17 @@ func NewEditor() *Editor {
 		},
 		lineTokens:       [][]Token{{}},
 		embeddedContexts: [][]EmbeddedContext{{}},
+		lineStates:       []lineState{{}},
 		horizOffset:      0,
+		showWhitespace:   options.ShowWhitespace,
 	}
 	editor.highlighter = NewSyntaxHighlighter(PlainText)
+	if len(grammars.errors) > 0 {
+		editor.message = "Grammar error: " + strings.Join(grammars.errors, "; ")
+	}
+	if optionsError != nil {
+		editor.message = "Config error: " + optionsError.Error()
+	}
 	return editor
 }
 
@@ -175,34 +248,12 @@ func (e *Editor) Run() {
 	// Load file from os.Args (streamed to avoid OOM)
 	if len(os.Args) > 1 {
 		filename := os.Args[1]
-		e.filename = filename
-		e.detectFormat()
-		// Read the entire file
-		content, err := ioutil.ReadFile(filename)
-		if err == nil {
-			// Convert content to lines
-			if len(content) == 0 {
-				e.lines = []string{""}
-			} else {
-				e.lines = strings.Split(string(content), "\n")
-				// Remove last empty line if file doesn't end with newline
-				if len(e.lines) > 0 && e.lines[len(e.lines)-1] == "" {
-					e.lines = e.lines[:len(e.lines)-1]
-				}
-				if len(e.lines) == 0 {
-					e.lines = []string{""}
-				}
-			}
-			e.dirty = false
-			e.partialLoad = false
-			e.fileHandle = nil
-			e.fileOffsetLines = len(e.lines)
-			e.updateSyntaxHighlighting()
-		} else {
+		if err := e.openFile(filename); err != nil {
 			// fallback to previous behavior (empty buffer and mark dirty)
 			e.filename = filename
 			e.dirty = true
 			e.detectFormat()
+			e.refreshDiagnostics()
 		}
 	}
 
@@ -211,6 +262,7 @@ func (e *Editor) Run() {
 		ev := s.PollEvent()
 		switch tev := ev.(type) {
 		case *tcell.EventKey:
+			e.message = ""
 			switch e.mode {
 			case Interactive:
 				e.handleInteractive(tev)
@@ -222,17 +274,124 @@ func (e *Editor) Run() {
 				e.handlePromptSave(tev)
 			case PromptQuit:
 				e.handlePromptQuit(tev)
+			case PanelMode:
+				e.handlePanel(tev)
 			}
+		case *highlightEvent:
+			e.applyHighlightEvent(tev)
+		case *semanticEvent:
+			e.applySemanticEvent(tev)
+		case *funcEvent:
+			tev.apply(e)
+		}
+	}
+}
+
+// openFile reads a whole file into the buffer, replacing what was there
+func (e *Editor) openFile(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	e.filename = filename
+	// Convert content to lines
+	if len(content) == 0 {
+		e.lines = []string{""}
+	} else {
+		e.lines = strings.Split(string(content), "\n")
+		// Remove last empty line if file doesn't end with newline
+		if len(e.lines) > 0 && e.lines[len(e.lines)-1] == "" {
+			e.lines = e.lines[:len(e.lines)-1]
+		}
+		if len(e.lines) == 0 {
+			e.lines = []string{""}
+		}
+	}
+	e.cursorLine, e.cursorCol = 0, 0
+	e.scrollOffset, e.horizOffset = 0, 0
+	e.dirty = false
+	e.partialLoad = false
+	e.fileHandle = nil
+	e.fileOffsetLines = len(e.lines)
+	e.diagnosedLines = nil
+	e.clearUndo()
+	// A syntax chosen for the last file doesn't carry over to this one
+	e.syntaxOverride = false
+	e.detectFormat()
+	e.refreshDiagnostics()
+	e.updateSyntaxHighlighting()
+	return nil
+}
+
+// visitFile makes path the buffer's file, opening it unless it already is.
+// Unsaved changes keep the current file open.
+func (e *Editor) visitFile(path string) bool {
+	if sameFile(path, e.filename) {
+		return true
+	}
+	if e.dirty {
+		e.message = "Save changes before opening " + relativePath(path)
+		return false
+	}
+	if err := e.openFile(path); err != nil {
+		e.message = err.Error()
+		return false
+	}
+	return true
+}
+
+// sameFile reports whether two paths name the same file
+func sameFile(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// relativePath shortens a path to one relative to the working directory
+// when it's inside it
+func relativePath(path string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
 		}
 	}
+	return path
 }
 
 // ----------------- INTERACTIVE MODE -----------------
 
 func (e *Editor) handleInteractive(key *tcell.EventKey) {
+	if e.popup != nil {
+		e.popup = nil
+		if key.Key() == tcell.KeyEsc {
+			return
+		}
+	}
+	if e.completion != nil && e.handleCompletionKey(key) {
+		return
+	}
+	if e.snippet != nil && e.handleSnippetKey(key) {
+		return
+	}
+	defer e.completeAfterKey(key)
+	defer e.syncSnippet(key)
 	ln := e.lines[e.cursorLine]
 	ctrl := key.Modifiers()&tcell.ModCtrl != 0
 
+	switch key.Key() {
+	case tcell.KeyRune, tcell.KeyTab:
+		e.recordUndo(undoTyping)
+	case tcell.KeyBackspace, tcell.KeyBackspace2, tcell.KeyDelete:
+		e.recordUndo(undoDeleting)
+	case tcell.KeyEnter:
+		e.recordUndo(undoStep)
+	default:
+		e.breakUndoGroup()
+	}
+
 	alt := key.Modifiers()&tcell.ModAlt != 0
 	if alt && key.Key() == tcell.KeyLeft {
 		e.cursorCol = prevWordStart(ln, e.cursorCol)
@@ -286,6 +445,30 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 	case tcell.KeyCtrlE:
 		e.mode = CommandLine
 		e.commandBuf = ""
+	case tcell.KeyCtrlRightSq:
+		e.jumpToMatch()
+	case tcell.KeyCtrlSpace:
+		e.openCompletion(true)
+	case tcell.KeyF12:
+		e.gotoDefinition()
+	case tcell.KeyF6:
+		e.panelCommand(nil)
+	case tcell.KeyCtrlO:
+		e.outlineCommand()
+	case tcell.KeyCtrlT:
+		e.jumpBack()
+	case tcell.KeyCtrlC:
+		e.stopRun()
+	case tcell.KeyF8:
+		if key.Modifiers()&tcell.ModShift != 0 {
+			e.nextError(-1)
+		} else {
+			e.nextError(1)
+		}
+	case tcell.KeyCtrlZ:
+		e.undo()
+	case tcell.KeyCtrlY:
+		e.redo()
 	case tcell.KeyHome:
 		e.cursorCol = 0
 	case tcell.KeyEnd:
@@ -316,7 +499,7 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 			if (prev == '{' && next == '}') || (prev == '[' && next == ']') || (prev == '(' && next == ')') {
 				// insert newline, put closing bracket on its own line and indent
 				indent := detectIndentation(e.lines[e.cursorLine])
-				innerIndent := indent + "\t"
+				innerIndent := indent + e.indentUnit()
 				// current line becomes up to cursor-1 (including opening bracket)
 				left := e.lines[e.cursorLine][:e.cursorCol]
 				// ensure left ends with opening bracket
@@ -325,12 +508,11 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 				// newLine already begins with the closing bracket, so don't prepend it again
 				insert := []string{innerIndent, indent + newLine}
 				e.lines = append(e.lines[:e.cursorLine+1], append(insert, e.lines[e.cursorLine+1:]...)...)
-				e.lineTokens = append(e.lineTokens[:e.cursorLine+1], append([][]Token{{}, {}}, e.lineTokens[e.cursorLine+1:]...)...)
-				e.embeddedContexts = append(e.embeddedContexts[:e.cursorLine+1], append([][]EmbeddedContext{{}, {}}, e.embeddedContexts[e.cursorLine+1:]...)...)
+				e.insertLineMeta(e.cursorLine+1, 2)
 				e.cursorLine++
 				e.cursorCol = len(innerIndent)
 				e.dirty = true
-				e.updateSyntaxHighlighting()
+				e.updateLineRange(e.cursorLine-1, e.cursorLine+2)
 				e.adjustScroll()
 				return
 			}
@@ -341,8 +523,7 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 		newLineWithIndent := smartIndent + newLine
 
 		e.lines = append(e.lines[:e.cursorLine+1], append([]string{newLineWithIndent}, e.lines[e.cursorLine+1:]...)...)
-		e.lineTokens = append(e.lineTokens[:e.cursorLine+1], append([][]Token{{}}, e.lineTokens[e.cursorLine+1:]...)...)
-		e.embeddedContexts = append(e.embeddedContexts[:e.cursorLine+1], append([][]EmbeddedContext{{}}, e.embeddedContexts[e.cursorLine+1:]...)...)
+		e.insertLineMeta(e.cursorLine+1, 1)
 		e.cursorLine++
 
 		// Check if the new line content needs dedenting (starts with closing bracket)
@@ -362,7 +543,7 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 		}
 
 		e.dirty = true
-		e.updateSyntaxHighlighting()
+		e.updateLineRange(e.cursorLine-1, e.cursorLine+1)
 		e.adjustScroll()
 	case tcell.KeyBackspace, tcell.KeyBackspace2:
 		if e.cursorCol > 0 {
@@ -390,8 +571,7 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 			prev := e.lines[e.cursorLine-1]
 			e.lines[e.cursorLine-1] = prev + ln
 			e.lines = append(e.lines[:e.cursorLine], e.lines[e.cursorLine+1:]...)
-			e.lineTokens = append(e.lineTokens[:e.cursorLine], e.lineTokens[e.cursorLine+1:]...)
-			e.embeddedContexts = append(e.embeddedContexts[:e.cursorLine], e.embeddedContexts[e.cursorLine+1:]...)
+			e.removeLineMeta(e.cursorLine, 1)
 			e.cursorLine--
 			e.cursorCol = len(prev)
 			e.dirty = true
@@ -406,8 +586,7 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 		} else if e.cursorLine < len(e.lines)-1 {
 			e.lines[e.cursorLine] += e.lines[e.cursorLine+1]
 			e.lines = append(e.lines[:e.cursorLine+1], e.lines[e.cursorLine+2:]...)
-			e.lineTokens = append(e.lineTokens[:e.cursorLine+1], e.lineTokens[e.cursorLine+2:]...)
-			e.embeddedContexts = append(e.embeddedContexts[:e.cursorLine+1], e.embeddedContexts[e.cursorLine+2:]...)
+			e.removeLineMeta(e.cursorLine+1, 1)
 			e.dirty = true
 			e.updateLineTokens(e.cursorLine)
 		}
@@ -416,10 +595,14 @@ func (e *Editor) handleInteractive(key *tcell.EventKey) {
 		e.handleRuneInput(r)
 		e.dirty = true
 	case tcell.KeyTab:
-		// Insert a tab character
+		if e.expandSnippet() {
+			return
+		}
+		// Insert one indentation unit (a tab unless the grammar says otherwise)
 		ln := e.lines[e.cursorLine]
-		e.lines[e.cursorLine] = ln[:e.cursorCol] + "\t" + ln[e.cursorCol:]
-		e.cursorCol++
+		unit := e.indentUnit()
+		e.lines[e.cursorLine] = ln[:e.cursorCol] + unit + ln[e.cursorCol:]
+		e.cursorCol += len(unit)
 		e.updateLineTokens(e.cursorLine)
 		e.updateCursorVisualCol()
 		e.dirty = true
@@ -449,101 +632,19 @@ func (e *Editor) getSmartIndentation(lineIdx int) string {
 	prevLine := e.lines[lineIdx-1]
 	baseIndent := detectIndentation(prevLine)
 
-	// Check if previous line ends with characters that should increase indentation
-	trimmed := strings.TrimSpace(prevLine)
-	if len(trimmed) > 0 {
-		lastChar := trimmed[len(trimmed)-1]
-
-		// Standard block opening characters
-		if lastChar == '{' || lastChar == '[' || lastChar == '(' {
-			return baseIndent + "\t"
-		}
-
-		// Language-specific indentation rules
-		if lastChar == ':' {
-			// Python, YAML, CSS rules
-			if e.format == Python || e.format == CSS {
-				return baseIndent + "\t"
-			}
-		}
-
-		// HTML/XML tag opening
-		if lastChar == '>' && strings.Contains(trimmed, "<") {
-			// Check if it's not a self-closing tag or comment
-			if !strings.HasSuffix(trimmed, "/>") && !strings.HasSuffix(trimmed, "-->") &&
-				!strings.Contains(trimmed, "<!") {
-				// Look for opening tag without corresponding closing tag on same line
-				openTags := strings.Count(trimmed, "<") - strings.Count(trimmed, "</")
-				if openTags > 0 {
-					return baseIndent + "\t"
-				}
-			}
-		}
-	}
-
-	// Check for language-specific keywords that should increase indentation
-	trimmedLower := strings.ToLower(trimmed)
-	switch e.format {
-	case Go, C, CPP, Java, JavaScript, PHP, Rust:
-		if e.endsWithBlockKeyword(trimmedLower) {
-			return baseIndent + "\t"
-		}
-	case Python:
-		if e.endsWithPythonBlockKeyword(trimmedLower) {
-			return baseIndent + "\t"
-		}
-	case SquidPlusPlus:
-		if e.endsWithSquidPlusPlusBlockKeyword(trimmedLower) {
-			return baseIndent + "\t"
-		}
+	// Check if previous line ends with characters or keywords that should
+	// increase indentation, as declared by the language's grammar
+	rules := indentRules(e.format)
+	if rules.opensBlock(prevLine) {
+		return baseIndent + rules.Unit
 	}
 
 	return baseIndent
 }
 
-// endsWithBlockKeyword checks if a line ends with keywords that start blocks
-func (e *Editor) endsWithBlockKeyword(line string) bool {
-	blockKeywords := []string{
-		"if", "else", "elif", "while", "for", "switch", "case", "default",
-		"try", "catch", "finally", "function", "class", "struct", "interface",
-		"do", "foreach", "match", "impl", "trait", "mod", "fn", "el",
-	}
-
-	for _, keyword := range blockKeywords {
-		if strings.HasSuffix(line, keyword) {
-			return true
-		}
-	}
-	return false
-}
-
-// endsWithSquidPlusPlusBlockKeyword checks for SQU1D++-specific block keywords
-func (e *Editor) endsWithSquidPlusPlusBlockKeyword(line string) bool {
-	squidKeywords := []string{
-		"if", "el", "while", "elif", "for", "def", "{",
-	}
-
-	for _, keyword := range squidKeywords {
-		if strings.HasSuffix(line, keyword) || strings.HasSuffix(line, keyword+" {") {
-			return true
-		}
-	}
-	return false
-}
-
-// endsWithPythonBlockKeyword checks for Python-specific block keywords
-func (e *Editor) endsWithPythonBlockKeyword(line string) bool {
-	pythonKeywords := []string{
-		"if", "elif", "else", "while", "for", "def", "class", "try", "except",
-		"finally", "with", "async def", "async with", "match", "case",
-	}
-
-	for _, keyword := range pythonKeywords {
-		if strings.HasSuffix(line, keyword+":") {
-			return true
-		}
-	}
-	return false
+// indentUnit returns one level of indentation for the current format
+func (e *Editor) indentUnit() string {
+	return indentRules(e.format).Unit
 }
 
 // getDedentedIndentation reduces indentation by one level
@@ -552,7 +653,10 @@ func (e *Editor) getDedentedIndentation(indent string) string {
 		return ""
 	}
 
-	// Remove one tab or 4 spaces
+	// Remove one level of the language's unit, else one tab or 4 spaces
+	if unit := e.indentUnit(); strings.HasSuffix(indent, unit) {
+		return indent[:len(indent)-len(unit)]
+	}
 	if indent[len(indent)-1] == '\t' {
 		return indent[:len(indent)-1]
 	} else if len(indent) >= 4 && indent[len(indent)-4:] == "    " {
@@ -594,11 +698,14 @@ func (e *Editor) handlePromptSave(key *tcell.EventKey) {
 	case tcell.KeyEnter:
 		filename := strings.TrimSpace(e.commandBuf)
 		if filename != "" {
+			e.beforeSave()
 			ioutil.WriteFile(filename, []byte(strings.Join(e.lines, "\n")), 0644)
 			e.filename = filename
 			e.dirty = false
 			e.detectFormat()
+			e.refreshDiagnostics()
 			e.updateSyntaxHighlighting()
+			e.afterSave()
 		}
 		e.commandBuf = ""
 		e.mode = Interactive
@@ -612,26 +719,35 @@ func (e *Editor) handlePromptSave(key *tcell.EventKey) {
 	}
 }
 
+// exit leaves the editor, killing the program the run command started so
+// it doesn't outlive it
+func (e *Editor) exit() {
+	if e.running != nil {
+		killProcessGroup(e.running.cmd)
+	}
+	e.screen.Fini()
+	os.Exit(0)
+}
+
 func (e *Editor) handlePromptQuit(key *tcell.EventKey) {
 	switch key.Rune() {
 	case 'y', 'Y':
 		if e.filename != "" {
+			e.beforeExitSave()
 			ioutil.WriteFile(e.filename, []byte(strings.Join(e.lines, "\n")), 0644)
 			e.dirty = false
-			e.screen.Fini()
-			os.Exit(0)
+			e.exit()
 		} else {
 			e.promptSaveCommandLine()
 		}
 	case 'n', 'N':
-		e.screen.Fini()
-		os.Exit(0)
+		e.exit()
 	default:
 		if e.filename != "" {
+			e.beforeExitSave()
 			ioutil.WriteFile(e.filename, []byte(strings.Join(e.lines, "\n")), 0644)
 			e.dirty = false
-			e.screen.Fini()
-			os.Exit(0)
+			e.exit()
 		} else {
 			e.promptSaveCommandLine()
 		}
@@ -640,64 +756,57 @@ func (e *Editor) handlePromptQuit(key *tcell.EventKey) {
 
 // ----------------- FORMATTING & TESTS -----------------
 
-// formatBuffer formats buffer for supported languages (Go and JSON)
-func (e *Editor) formatBuffer() {
-	switch e.format {
-	case Go:
-		src := strings.Join(e.lines, "\n")
-		out, err := formatSourceGo(src)
-		if err == nil {
-			e.lines = strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n")
-			e.dirty = false
-			e.updateSyntaxHighlighting()
-		} else {
-			// keep buffer; optionally show error in status later
-		}
-	case JSON:
-		src := strings.Join(e.lines, "\n")
-		out, err := formatJSON(src)
-		if err == nil {
-			e.lines = strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n")
-			e.dirty = false
-			e.updateSyntaxHighlighting()
-		}
-	default:
-		//
+// formatBuffer runs the buffer through its language's formatter in the
+// background, as external tools can take a while. The result replaces the
+// buffer if it still holds what was formatted, and then runs after that,
+// even when the formatter failed.
+func (e *Editor) formatBuffer(then func(*Editor)) {
+	format, ok := formatterFor(e.format)
+	if !ok {
+		e.message = "No formatter for " + e.format.String()
+		return
 	}
-}
+	filename, src := e.filename, strings.Join(e.lines, "\n")
+	e.message = "Formatting"
 
-// runGoTests runs `go test ./...` and returns raw output (stdout+stderr)
-func (e *Editor) runGoTests() (string, error) {
-	// Use os/exec to run go test
-	cmd := exec.Command("go", "test", "./...")
-	out, err := cmd.CombinedOutput()
-	return string(out), err
+	screen := e.screen
+	go func() {
+		out, err := format(src, filename)
+		postFuncEvent(screen, func(e *Editor) {
+			if e.filename != filename || strings.Join(e.lines, "\n") != src {
+				e.message = "Format: the buffer changed, format again"
+				return
+			}
+			if err != nil {
+				e.showFormatError(err)
+			} else {
+				e.replaceBuffer(out)
+			}
+			if then != nil {
+				then(e)
+			}
+		})
+	}()
 }
 
-// parseGoTestOutput extracts file:line:msg style diagnostics
-func parseGoTestOutput(output string) []Diagnostic {
-	var diags []Diagnostic
-	// simple regex for file:line:col: message OR file:line: message
-	re := regexp.MustCompile(`([\w\./_-]+\.go):(\d+)(?::(\d+))?:\s*(.*)`)
-	matches := re.FindAllStringSubmatch(output, -1)
-	for _, m := range matches {
-		lineNum := 0
-		if n, err := strconv.Atoi(m[2]); err == nil {
-			lineNum = n - 1
-		}
-		diags = append(diags, Diagnostic{File: m[1], Line: lineNum, Message: m[4]})
+// replaceBuffer swaps in a rewritten buffer as a single undo step, keeping
+// the cursor on the same code
+func (e *Editor) replaceBuffer(out string) {
+	lines := strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n")
+	if strings.Join(lines, "\n") == strings.Join(e.lines, "\n") {
+		e.message = "Already formatted"
+		return
 	}
-	return diags
-}
 
-type Diagnostic struct {
-	File    string
-	Line    int
-	Message string
+	e.recordUndo(undoStep)
+	e.cursorLine, e.cursorCol = mapPosition(e.lines, lines, e.cursorLine, e.cursorCol)
+	e.lines = lines
+	e.cursorLine = min(e.cursorLine, len(e.lines)-1)
+	e.afterBulkEdit()
+	e.adjustScroll()
+	e.message = "Formatted"
 }
 
-var diagnostics []Diagnostic
-
 // ----------------- FIND MODE -----------------
 
 func (e *Editor) handleFind(key *tcell.EventKey) {
@@ -762,19 +871,23 @@ func (e *Editor) executeCommand() {
 		if e.dirty {
 			e.promptQuitCommandLine()
 		} else {
-			e.screen.Fini()
-			os.Exit(0)
+			e.exit()
 		}
 	case "save":
 		if len(args) > 1 {
+			e.beforeSave()
 			e.saveWithEncoding(args[1], strings.Join(e.lines, "\n"))
 			e.filename = args[1]
 			e.dirty = false
 			e.detectFormat()
+			e.refreshDiagnostics()
 			e.updateSyntaxHighlighting()
+			e.afterSave()
 		} else if e.filename != "" {
+			e.beforeSave()
 			e.saveWithEncoding(e.filename, strings.Join(e.lines, "\n"))
 			e.dirty = false
+			e.afterSave()
 		} else {
 			e.promptSaveCommandLine()
 		}
@@ -799,22 +912,75 @@ func (e *Editor) executeCommand() {
 			e.setEncoding(strings.ToLower(args[1]))
 		}
 	case "format":
-		e.formatBuffer()
+		e.formatBuffer(nil)
+	case "run":
+		e.runCommand(args[1:])
+	case "imports":
+		e.importsCommand()
+	case "gen-test":
+		e.genTestCommand()
+	case "json-minify":
+		e.jsonCommand(minifyJSON)
+	case "json-sort":
+		e.jsonCommand(sortJSON)
+	case "syntax":
+		e.setSyntax(args[1:])
+	case "match":
+		e.jumpToMatch()
+	case "whitespace", "ws":
+		e.toggleWhitespace(args[1:])
+	case "trim":
+		e.message = fmt.Sprintf("Trimmed %d line(s)", e.trimTrailingWhitespace())
+	case "retab":
+		e.reindentCommand(true, args[1:])
+	case "untab":
+		e.reindentCommand(false, args[1:])
+	case "lsp":
+		e.lspCommand(args[1:])
+	case "hover":
+		e.hover()
+	case "def", "definition":
+		e.gotoDefinition()
+	case "refs", "references":
+		e.findReferences()
+	case "complete":
+		e.complete()
+	case "rename":
+		e.renameSymbol(args[1:])
+	case "build":
+		e.build(args[1:], false)
+	case "make":
+		e.build(args[1:], true)
+	case "diagnostics", "diag":
+		e.diagnosticsCommand()
+	case "snippets":
+		e.snippetsCommand()
+	case "outline":
+		e.outlineCommand()
+	case "tag":
+		e.tagCommand(args[1:])
+	case "tags-regenerate":
+		e.regenerateTags()
+	case "back":
+		e.jumpBack()
+	case "lint":
+		e.lint(true)
+	case "next-error":
+		e.nextError(1)
+	case "prev-error":
+		e.nextError(-1)
+	case "undo":
+		e.undo()
+	case "redo":
+		e.redo()
 	case "test":
-		out, _ := e.runGoTests()
-		diagnostics = parseGoTestOutput(out)
-		// if diagnostics pertain to current file, position cursor to first
-		if len(diagnostics) > 0 && e.filename != "" {
-			for _, d := range diagnostics {
-				if filepath.Base(d.File) == filepath.Base(e.filename) {
-					if d.Line >= 0 && d.Line < len(e.lines) {
-						e.cursorLine = d.Line
-						e.adjustScroll()
-						break
-					}
-				}
-			}
-		}
+		e.testCommand("all")
+	case "test-pkg":
+		e.testCommand("pkg")
+	case "test-func":
+		e.testCommand("func")
+	case "panel":
+		e.panelCommand(args[1:])
 	}
 }
 
@@ -826,18 +992,6 @@ func formatSourceGo(src string) (string, error) {
 	return string(out), nil
 }
 
-func formatJSON(src string) (string, error) {
-	var v interface{}
-	if err := json.Unmarshal([]byte(src), &v); err != nil {
-		return "", err
-	}
-	out, err := json.MarshalIndent(v, "", "    ")
-	if err != nil {
-		return "", err
-	}
-	return string(out), nil
-}
-
 func (e *Editor) promptSaveCommandLine() {
 	e.mode = PromptSave
 	e.commandBuf = ""
@@ -852,8 +1006,7 @@ func (e *Editor) promptQuitCommandLine() {
 // ----------------- RENDER -----------------
 
 func (e *Editor) adjustScroll() {
-	_, h := e.screen.Size()
-	height := h - 5
+	height := e.pageSize()
 	if e.cursorLine < e.scrollOffset {
 		e.scrollOffset = e.cursorLine
 	}
@@ -864,7 +1017,7 @@ func (e *Editor) adjustScroll() {
 
 func (e *Editor) pageSize() int {
 	_, h := e.screen.Size()
-	return h - 5
+	return h - 5 - e.panelRows()
 }
 
 // func expandTabs(s string, tabWidth int) string {
@@ -884,11 +1037,24 @@ func (e *Editor) pageSize() int {
 // }
 
 func (e *Editor) Render() {
+	if e.semanticPending {
+		if len(e.lines) <= syncHighlightLines {
+			e.applySemanticTokens()
+		} else {
+			e.startSemanticHighlight()
+		}
+	}
+	e.highlightVisible()
+	e.trackDiagnostics()
+	e.syncLSP()
+	pair, hasPair := e.cursorBrackets()
+	guides := e.computeIndentGuides()
+
 	// Set screen background
 	e.screen.Clear()
 	e.screen.Fill(' ', tcell.StyleDefault.Background(tcell.NewRGBColor(15, 20, 30)))
 	w, h := e.screen.Size()
-	height := h - 5
+	height := e.pageSize()
 
 	// Top bar
 	drawLine(e.screen, 0, 0, w, '-')
@@ -920,8 +1086,24 @@ func (e *Editor) Render() {
 			currentLineNumStr = lineNumStr
 		}
 		drawString(e.screen, 0, 3+i, lineNumStr)
+		e.drawDiagnosticMark(idx, len(lineNumStr)-1, 3+i)
+		e.drawTestMark(idx, len(lineNumStr)-1, 3+i)
 		// draw with horizontal clipping using expanded tabs
 		e.drawHighlightedLineWithHScroll(len(lineNumStr), 3+i, idx, w-lineNumWidth-2)
+		if e.showWhitespace {
+			e.drawWhitespace(idx, len(lineNumStr), 3+i, w-lineNumWidth-2)
+		}
+		if options.IndentGuides {
+			e.drawIndentGuides(guides, idx, len(lineNumStr), 3+i, w-lineNumWidth-2)
+		}
+		if idx == e.cursorLine && options.HighlightCurrentLine {
+			e.drawCurrentLine(len(lineNumStr), 3+i, w-lineNumWidth-2)
+		}
+		e.drawDiagnostics(idx, len(lineNumStr), 3+i, w-lineNumWidth-2)
+		e.drawSnippetFields(idx, len(lineNumStr), 3+i, w-lineNumWidth-2)
+		if hasPair {
+			e.drawBracketMarks(pair, idx, len(lineNumStr), 3+i, w-lineNumWidth-2)
+		}
 	}
 
 	// Scroll bar
@@ -930,11 +1112,16 @@ func (e *Editor) Render() {
 		bottomY := 3 + height - 1
 		drawString(e.screen, w-1, topY, "▲")
 		drawString(e.screen, w-1, bottomY, "▼")
+		e.drawDiagnosticTicks(w-1, topY, height)
 		ratio := float64(e.cursorLine) / float64(max(1, len(e.lines)-1))
 		pos := int(ratio * float64(height-1))
 		drawString(e.screen, w-1, topY+pos, "█")
 	}
 
+	if rows := e.panelRows(); rows > 0 {
+		e.drawPanel(h-2-rows, rows, w)
+	}
+
 	// Auto-load more lines if we're near the end of currently loaded content
 	if e.partialLoad && e.cursorLine > len(e.lines)-100 {
 		e.loadMoreLines(1000)
@@ -943,34 +1130,46 @@ func (e *Editor) Render() {
 	// Diagnostic/status area and command line separator placement
 	statusMsg := ""
 	errorStyle := tcell.StyleDefault.Background(tcell.NewRGBColor(15, 20, 30)).Foreground(tcell.NewRGBColor(255, 0, 0))
-	if len(diagnostics) > 0 {
-		for _, d := range diagnostics {
-			if filepath.Base(d.File) == filepath.Base(e.filename) {
-				if d.Line == e.cursorLine {
-					statusMsg = "Error: " + d.Message
-					break
-				}
-			}
-		}
-		if statusMsg == "" {
-			for _, d := range diagnostics {
-				if filepath.Base(d.File) == filepath.Base(e.filename) {
-					statusMsg = "Warning: " + d.Message
-					break
-				}
-			}
-		}
+	statusStyle := errorStyle
+	if d, ok := e.diagnosticAt(e.cursorLine); ok {
+		statusMsg = severityLabel(d.Severity) + firstLine(d.Message)
+		statusStyle = statusStyle.Foreground(severityColor(d.Severity))
 	}
 
-	statusY := h - 3
+	statusY := h - 2
 	cmdY := h - 1
-	if statusMsg != "" {
-		// Draw error/warning messages in red
-		for i, r := range statusMsg {
-			e.screen.SetContent(i, statusY+1, r, nil, errorStyle)
+	drawLine(e.screen, 0, statusY, w, '-')
+	if e.message != "" {
+		// One-off messages answer the last command, so they come first
+		drawString(e.screen, 0, statusY, e.message)
+	} else if statusMsg != "" {
+		// Draw the cursor line's problem in its severity's color
+		for i, r := range []rune(statusMsg) {
+			e.screen.SetContent(i, statusY, r, nil, statusStyle)
+		}
+	}
+	right := w
+	if hasPair && !pair.matched {
+		indicator := " Unmatched '" + string(e.lines[pair.line][pair.col]) + "' "
+		for i, r := range indicator {
+			e.screen.SetContent(w-len(indicator)+i, statusY, r, nil, errorStyle)
+		}
+		right -= len(indicator)
+	}
+	// The symbol the cursor is in, when there's room beside the message
+	if _, where := e.symbolAt(e.cursorLine); where != "" {
+		where = " " + where + " "
+		left := len([]rune(e.message))
+		if e.message == "" {
+			left = len([]rune(statusMsg))
+		}
+		if x := right - len([]rune(where)); x > left {
+			symbolStyle := tcell.StyleDefault.Background(tcell.NewRGBColor(15, 20, 30)).Foreground(tcell.NewRGBColor(150, 180, 230))
+			for i, r := range []rune(where) {
+				e.screen.SetContent(x+i, statusY, r, nil, symbolStyle)
+			}
 		}
 	}
-	drawLine(e.screen, 0, cmdY-1, w, '-')
 
 	// Command line
 	switch e.mode {
@@ -1007,7 +1206,13 @@ func (e *Editor) Render() {
 	}
 	// Place cursor taking horizOffset into account
 	screenX := e.cursorVisualCol - e.horizOffset + len(currentLineNumStr)
-	e.screen.ShowCursor(screenX, e.cursorLine-e.scrollOffset+3)
+	e.drawCompletion(screenX, e.cursorLine-e.scrollOffset+3, 3, 3+height, w)
+	e.drawPopup(screenX, e.cursorLine-e.scrollOffset+3, 3, 3+height, w)
+	if e.mode == PanelMode {
+		e.screen.HideCursor()
+	} else {
+		e.screen.ShowCursor(screenX, e.cursorLine-e.scrollOffset+3)
+	}
 	e.screen.Show()
 }
 
@@ -1132,7 +1337,9 @@ func (e *Editor) drawHighlightedLineWithHScroll(x, y, lineIdx, maxWidth int) {
 			}
 		}
 
-		prevByte = token.End
+		// Tokens nested inside an earlier one are drawn over it without
+		// cutting the outer token short
+		prevByte = max(prevByte, token.End)
 	}
 
 	// trailing gap after last token
@@ -1244,468 +1451,657 @@ func (e *Editor) getLineNumberWidth() int {
 // ----------------- FORMAT DETECTION -----------------
 
 func (e *Editor) detectFormat() {
+	// The language server follows the format
+	defer e.openLSP()
+
+	if e.syntaxOverride {
+		e.format = e.overrideFormat
+		fileFormat = e.format.String()
+		e.highlighter = NewSyntaxHighlighter(e.format)
+		return
+	}
 	if e.filename == "" {
 		e.format = PlainText
 		e.highlighter = NewSyntaxHighlighter(PlainText)
 		return
 	}
 
-	ext := strings.ToLower(filepath.Ext(e.filename))
-	switch ext {
-	case ".go":
-		e.format = Go
-		fileFormat = "Go"
-	case ".js", ".jsx":
-		e.format = JavaScript
-		fileFormat = "JavaScript"
-	case ".py":
-		e.format = Python
-		fileFormat = "Python"
-	case ".html", ".htm":
-		e.format = HTML
-		fileFormat = "HTML"
-	case ".css":
-		e.format = CSS
-		fileFormat = "CSS"
-	case ".json":
-		e.format = JSON
-		fileFormat = "JSON"
-	case ".md", ".markdown":
-		e.format = Markdown
-		fileFormat = "Markdown"
-	case ".sh", ".bash":
-		e.format = Shell
-		fileFormat = "Shell"
-	case ".c":
-		e.format = C
-		fileFormat = "C"
-	case ".cpp", ".cc", ".cxx":
-		e.format = CPP
-		fileFormat = "CPP"
-	case ".rs":
-		e.format = Rust
-		fileFormat = "Rust"
-	case ".java":
-		e.format = Java
-		fileFormat = "Java"
-	case ".php":
-		e.format = PHP
-		fileFormat = "PHP"
-	case ".sqd":
-		e.format = SquidPlusPlus
-		fileFormat = "SQU1D++"
-	default:
-		e.format = PlainText
-		fileFormat = "Plain Text"
-	}
+	e.format = detectFileFormat(e.filename, e.lines)
+	fileFormat = e.format.String()
 
 	e.highlighter = NewSyntaxHighlighter(e.format)
 }
 
-// ----------------- SYNTAX HIGHLIGHTING -----------------
-
-func NewSyntaxHighlighter(format FileFormat) *SyntaxHighlighter {
-	h := &SyntaxHighlighter{
-		format:               format,
-		keywords:             make(map[string]bool),
-		patterns:             make(map[TokenType]*regexp.Regexp),
-		embeddedHighlighters: make(map[FileFormat]*SyntaxHighlighter),
+// setSyntax overrides the detected format for the rest of the session.
+// "syntax auto" goes back to detection and a bare "syntax" reports the format.
+func (e *Editor) setSyntax(args []string) {
+	if len(args) == 0 {
+		e.message = "Syntax: " + e.format.String()
+		if e.syntaxOverride {
+			e.message += " (set manually)"
+		}
+		return
 	}
 
-	switch format {
-	case Go:
-		h.setupGoHighlighting()
-	case JavaScript:
-		h.setupJavaScriptHighlighting()
-	case Python:
-		h.setupPythonHighlighting()
-	case HTML:
-		h.setupHTMLHighlighting()
-	case CSS:
-		h.setupCSSHighlighting()
-	case Java:
-		h.setupJavaHighlighting()
-	case Rust:
-		h.setupRustHighlighting()
-	case C:
-		h.setupCHighlighting()
-	case CPP:
-		h.setupCPPHighlighting()
-	case PHP:
-		h.setupPHPHighlighting()
-	case SquidPlusPlus:
-		h.setupSquidPlusPlusHighlighting()
-	case PlainText:
-		// PlainText doesn't need special highlighting, but we still need a valid case
+	name := strings.Join(args, " ")
+	switch strings.ToLower(name) {
+	case "auto":
+		e.syntaxOverride = false
+	case "plain", "text", "plain text", "none":
+		e.syntaxOverride = true
+		e.overrideFormat = PlainText
 	default:
-		h.format = PlainText
+		format, ok := grammars.lookup(name)
+		if !ok {
+			e.message = "Unknown syntax: " + name
+			return
+		}
+		e.syntaxOverride = true
+		e.overrideFormat = format
 	}
 
-	h.setupEmbeddedHighlighters()
+	e.detectFormat()
+	e.refreshDiagnostics()
+	e.updateSyntaxHighlighting()
+	e.message = "Syntax: " + e.format.String()
+}
 
+// ----------------- SYNTAX HIGHLIGHTING -----------------
+
+func NewSyntaxHighlighter(format FileFormat) *SyntaxHighlighter {
+	h := createBasicSyntaxHighlighter(format)
+	h.setupEmbeddedHighlighters()
+	if format == Go {
+		h.semantic = newGoHighlighter()
+	}
 	return h
 }
 
 func (h *SyntaxHighlighter) setupEmbeddedHighlighters() {
-	switch h.format {
-	case HTML:
-		// HTML can contain JavaScript and CSS (but not PHP to avoid recursion)
-		h.embeddedHighlighters[JavaScript] = createBasicSyntaxHighlighter(JavaScript)
-		h.embeddedHighlighters[CSS] = createBasicSyntaxHighlighter(CSS)
-	case PHP:
-		// PHP can contain JavaScript and CSS (but not HTML to avoid recursion)
-		h.embeddedHighlighters[JavaScript] = createBasicSyntaxHighlighter(JavaScript)
-		h.embeddedHighlighters[CSS] = createBasicSyntaxHighlighter(CSS)
-	case Shell:
-		// Shell scripts can contain embedded code
-		h.embeddedHighlighters[JavaScript] = createBasicSyntaxHighlighter(JavaScript)
-		h.embeddedHighlighters[Python] = createBasicSyntaxHighlighter(Python)
+	if h.grammar == nil {
+		return
+	}
+	for _, rule := range h.grammar.Embedded {
+		format, ok := grammars.lookup(rule.Language)
+		if !ok || format == h.format {
+			continue
+		}
+		h.embeddedHighlighters[format] = createBasicSyntaxHighlighter(format)
 	}
 }
 
+// createBasicSyntaxHighlighter builds a highlighter from the format's grammar
+// without embedded languages, so embedding can't recurse.
 func createBasicSyntaxHighlighter(format FileFormat) *SyntaxHighlighter {
 	h := &SyntaxHighlighter{
 		format:               format,
 		keywords:             make(map[string]bool),
-		patterns:             make(map[TokenType]*regexp.Regexp),
 		embeddedHighlighters: make(map[FileFormat]*SyntaxHighlighter),
+		regionEnds:           make(map[string]*regexp.Regexp),
 	}
 
-	switch format {
-	case Go:
-		h.setupGoHighlighting()
-	case JavaScript:
-		h.setupJavaScriptHighlighting()
-	case Python:
-		h.setupPythonHighlighting()
-	case HTML:
-		h.setupHTMLHighlighting()
-	case CSS:
-		h.setupCSSHighlighting()
-	case Java:
-		h.setupJavaHighlighting()
-	case Rust:
-		h.setupRustHighlighting()
-	case C:
-		h.setupCHighlighting()
-	case CPP:
-		h.setupCPPHighlighting()
-	case PHP:
-		h.setupPHPHighlighting()
-	case PlainText:
-		// PlainText doesn't need special highlighting, but we still need a valid case
-	default:
+	h.grammar = grammars.grammar(format)
+	if h.grammar == nil {
 		h.format = PlainText
+		return h
 	}
 
-	// Do not call setupEmbeddedHighlighters to avoid recursion
+	for _, keyword := range h.grammar.Keywords {
+		h.keywords[keyword] = true
+	}
+	h.rules = h.grammar.rules
 
 	return h
 }
 
-func (h *SyntaxHighlighter) setupGoHighlighting() {
-	keywords := []string{
-		"break", "case", "chan", "const", "continue", "default", "defer", "else",
-		"fallthrough", "for", "func", "go", "goto", "if", "import", "interface",
-		"map", "package", "range", "return", "select", "struct", "switch", "type",
-		"var", "bool", "byte", "complex64", "complex128", "error", "float32",
-		"float64", "int", "int8", "int16", "int32", "int64", "rune", "string",
-		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "true", "false",
-		"iota", "nil", "append", "cap", "close", "complex", "copy", "delete",
-		"imag", "len", "make", "new", "panic", "print", "println", "real", "recover",
+// syncHighlightLines is the largest buffer highlighted in one go; bigger
+// ones get the visible lines first and the rest in the background.
+const syncHighlightLines = 5000
+
+// highlightBatch is how many lines the background job sends back at a time
+const highlightBatch = 2000
+
+// highlightEvent carries a batch of lines highlighted in the background
+type highlightEvent struct {
+	tcell.EventTime
+	gen      int
+	start    int
+	tokens   [][]Token
+	contexts [][]EmbeddedContext
+	states   []lineState
+}
+
+// semanticEvent carries the semantic highlighter's tokens for the buffer
+type semanticEvent struct {
+	tcell.EventTime
+	gen    int
+	tokens [][]Token
+}
+
+// funcEvent carries the result of a background job, such as a language
+// server's answer, to the event loop, which applies it to the editor
+type funcEvent struct {
+	tcell.EventTime
+	apply func(e *Editor)
+}
+
+// postFuncEvent hands apply to the event loop to run there
+func postFuncEvent(screen tcell.Screen, apply func(e *Editor)) {
+	ev := &funcEvent{apply: apply}
+	ev.SetEventNow()
+	postEvent(screen, ev, nil)
+}
+
+func (e *Editor) updateSyntaxHighlighting() {
+	e.lineTokens = make([][]Token, len(e.lines))
+	e.embeddedContexts = make([][]EmbeddedContext, len(e.lines))
+	e.lineStates = make([]lineState, len(e.lines))
+	e.highlightedTo = 0
+	e.semanticGen++
+	if e.highlighter == nil {
+		e.highlightedTo = len(e.lines)
+		e.startBackgroundHighlight()
+		return
 	}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+	end := len(e.lines)
+	if end > syncHighlightLines {
+		end = min(end, e.visibleEnd())
+	}
+	state := lineState{}
+	for i := 0; i < end; i++ {
+		e.lineStates[i] = state
+		e.lineTokens[i], e.embeddedContexts[i], state = e.highlighter.tokenizeLineWithState(e.lines[i], state)
 	}
+	e.highlightedTo = end
+	e.startBackgroundHighlight()
 
-	h.patterns[TokenString] = regexp.MustCompile(`"([^"\\]|\\.)*"|` + "`[^`]*`" + `|'([^'\\]|\\.)*'`)
-	h.patterns[TokenComment] = regexp.MustCompile(`//.*$|/\*[\s\S]*?\*/`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?([eE][+-]?\d+)?\b|0[xX][0-9a-fA-F]+|0[0-7]+`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`[+\-*/=<>!&|^%]+|:=|<<|>>|\+\+|--|&&|\|\||<-|\.\.\.|\.\.`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\b(func\s+)?([a-zA-Z_][a-zA-Z0-9_]*)\s*\(`)
-	h.patterns[TokenMethod] = regexp.MustCompile(`\.([a-zA-Z_][a-zA-Z0-9_]*)\s*\(`)
-	h.patterns[TokenType_] = regexp.MustCompile(`\b[A-Z][a-zA-Z0-9_]*\b`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
-	h.patterns[TokenVariable] = regexp.MustCompile(`\b[a-z_][a-zA-Z0-9_]*\b`)
-	h.patterns[TokenPreprocessor] = regexp.MustCompile(`\bpackage\s+\w+|\bimport\s+`)
+	e.semanticPending = e.highlighter.semantic != nil
+	if len(e.lines) <= syncHighlightLines {
+		e.applySemanticTokens()
+	}
 }
 
-func (h *SyntaxHighlighter) setupJavaScriptHighlighting() {
-	keywords := []string{
-		"break", "case", "catch", "class", "const", "continue", "debugger", "default",
-		"delete", "do", "else", "export", "extends", "finally", "for", "function",
-		"if", "import", "in", "instanceof", "let", "new", "return", "super", "switch",
-		"this", "throw", "try", "typeof", "var", "void", "while", "with", "yield",
-		"true", "false", "null", "undefined", "async", "await",
+// visibleEnd is the index just past the last line on screen
+func (e *Editor) visibleEnd() int {
+	if e.screen == nil {
+		return len(e.lines)
 	}
+	return e.scrollOffset + e.pageSize() + 1
+}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+// startBackgroundHighlight highlights the lines from highlightedTo on in a
+// goroutine, replacing any job already running. Results come back to the
+// event loop as highlightEvents and are dropped if the buffer changed since.
+func (e *Editor) startBackgroundHighlight() {
+	e.highlightGen++
+	if e.highlightStop != nil {
+		close(e.highlightStop)
+		e.highlightStop = nil
+	}
+	from := e.highlightedTo
+	if e.highlighter == nil || e.screen == nil || from >= len(e.lines) {
+		return
 	}
 
-	h.patterns[TokenString] = regexp.MustCompile(`"([^"\\]|\\.)*"|'([^'\\]|\\.)*'|` + "`[^`]*`")
-	h.patterns[TokenComment] = regexp.MustCompile(`//.*$|/\*[\s\S]*?\*/`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?([eE][+-]?\d+)?\b|0[xX][0-9a-fA-F]+|0[bB][01]+|0[oO][0-7]+`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`[+\-*/=<>!&|^%]+|===|!==|==|!=|<=|>=|\+\+|--|&&|\|\||=>|\.\.\.`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\b(function\s+)?([a-zA-Z_$][a-zA-Z0-9_$]*)\s*\(|([a-zA-Z_$][a-zA-Z0-9_$]*)\s*=>`)
-	h.patterns[TokenClass] = regexp.MustCompile(`\b(class\s+)([a-zA-Z_$][a-zA-Z0-9_$]*)|(\bnew\s+)([A-Z][a-zA-Z0-9_$]*)`)
-	h.patterns[TokenMethod] = regexp.MustCompile(`\.([a-zA-Z_$][a-zA-Z0-9_$]*)\s*\(`)
-	h.patterns[TokenProperty] = regexp.MustCompile(`\.([a-zA-Z_$][a-zA-Z0-9_$]*)`)
-	h.patterns[TokenRegex] = regexp.MustCompile(`/(?:[^/\\\n]|\\.)+/[gimuy]*`)
-	h.patterns[TokenVariable] = regexp.MustCompile(`\b(let|const|var)\s+([a-zA-Z_$][a-zA-Z0-9_$]*)`)
+	// The job gets its own highlighter since highlighters cache lazily
+	h := NewSyntaxHighlighter(e.highlighter.format)
+	state := lineState{}
+	if from > 0 {
+		_, _, state = h.tokenizeLineWithState(e.lines[from-1], e.lineStates[from-1])
+	}
+	lines := append([]string(nil), e.lines...)
+	stop := make(chan struct{})
+	e.highlightStop = stop
+	gen, screen := e.highlightGen, e.screen
+
+	go func() {
+		for start := from; start < len(lines); start += highlightBatch {
+			end := min(start+highlightBatch, len(lines))
+			ev := &highlightEvent{gen: gen, start: start}
+			for _, line := range lines[start:end] {
+				tokens, contexts, next := h.tokenizeLineWithState(line, state)
+				ev.tokens = append(ev.tokens, tokens)
+				ev.contexts = append(ev.contexts, contexts)
+				ev.states = append(ev.states, state)
+				state = next
+			}
+			ev.SetEventNow()
+			if !postEvent(screen, ev, stop) {
+				return
+			}
+		}
+	}()
 }
 
-func (h *SyntaxHighlighter) setupPythonHighlighting() {
-	keywords := []string{
-		"and", "as", "assert", "break", "class", "continue", "def", "del", "elif",
-		"else", "except", "exec", "finally", "for", "from", "global", "if", "import",
-		"in", "is", "lambda", "not", "or", "pass", "print", "raise", "return", "try",
-		"while", "with", "yield", "True", "False", "None", "async", "await", "nonlocal",
+// postEvent hands ev to the event loop, waiting while the queue is full
+func postEvent(screen tcell.Screen, ev tcell.Event, stop chan struct{}) bool {
+	for screen.PostEvent(ev) != nil {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
 	}
+	return true
+}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+// applyHighlightEvent stores a batch from the background job
+func (e *Editor) applyHighlightEvent(ev *highlightEvent) {
+	if ev.gen != e.highlightGen {
+		return
+	}
+	for i := range ev.tokens {
+		idx := ev.start + i
+		if idx >= len(e.lines) {
+			break
+		}
+		if e.highlighter.semantic == nil {
+			e.lineTokens[idx] = ev.tokens[i]
+		}
+		e.embeddedContexts[idx] = ev.contexts[i]
+		e.lineStates[idx] = ev.states[i]
+	}
+	e.highlightedTo = min(ev.start+len(ev.tokens), len(e.lines))
+	if e.highlightedTo == len(e.lines) {
+		e.highlightStop = nil
 	}
+}
 
-	h.patterns[TokenString] = regexp.MustCompile(`"""[\s\S]*?"""|'''[\s\S]*?'''|"([^"\\]|\\.)*"|'([^'\\]|\\.)*'|r"[^"]*"|r'[^']*'|f"[^"]*"|f'[^']*'`)
-	h.patterns[TokenComment] = regexp.MustCompile(`#.*$`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?([eE][+-]?\d+)?\b|0[xX][0-9a-fA-F]+|0[bB][01]+|0[oO][0-7]+`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`[+\-*/=<>!&|^%]+|==|!=|<=|>=|\*\*|//|@|\bin\b|\bis\b|\bnot\b`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\b(def\s+)([a-zA-Z_][a-zA-Z0-9_]*)|([a-zA-Z_][a-zA-Z0-9_]*)\s*\(`)
-	h.patterns[TokenClass] = regexp.MustCompile(`\b(class\s+)([a-zA-Z_][a-zA-Z0-9_]*)`)
-	h.patterns[TokenMethod] = regexp.MustCompile(`\.([a-zA-Z_][a-zA-Z0-9_]*)\s*\(`)
-	h.patterns[TokenProperty] = regexp.MustCompile(`\.([a-zA-Z_][a-zA-Z0-9_]*)`)
-	h.patterns[TokenAnnotation] = regexp.MustCompile(`@([a-zA-Z_][a-zA-Z0-9_]*)`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
-	h.patterns[TokenVariable] = regexp.MustCompile(`\bself\b|\bcls\b`)
-}
-
-func (h *SyntaxHighlighter) setupHTMLHighlighting() {
-	keywords := []string{
-		"html", "head", "body", "title", "meta", "script", "style", "link", "div", "span", "p",
-		"h1", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "li", "a", "img", "table", "tr", "td",
-		"th", "caption", "form", "input", "textarea", "button", "select", "option", "label",
-		"br", "hr", "blockquote", "cite", "code", "pre", "kbd", "samp", "var", "small", "strong",
-		"em", "b", "i", "u", "s", "del", "ins", "sup", "sub", "mark", "ruby", "rt", "rp", "bdi",
-		"bdo", "iframe", "picture", "source", "video", "audio", "track", "canvas", "map", "area",
-		"base", "nav", "section", "article", "aside", "header", "footer", "main", "figure",
-		"figcaption", "details", "summary", "dialog", "menu", "menuitem",
-	}
-
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+// highlightVisible gives visible lines the background job hasn't reached yet
+// provisional tokens, so a jump into a large file isn't drawn plain
+func (e *Editor) highlightVisible() {
+	if e.highlighter == nil {
+		return
+	}
+	for i := max(e.scrollOffset, e.highlightedTo); i < min(e.visibleEnd(), len(e.lines)); i++ {
+		if e.lineTokens[i] == nil {
+			e.lineTokens[i], e.embeddedContexts[i], _ = e.highlighter.tokenizeLineWithState(e.lines[i], e.lineStates[i])
+		}
 	}
+}
 
-	h.patterns[TokenComment] = regexp.MustCompile(`<!--[\s\S]*?-->`)
-	h.patterns[TokenDoctype] = regexp.MustCompile(`<!DOCTYPE[^>]*>`)
-	h.patterns[TokenTag] = regexp.MustCompile(`</?[a-zA-Z][a-zA-Z0-9]*`)
-	h.patterns[TokenAttribute] = regexp.MustCompile(`\b[a-zA-Z-]+\s*=`)
-	h.patterns[TokenValue] = regexp.MustCompile(`"([^"\\]|\\.)*"|'([^'\\]|\\.)*'`)
-	h.patterns[TokenEntity] = regexp.MustCompile(`&[a-zA-Z][a-zA-Z0-9]*;|&#\d+;|&#x[0-9a-fA-F]+;`)
-	h.patterns[TokenDelimiter] = regexp.MustCompile(`[<>/=]`)
+// applySemanticTokens replaces the grammar's tokens with the semantic
+// highlighter's, if the format has one and it could parse the buffer.
+// While a background run is using the highlighter it stays pending, to be
+// applied once that run reports back.
+func (e *Editor) applySemanticTokens() {
+	if e.semanticRunning {
+		e.semanticPending = true
+		return
+	}
+	e.semanticPending = false
+	if e.highlighter == nil || e.highlighter.semantic == nil {
+		return
+	}
+	if tokens := e.highlighter.semantic.tokens(e.lines, e.filename); len(tokens) == len(e.lines) {
+		e.lineTokens = tokens
+	}
 }
 
-func (h *SyntaxHighlighter) setupCSSHighlighting() {
-	keywords := []string{
-		"color", "background", "font", "margin", "padding", "border", "width", "height",
-		"display", "position", "top", "left", "right", "bottom", "float", "clear",
-		"text-align", "text-decoration", "font-size", "font-weight", "font-family",
-		"line-height", "letter-spacing", "word-spacing", "white-space", "vertical-align",
-		"list-style", "overflow", "visibility", "z-index", "cursor", "opacity",
-		"transform", "transition", "animation", "flex", "grid", "justify-content",
-		"align-items", "align-content", "flex-direction", "flex-wrap", "order",
-		"flex-grow", "flex-shrink", "flex-basis", "grid-template", "grid-area",
+// startSemanticHighlight runs the semantic highlighter on a snapshot of a
+// large buffer in the background; one run at a time, the latest edits win
+func (e *Editor) startSemanticHighlight() {
+	if e.semanticRunning || e.highlighter == nil || e.highlighter.semantic == nil {
+		return
 	}
+	e.semanticPending = false
+	e.semanticRunning = true
+	e.semanticGen++
+	gen, screen, semantic, filename := e.semanticGen, e.screen, e.highlighter.semantic, e.filename
+	lines := append([]string(nil), e.lines...)
+	go func() {
+		ev := &semanticEvent{gen: gen, tokens: semantic.tokens(lines, filename)}
+		ev.SetEventNow()
+		postEvent(screen, ev, nil)
+	}()
+}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+// applySemanticEvent stores the semantic tokens unless the buffer changed
+func (e *Editor) applySemanticEvent(ev *semanticEvent) {
+	e.semanticRunning = false
+	if ev.gen == e.semanticGen && !e.semanticPending && len(ev.tokens) == len(e.lines) {
+		e.lineTokens = ev.tokens
 	}
+}
 
-	h.patterns[TokenComment] = regexp.MustCompile(`/\*[\s\S]*?\*/`)
-	h.patterns[TokenSelector] = regexp.MustCompile(`[.#]?[a-zA-Z][a-zA-Z0-9_-]*\s*[{,]|[a-zA-Z][a-zA-Z0-9_-]*\s*:`)
-	h.patterns[TokenProperty] = regexp.MustCompile(`[a-zA-Z-]+\s*:`)
-	h.patterns[TokenValue] = regexp.MustCompile(`"([^"\\]|\\.)*"|'([^'\\]|\\.)*'`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?(px|em|rem|%|vh|vw|pt|pc|in|cm|mm|ex|ch|vmin|vmax|fr)?\b`)
-	h.patterns[TokenUnit] = regexp.MustCompile(`(px|em|rem|%|vh|vw|pt|pc|in|cm|mm|ex|ch|vmin|vmax|fr)\b`)
-	h.patterns[TokenPseudo] = regexp.MustCompile(`:[a-zA-Z-]+(\([^)]*\))?`)
-	h.patterns[TokenImportant] = regexp.MustCompile(`!important\b`)
-	h.patterns[TokenDelimiter] = regexp.MustCompile(`[{}();:,]`)
+// updateLineTokens re-highlights one line and, when that changes the state
+// the next line starts in (e.g. a code fence was opened), the lines after it.
+func (e *Editor) updateLineTokens(lineIdx int) {
+	e.updateLineRange(lineIdx, lineIdx+1)
 }
 
-func (h *SyntaxHighlighter) setupJavaHighlighting() {
-	keywords := []string{
-		"abstract", "assert", "boolean", "break", "byte", "case", "catch", "char", "class",
-		"const", "continue", "default", "do", "double", "else", "enum", "extends", "final",
-		"finally", "float", "for", "goto", "if", "implements", "import", "instanceof", "int",
-		"interface", "long", "native", "new", "package", "private", "protected", "public",
-		"return", "short", "static", "strictfp", "super", "switch", "synchronized", "this",
-		"throw", "throws", "transient", "try", "void", "volatile", "while", "true", "false", "null",
+// updateLineRange re-highlights the edited lines [start, end) and then
+// carries the state forward while it keeps changing. Past the bottom of the
+// screen the rest is left to the background job.
+func (e *Editor) updateLineRange(start, end int) {
+	defer func() {
+		if e.highlightedTo < len(e.lines) {
+			// Restart the job on the edited text
+			e.startBackgroundHighlight()
+		}
+	}()
+	if e.highlighter == nil {
+		for i := start; i < end && i < len(e.lineTokens); i++ {
+			e.lineTokens[i] = []Token{}
+			e.embeddedContexts[i] = []EmbeddedContext{}
+		}
+		return
 	}
+	// Edits are batched up and reparsed once before the next frame
+	e.semanticPending = e.highlighter.semantic != nil
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+	for lineIdx := start; lineIdx < len(e.lines) && lineIdx < len(e.lineTokens); lineIdx++ {
+		var state, next lineState
+		if lineIdx < len(e.lineStates) {
+			state = e.lineStates[lineIdx]
+		}
+		e.lineTokens[lineIdx], e.embeddedContexts[lineIdx], next = e.highlighter.tokenizeLineWithState(e.lines[lineIdx], state)
+
+		following := lineIdx + 1
+		if following >= len(e.lineStates) || following >= e.highlightedTo {
+			// Not highlighted yet; the background job works out its state
+			return
+		}
+		if following >= end && e.lineStates[following] == next {
+			return
+		}
+		e.lineStates[following] = next
+		if following >= end && following >= e.visibleEnd() {
+			e.highlightedTo = following
+			return
+		}
+	}
+}
+
+// insertLineMeta makes room for n new lines at idx in the per-line highlighting slices
+func (e *Editor) insertLineMeta(idx, n int) {
+	e.lineTokens = append(e.lineTokens[:idx], append(make([][]Token, n), e.lineTokens[idx:]...)...)
+	e.embeddedContexts = append(e.embeddedContexts[:idx], append(make([][]EmbeddedContext, n), e.embeddedContexts[idx:]...)...)
+	state := lineState{}
+	if idx < len(e.lineStates) {
+		state = e.lineStates[idx]
 	}
+	states := make([]lineState, n)
+	for i := range states {
+		states[i] = state
+	}
+	e.lineStates = append(e.lineStates[:idx], append(states, e.lineStates[idx:]...)...)
+	if idx < e.highlightedTo || e.highlightedTo == len(e.lines)-n {
+		e.highlightedTo += n
+	}
+}
 
-	h.patterns[TokenString] = regexp.MustCompile(`"([^"\\]|\\.)*"|'([^'\\]|\\.)*'`)
-	h.patterns[TokenComment] = regexp.MustCompile(`//.*$|/\*[\s\S]*?\*/`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?([eE][+-]?\d+)?[fFdDlL]?\b|0[xX][0-9a-fA-F]+[lL]?|0[bB][01]+[lL]?|0[0-7]+[lL]?`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`[+\-*/=<>!&|^%]+|==|!=|<=|>=|\+\+|--|&&|\|\||<<|>>|>>>`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\b[a-zA-Z_][a-zA-Z0-9_]*\s*\(`)
-	h.patterns[TokenClass] = regexp.MustCompile(`\b[A-Z][a-zA-Z0-9_]*\b`)
-	h.patterns[TokenAnnotation] = regexp.MustCompile(`@[A-Z][a-zA-Z0-9_]*`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
+// removeLineMeta drops the per-line highlighting entries for lines [idx, idx+n)
+func (e *Editor) removeLineMeta(idx, n int) {
+	e.lineTokens = append(e.lineTokens[:idx], e.lineTokens[idx+n:]...)
+	e.embeddedContexts = append(e.embeddedContexts[:idx], e.embeddedContexts[idx+n:]...)
+	e.lineStates = append(e.lineStates[:idx], e.lineStates[idx+n:]...)
+	if idx < e.highlightedTo {
+		e.highlightedTo -= min(n, e.highlightedTo-idx)
+	}
 }
 
-func (h *SyntaxHighlighter) setupRustHighlighting() {
-	keywords := []string{
-		"as", "break", "const", "continue", "crate", "else", "enum", "extern", "false", "fn",
-		"for", "if", "impl", "in", "let", "loop", "match", "mod", "move", "mut", "pub", "ref",
-		"return", "self", "Self", "static", "struct", "super", "trait", "true", "type", "unsafe",
-		"use", "where", "while", "async", "await", "dyn", "abstract", "become", "box", "do",
-		"final", "macro", "override", "priv", "typeof", "unsized", "virtual", "yield",
+// tokenizeLineWithState tokenizes a line that starts in state and returns the
+// state the following line starts in. Lines inside a multi-line region are
+// handed to the region's language or painted with its token type.
+func (h *SyntaxHighlighter) tokenizeLineWithState(line string, state lineState) ([]Token, []EmbeddedContext, lineState) {
+	if h.grammar == nil || state.region == 0 || state.region > len(h.grammar.Regions) {
+		return h.tokenizeOutside(line, 0, 0, nil, nil)
 	}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+	region := h.grammar.Regions[state.region-1]
+	end := h.regionEnd(state.end).FindStringIndex(line)
+	if end != nil && region.Exclusive {
+		// The closing line already belongs to the surrounding text
+		return h.tokenizeOutside(line, 0, 0, nil, nil)
 	}
 
-	h.patterns[TokenString] = regexp.MustCompile(`"([^"\\]|\\.)*"|'([^'\\]|\\.)*'|r#"[^"]*"#|r"[^"]*"`)
-	h.patterns[TokenComment] = regexp.MustCompile(`//.*$|/\*[\s\S]*?\*/`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?([eE][+-]?\d+)?[fF]?\b|0[xX][0-9a-fA-F]+|0[bB][01]+|0[oO][0-7]+`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`[+\-*/=<>!&|^%]+|==|!=|<=|>=|\+\+|--|&&|\|\||<<|>>|->|=>`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\bfn\s+[a-zA-Z_][a-zA-Z0-9_]*|[a-zA-Z_][a-zA-Z0-9_]*\s*!?\s*\(`)
-	h.patterns[TokenMacro] = regexp.MustCompile(`[a-zA-Z_][a-zA-Z0-9_]*!`)
-	h.patterns[TokenType_] = regexp.MustCompile(`\b[A-Z][a-zA-Z0-9_]*\b`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
-}
+	bodyEnd := len(line)
+	if end != nil {
+		// Painted regions keep their closing delimiter, like a string keeps
+		// its quote; embedded code hands the delimiter back to the host
+		bodyEnd = end[1]
+		if state.format != PlainText {
+			bodyEnd = end[0]
+		}
+	}
 
-func (h *SyntaxHighlighter) setupCHighlighting() {
-	keywords := []string{
-		"auto", "break", "case", "char", "const", "continue", "default", "do", "double", "else",
-		"enum", "extern", "float", "for", "goto", "if", "inline", "int", "long", "register",
-		"restrict", "return", "short", "signed", "sizeof", "static", "struct", "switch",
-		"typedef", "union", "unsigned", "void", "volatile", "while", "_Alignas", "_Alignof",
-		"_Atomic", "_Static_assert", "_Noreturn", "_Thread_local", "_Generic",
+	var tokens []Token
+	var contexts []EmbeddedContext
+	if state.format != PlainText {
+		embedded := h.embeddedHighlighter(state.format)
+		tokens = embedded.tokenizeLine(line[:bodyEnd])
+		for i := range tokens {
+			tokens[i].Context = state.format
+		}
+		if bodyEnd > 0 {
+			contexts = []EmbeddedContext{{Format: state.format, Start: 0, End: bodyEnd}}
+		}
+	} else if region.token != TokenNormal && bodyEnd > 0 {
+		tokens = []Token{{Type: region.token, Start: 0, End: bodyEnd, Context: h.format}}
 	}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+	if end == nil {
+		return tokens, contexts, state
 	}
 
-	h.patterns[TokenString] = regexp.MustCompile(`"([^"\\]|\\.)*"|'([^'\\]|\\.)*'`)
-	h.patterns[TokenComment] = regexp.MustCompile(`//.*$|/\*[\s\S]*?\*/`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?([eE][+-]?\d+)?[fFlL]?\b|0[xX][0-9a-fA-F]+[uUlL]*|0[0-7]+[uUlL]*`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`[+\-*/=<>!&|^%]+|==|!=|<=|>=|\+\+|--|&&|\|\||<<|>>|->`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\b[a-zA-Z_][a-zA-Z0-9_]*\s*\(`)
-	h.patterns[TokenPreprocessor] = regexp.MustCompile(`#\s*[a-zA-Z_][a-zA-Z0-9_]*`)
-	h.patterns[TokenType_] = regexp.MustCompile(`\b[a-zA-Z_][a-zA-Z0-9_]*_t\b`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
+	// Highlight whatever follows the region on its closing line
+	return h.tokenizeOutside(line, bodyEnd, end[1], tokens, contexts)
 }
 
-func (h *SyntaxHighlighter) setupCPPHighlighting() {
-	keywords := []string{
-		"alignas", "alignof", "and", "and_eq", "asm", "auto", "bitand", "bitor", "bool", "break",
-		"case", "catch", "char", "char16_t", "char32_t", "class", "compl", "const", "constexpr",
-		"const_cast", "continue", "decltype", "default", "delete", "do", "double", "dynamic_cast",
-		"else", "enum", "explicit", "export", "extern", "false", "float", "for", "friend", "goto",
-		"if", "inline", "int", "long", "mutable", "namespace", "new", "noexcept", "not", "not_eq",
-		"nullptr", "operator", "or", "or_eq", "private", "protected", "public", "register",
-		"reinterpret_cast", "return", "short", "signed", "sizeof", "static", "static_assert",
-		"static_cast", "struct", "switch", "template", "this", "thread_local", "throw", "true",
-		"try", "typedef", "typeid", "typename", "union", "unsigned", "using", "virtual", "void",
-		"volatile", "wchar_t", "while", "xor", "xor_eq",
+// tokenizeOutside highlights line from from on, outside any region, after
+// the tokens already found before it. Regions may start again from resume,
+// past the delimiter of one that just closed. Embedded regions that open and
+// close on the line are filled in, and the state the next line starts in
+// returned.
+func (h *SyntaxHighlighter) tokenizeOutside(line string, from, resume int, tokens []Token, contexts []EmbeddedContext) ([]Token, []EmbeddedContext, lineState) {
+	rest, restContexts := h.tokenizeLineWithContext(line[from:])
+	for _, token := range rest {
+		token.Start += from
+		token.End += from
+		tokens = append(tokens, token)
+	}
+	for _, ctx := range restContexts {
+		ctx.Start += from
+		ctx.End += from
+		contexts = append(contexts, ctx)
 	}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+	tokens, contexts = h.embedInlineRegions(line, tokens, contexts, resume)
+	next, start := h.openRegion(line, tokens, resume)
+	tokens, contexts = h.enterRegion(line, tokens, contexts, next, start)
+	return tokens, contexts, next
+}
+
+// openRegion returns the state after a line outside any region and where
+// the region starts: the first region start at or after from that isn't
+// inside a string or comment opens it, unless it also closes on the same line.
+func (h *SyntaxHighlighter) openRegion(line string, tokens []Token, from int) (lineState, int) {
+	if h.grammar == nil {
+		return lineState{}, 0
+	}
+	for i, region := range h.grammar.Regions {
+		for _, match := range region.re.FindAllStringSubmatchIndex(line, -1) {
+			if match[0] < from || h.isQuoted(match[0], tokens) {
+				continue
+			}
+			state := lineState{region: i + 1, format: PlainText}
+			state.end = expandCaptures(region.End, line, match, regexp.QuoteMeta)
+			if h.regionEnd(state.end).MatchString(line[match[1]:]) {
+				continue
+			}
+			if format, ok := h.regionLanguage(region, line, match); ok {
+				// Embedded code starts after the opening delimiter
+				state.format = format
+				return state, match[1]
+			}
+			return state, match[0]
+		}
 	}
+	return lineState{}, 0
+}
 
-	h.patterns[TokenString] = regexp.MustCompile(`"([^"\\]|\\.)*"|'([^'\\]|\\.)*'|R"\([^)]*\)"`)
-	h.patterns[TokenComment] = regexp.MustCompile(`//.*$|/\*[\s\S]*?\*/`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(\.\d+)?([eE][+-]?\d+)?[fFlL]?\b|0[xX][0-9a-fA-F]+[uUlL]*|0[bB][01]+[uUlL]*|0[0-7]+[uUlL]*`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`[+\-*/=<>!&|^%]+|==|!=|<=|>=|\+\+|--|&&|\|\||<<|>>|->|\*|::`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\b[a-zA-Z_][a-zA-Z0-9_]*\s*\(`)
-	h.patterns[TokenClass] = regexp.MustCompile(`\bclass\s+[a-zA-Z_][a-zA-Z0-9_]*|[A-Z][a-zA-Z0-9_]*`)
-	h.patterns[TokenNamespace] = regexp.MustCompile(`\bnamespace\s+[a-zA-Z_][a-zA-Z0-9_]*|[a-zA-Z_][a-zA-Z0-9_]*::`)
-	h.patterns[TokenPreprocessor] = regexp.MustCompile(`#\s*[a-zA-Z_][a-zA-Z0-9_]*`)
-	h.patterns[TokenType_] = regexp.MustCompile(`\b[a-zA-Z_][a-zA-Z0-9_]*_t\b`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
-}
-
-func (h *SyntaxHighlighter) setupPHPHighlighting() {
-	keywords := []string{
-		"abstract", "and", "array", "as", "break", "callable", "case", "catch", "class", "clone",
-		"const", "continue", "declare", "default", "die", "do", "echo", "else", "elseif", "empty",
-		"enddeclare", "endfor", "endforeach", "endif", "endswitch", "endwhile", "eval", "exit",
-		"extends", "final", "finally", "for", "foreach", "function", "global", "goto", "if",
-		"implements", "include", "include_once", "instanceof", "insteadof", "interface", "isset",
-		"list", "namespace", "new", "or", "print", "private", "protected", "public", "require",
-		"require_once", "return", "static", "switch", "throw", "trait", "try", "unset", "use",
-		"var", "while", "xor", "yield", "true", "false", "null", "__CLASS__", "__DIR__", "__FILE__",
-		"__FUNCTION__", "__LINE__", "__METHOD__", "__NAMESPACE__", "__TRAIT__",
-	}
-
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+// regionLanguage resolves the language a region's body is written in, if
+// it names one other than the host's
+func (h *SyntaxHighlighter) regionLanguage(region RegionRule, line string, match []int) (FileFormat, bool) {
+	if region.Language == "" {
+		return PlainText, false
 	}
+	name := expandCaptures(region.Language, line, match, func(s string) string { return s })
+	format, ok := grammars.lookup(name)
+	return format, ok && format != h.format
+}
 
-	// Safe PHP patterns that won't cause hanging
-	h.patterns[TokenString] = regexp.MustCompile(`"[^"\\]*(?:\\.[^"\\]*)*"|'[^'\\]*(?:\\.[^'\\]*)*'`)
-	h.patterns[TokenComment] = regexp.MustCompile(`//[^\r\n]*|/\*[^*]*\*+(?:[^/*][^*]*\*+)*/|#[^\r\n]*`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(?:\.\d+)?(?:[eE][+-]?\d+)?\b|0[xX][0-9a-fA-F]+|0[bB][01]+|0[oO][0-7]+`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`===|!==|==|!=|<=|>=|\*\*|\?\?|[+\-*/=<>!&|^%?:]`)
-	h.patterns[TokenVariable] = regexp.MustCompile(`\$[a-zA-Z_][a-zA-Z0-9_]*`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\bfunction\s+[a-zA-Z_][a-zA-Z0-9_]*`)
-	h.patterns[TokenClass] = regexp.MustCompile(`\bclass\s+[a-zA-Z_][a-zA-Z0-9_]*`)
-	h.patterns[TokenMethod] = regexp.MustCompile(`->[a-zA-Z_][a-zA-Z0-9_]*`)
-	h.patterns[TokenProperty] = regexp.MustCompile(`->[a-zA-Z_][a-zA-Z0-9_]*`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
+// embedInlineRegions hands the bodies of embedded regions that open and
+// close on the same line, like <?= $title ?>, to their language
+func (h *SyntaxHighlighter) embedInlineRegions(line string, tokens []Token, contexts []EmbeddedContext, from int) ([]Token, []EmbeddedContext) {
+	if h.grammar == nil {
+		return tokens, contexts
+	}
+	for _, region := range h.grammar.Regions {
+		if region.Language == "" || region.Linewise {
+			continue
+		}
+		done := from
+		for _, match := range region.re.FindAllStringSubmatchIndex(line, -1) {
+			if match[0] < done || h.isQuoted(match[0], tokens) {
+				continue
+			}
+			format, ok := h.regionLanguage(region, line, match)
+			if !ok {
+				continue
+			}
+			end := h.regionEnd(expandCaptures(region.End, line, match, regexp.QuoteMeta)).FindStringIndex(line[match[1]:])
+			if end == nil {
+				continue
+			}
+			tokens, contexts = h.embedRange(line, tokens, contexts, format, match[1], match[1]+end[0])
+			done = match[1] + end[1]
+		}
+	}
+	return tokens, contexts
 }
 
-func (h *SyntaxHighlighter) setupSquidPlusPlusHighlighting() {
-	keywords := []string{
-		"var", "suppress", "def", "if", "el", "elif", "while", "for", "return", "true", "false", "null",
-		"break", "continue", "include", "pkg_create", "pkg_list", "pkg_remove", "i2fl", "fl2i",
-		"write", "read", "cat", "append", "tp", "abs", "sqrt", "pow", "sin", "cos", "upper",
-		"lower", "trim", "env", "exec", "sleep", "now", "exit",
+// embedRange replaces the tokens in line[start:end] with format's
+func (h *SyntaxHighlighter) embedRange(line string, tokens []Token, contexts []EmbeddedContext, format FileFormat, start, end int) ([]Token, []EmbeddedContext) {
+	if start >= end {
+		return tokens, contexts
+	}
+	var kept []Token
+	for _, token := range tokens {
+		switch {
+		case token.End <= start || token.Start >= end:
+		case token.Start < start && token.End > end:
+			// A host token around the body, like the quotes of node -e '...'
+			after := token
+			after.Start = end
+			kept = append(kept, after)
+			token.End = start
+		case token.Start < start:
+			token.End = start
+		case token.End > end:
+			token.Start = end
+		default:
+			continue
+		}
+		kept = append(kept, token)
 	}
+	for _, token := range h.embeddedHighlighter(format).tokenizeLine(line[start:end]) {
+		token.Start += start
+		token.End += start
+		token.Context = format
+		kept = append(kept, token)
+	}
+	sortTokens(kept)
+	return kept, append(contexts, EmbeddedContext{Format: format, Start: start, End: end})
+}
 
-	for _, keyword := range keywords {
-		h.keywords[keyword] = true
+// enterRegion highlights the rest of the line from start as the body of the
+// region state just opened there: embedded code in its language, painted
+// regions with their token. Linewise regions only begin on the next line.
+func (h *SyntaxHighlighter) enterRegion(line string, tokens []Token, contexts []EmbeddedContext, state lineState, start int) ([]Token, []EmbeddedContext) {
+	if state.region == 0 {
+		return tokens, contexts
+	}
+	region := h.grammar.Regions[state.region-1]
+	if region.Linewise {
+		return tokens, contexts
+	}
+	if state.format != PlainText {
+		return h.embedRange(line, tokens, contexts, state.format, start, len(line))
+	}
+	if region.token == TokenNormal {
+		return tokens, contexts
 	}
 
-	// SQU1D++ patterns for syntax highlighting
-	h.patterns[TokenString] = regexp.MustCompile(`"[^"\\]*(?:\\.[^"\\]*)*"`)
-	h.patterns[TokenComment] = regexp.MustCompile(`#[^#\r\n]*#?`)
-	h.patterns[TokenNumber] = regexp.MustCompile(`\b\d+(?:\.\d+)?(?:[eE][+-]?\d+)?\b|'[0-9]+(?:\.[0-9]+)?`)
-	h.patterns[TokenOperator] = regexp.MustCompile(`==|!=|<=|>=|[+\-*/=<>!%]`)
-	h.patterns[TokenFunction] = regexp.MustCompile(`\bdef\s*\(|\b(?:write|read|cat|append|tp|abs|sqrt|pow|sin|cos|upper|lower|trim|env|exec|sleep|now|pkg_create|pkg_list|pkg_remove|i2fl|fl2i)\b`)
-	h.patterns[TokenConstant] = regexp.MustCompile(`\b(?:true|false|null|pi|e)\b`)
-	h.patterns[TokenDelimiter] = regexp.MustCompile(`[{}\[\]();,]`)
-	h.patterns[TokenVariable] = regexp.MustCompile(`\b[a-zA-Z_][a-zA-Z0-9_]*\b`)
+	kept := tokens[:0]
+	for _, token := range tokens {
+		if token.Start < start {
+			if token.End > start {
+				token.End = start
+			}
+			kept = append(kept, token)
+		}
+	}
+	return append(kept, Token{Type: region.token, Start: start, End: len(line), Context: h.format}), contexts
 }
 
-func (e *Editor) updateSyntaxHighlighting() {
-	e.lineTokens = make([][]Token, len(e.lines))
-	e.embeddedContexts = make([][]EmbeddedContext, len(e.lines))
-	for i := range e.lines {
-		e.updateLineTokens(i)
+// isQuoted reports whether pos falls inside a string or comment token; a
+// token starting at pos is the region's own opening delimiter
+func (h *SyntaxHighlighter) isQuoted(pos int, tokens []Token) bool {
+	for _, token := range tokens {
+		if (token.Type == TokenString || token.Type == TokenComment) && pos > token.Start && pos < token.End {
+			return true
+		}
 	}
+	return false
 }
 
-func (e *Editor) updateLineTokens(lineIdx int) {
-	if lineIdx >= len(e.lines) || lineIdx >= len(e.lineTokens) {
-		return
+// regionEnd compiles a region's resolved end pattern, caching it per highlighter
+func (h *SyntaxHighlighter) regionEnd(pattern string) *regexp.Regexp {
+	if re, ok := h.regionEnds[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		// A capture that can't be quoted into a valid regex never closes
+		re = regexp.MustCompile(`$^`)
 	}
+	h.regionEnds[pattern] = re
+	return re
+}
 
-	line := e.lines[lineIdx]
-	if e.highlighter == nil {
-		e.lineTokens[lineIdx] = []Token{}
-		e.embeddedContexts[lineIdx] = []EmbeddedContext{}
-		return
+// embeddedHighlighter returns the highlighter for a language embedded in this
+// one, creating it the first time a region names it
+func (h *SyntaxHighlighter) embeddedHighlighter(format FileFormat) *SyntaxHighlighter {
+	if eh, ok := h.embeddedHighlighters[format]; ok {
+		return eh
 	}
-	e.lineTokens[lineIdx], e.embeddedContexts[lineIdx] = e.highlighter.tokenizeLineWithContext(line)
+	eh := createBasicSyntaxHighlighter(format)
+	h.embeddedHighlighters[format] = eh
+	return eh
+}
+
+// expandCaptures replaces $1..$9 in template with the capture groups of match,
+// passed through quote
+func expandCaptures(template, line string, match []int, quote func(string) string) string {
+	if !strings.Contains(template, "$") {
+		return template
+	}
+	var out strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] == '$' && i+1 < len(template) && template[i+1] >= '1' && template[i+1] <= '9' {
+			group := int(template[i+1] - '0')
+			if 2*group+1 < len(match) && match[2*group] >= 0 {
+				out.WriteString(quote(line[match[2*group]:match[2*group+1]]))
+			}
+			i++
+			continue
+		}
+		out.WriteByte(template[i])
+	}
+	return out.String()
 }
 
 func (h *SyntaxHighlighter) tokenizeLineWithContext(line string) ([]Token, []EmbeddedContext) {
@@ -1741,60 +2137,27 @@ func (h *SyntaxHighlighter) tokenizeLineWithContext(line string) ([]Token, []Emb
 	}
 
 	// Sort tokens by start position
-	for i := 0; i < len(tokens); i++ {
-		for j := i + 1; j < len(tokens); j++ {
-			if tokens[i].Start > tokens[j].Start {
-				tokens[i], tokens[j] = tokens[j], tokens[i]
-			}
-		}
-	}
+	sortTokens(tokens)
 
 	return tokens, contexts
 }
 
 func (h *SyntaxHighlighter) detectEmbeddedContexts(line string) []EmbeddedContext {
 	var contexts []EmbeddedContext
+	if h.grammar == nil {
+		return contexts
+	}
 
-	switch h.format {
-	case HTML:
-		// Detect <script> tags for JavaScript
-		scriptPattern := regexp.MustCompile(`<script[^>]*>(.*?)</script>`)
-		matches := scriptPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) >= 4 {
-				contexts = append(contexts, EmbeddedContext{
-					Format: JavaScript,
-					Start:  match[2],
-					End:    match[3],
-				})
-			}
-		}
-
-		// Detect <style> tags for CSS
-		stylePattern := regexp.MustCompile(`<style[^>]*>(.*?)</style>`)
-		matches = stylePattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) >= 4 {
-				contexts = append(contexts, EmbeddedContext{
-					Format: CSS,
-					Start:  match[2],
-					End:    match[3],
-				})
-			}
+	for _, rule := range h.grammar.Embedded {
+		format, ok := grammars.lookup(rule.Language)
+		if !ok {
+			continue
 		}
-
-	case PHP:
-		// PHP embedded contexts are handled differently to avoid recursion
-		// We don't detect HTML contexts within PHP files to prevent infinite recursion
-
-	case Shell:
-		// Detect JavaScript in shell scripts (no HTML to avoid recursion)
-		jsPattern := regexp.MustCompile(`node\s+-e\s+['"]([^'"]+)['"]`)
-		matches := jsPattern.FindAllStringSubmatchIndex(line, -1)
+		matches := rule.re.FindAllStringSubmatchIndex(line, -1)
 		for _, match := range matches {
-			if len(match) >= 4 {
+			if match[2] >= 0 {
 				contexts = append(contexts, EmbeddedContext{
-					Format: JavaScript,
+					Format: format,
 					Start:  match[2],
 					End:    match[3],
 				})
@@ -1813,12 +2176,12 @@ func (h *SyntaxHighlighter) tokenizeLine(line string) []Token {
 	var tokens []Token
 
 	// Phase 1: Find strings and comments (highest priority)
-	for tokenType, pattern := range h.patterns {
-		if tokenType == TokenString || tokenType == TokenComment || tokenType == TokenDoctype {
-			matches := pattern.FindAllStringIndex(line, -1)
+	for _, rule := range h.rules {
+		if rule.token == TokenString || rule.token == TokenComment || rule.token == TokenDoctype {
+			matches := rule.pattern.FindAllStringIndex(line, -1)
 			for _, match := range matches {
 				tokens = append(tokens, Token{
-					Type:    tokenType,
+					Type:    rule.token,
 					Start:   match[0],
 					End:     match[1],
 					Context: h.format,
@@ -1828,22 +2191,19 @@ func (h *SyntaxHighlighter) tokenizeLine(line string) []Token {
 	}
 
 	// Sort tokens by start position
-	for i := 0; i < len(tokens); i++ {
-		for j := i + 1; j < len(tokens); j++ {
-			if tokens[i].Start > tokens[j].Start {
-				tokens[i], tokens[j] = tokens[j], tokens[i]
-			}
-		}
-	}
+	sortTokens(tokens)
 
 	// Phase 2: Find keywords (but skip areas already covered)
-	words := regexp.MustCompile(`\b\w+\b`).FindAllStringIndex(line, -1)
+	words := wordPattern.FindAllStringIndex(line, -1)
 	for _, wordMatch := range words {
 		if h.isPositionCovered(wordMatch[0], wordMatch[1], tokens) {
 			continue
 		}
 
 		word := line[wordMatch[0]:wordMatch[1]]
+		if h.grammar != nil && h.grammar.IgnoreCase {
+			word = strings.ToLower(word)
+		}
 		if h.keywords[word] {
 			tokens = append(tokens, Token{
 				Type:    TokenKeyword,
@@ -1854,220 +2214,48 @@ func (h *SyntaxHighlighter) tokenizeLine(line string) []Token {
 		}
 	}
 
-	// Phase 3: Find special patterns (functions, methods, etc.)
-	for tokenType, pattern := range h.patterns {
-		if tokenType != TokenString && tokenType != TokenComment && tokenType != TokenDoctype {
-			matches := pattern.FindAllStringSubmatchIndex(line, -1)
+	// Phase 3: Find special patterns (functions, methods, etc.) in grammar order
+	for _, rule := range h.rules {
+		if rule.token != TokenString && rule.token != TokenComment && rule.token != TokenDoctype {
+			matches := rule.pattern.FindAllStringSubmatchIndex(line, -1)
 			for _, match := range matches {
 				start, end := match[0], match[1]
-				if !h.isPositionCovered(start, end, tokens) {
+				if rule.group >= 0 {
+					// The grammar names the group to highlight
+					start, end = match[2*rule.group], match[2*rule.group+1]
+					if start < 0 || h.isPositionCovered(start, end, tokens) {
+						continue
+					}
+				} else if !h.isPositionCovered(start, end, tokens) {
 					// For function patterns with groups, use the group if available
 					if len(match) > 2 && match[2] != -1 {
 						start, end = match[2], match[3]
 					}
-					tokens = append(tokens, Token{
-						Type:    tokenType,
-						Start:   start,
-						End:     end,
-						Context: h.format,
-					})
+				} else {
+					continue
 				}
+				tokens = append(tokens, Token{
+					Type:    rule.token,
+					Start:   start,
+					End:     end,
+					Context: h.format,
+				})
 			}
 		}
 	}
 
-	// Phase 4: Context-specific tokenization for better accuracy
-	h.addContextSpecificTokens(line, &tokens)
-
 	// Final sort by start position
-	for i := 0; i < len(tokens); i++ {
-		for j := i + 1; j < len(tokens); j++ {
-			if tokens[i].Start > tokens[j].Start {
-				tokens[i], tokens[j] = tokens[j], tokens[i]
-			}
-		}
-	}
+	sortTokens(tokens)
 
 	return tokens
 }
 
-// addContextSpecificTokens adds language-specific tokenization improvements
-func (h *SyntaxHighlighter) addContextSpecificTokens(line string, tokens *[]Token) {
-	switch h.format {
-	case Go:
-		// Identify Go-specific patterns like struct fields, interface methods
-		structFieldPattern := regexp.MustCompile(`\b([A-Z]\w*)\s+\w+`)
-		matches := structFieldPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenType_,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-
-		// Function receivers and return types
-		receiverPattern := regexp.MustCompile(`func\s+\(.*?\)\s+(\w+)`)
-		matches = receiverPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenFunction,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-
-	case JavaScript:
-		// Identify arrow functions and method calls
-		arrowFuncPattern := regexp.MustCompile(`(\w+)\s*=>`)
-		matches := arrowFuncPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenVariable,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-
-		// Object property access
-		propertyPattern := regexp.MustCompile(`\.(\w+)`)
-		matches = propertyPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenProperty,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-
-	case Python:
-		// Identify self parameter and decorators
-		selfPattern := regexp.MustCompile(`\bself\b`)
-		matches := selfPattern.FindAllStringIndex(line, -1)
-		for _, match := range matches {
-			if !h.isPositionCovered(match[0], match[1], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenKeyword,
-					Start:   match[0],
-					End:     match[1],
-					Context: h.format,
-				})
-			}
-		}
-
-		// Decorators
-		decoratorPattern := regexp.MustCompile(`@(\w+)`)
-		matches = decoratorPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenAnnotation,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-
-	case SquidPlusPlus:
-		// Variable assignments
-		varAssignPattern := regexp.MustCompile(`var\s+(\w+)\s*=`)
-		matches := varAssignPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenVariable,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-
-		// Function names in def statements
-		defPattern := regexp.MustCompile(`var\s+(\w+)\s*=\s*def`)
-		matches = defPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenFunction,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-
-		// Array/object property access
-		accessPattern := regexp.MustCompile(`(\w+)\["([^"]+)"\]`)
-		matches = accessPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 5 && !h.isPositionCovered(match[4], match[5], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenProperty,
-					Start:   match[4],
-					End:     match[5],
-					Context: h.format,
-				})
-			}
-		}
-
-		// Quoted float literals
-		quotedFloatPattern := regexp.MustCompile(`'[0-9]*\.?[0-9]+`)
-		matches = quotedFloatPattern.FindAllStringIndex(line, -1)
-		for _, match := range matches {
-			if !h.isPositionCovered(match[0], match[1], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenNumber,
-					Start:   match[0],
-					End:     match[1],
-					Context: h.format,
-				})
-			}
-		}
-
-	case HTML:
-		// Tag attributes
-		attrPattern := regexp.MustCompile(`(\w+)=`)
-		matches := attrPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenAttribute,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
+// wordPattern finds the words checked against a grammar's keywords
+var wordPattern = regexp.MustCompile(`\b\w+\b`)
 
-	case CSS:
-		// CSS selectors and properties
-		selectorPattern := regexp.MustCompile(`^([.#]?\w+[\w-]*)\s*{?`)
-		matches := selectorPattern.FindAllStringSubmatchIndex(line, -1)
-		for _, match := range matches {
-			if len(match) > 3 && !h.isPositionCovered(match[2], match[3], *tokens) {
-				*tokens = append(*tokens, Token{
-					Type:    TokenSelector,
-					Start:   match[2],
-					End:     match[3],
-					Context: h.format,
-				})
-			}
-		}
-	}
+// sortTokens orders tokens by start position
+func sortTokens(tokens []Token) {
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].Start < tokens[j].Start })
 }
 
 func (h *SyntaxHighlighter) isPositionCovered(start, end int, tokens []Token) bool {
@@ -2146,7 +2334,8 @@ func (e *Editor) loadMoreLines(n int) {
 	if len(newLines) > 0 {
 		e.lines = append(e.lines, newLines...)
 		e.fileOffsetLines = len(e.lines)
-		e.updateSyntaxHighlighting()
+		e.insertLineMeta(len(e.lines)-len(newLines), len(newLines))
+		e.updateLineRange(len(e.lines)-len(newLines), len(e.lines))
 	}
 	// Try to peek to see if EOF
 	_, err := r.Peek(1)
@@ -2199,6 +2388,32 @@ func (e *Editor) getTokenStyle(tokenType TokenType) tcell.Style {
 			// Types, Classes, Properties - Crisp Cyan
 			return baseStyle.Foreground(tcell.NewRGBColor(0, 255, 255)).Bold(true)
 
+		case TokenHeading:
+			// Markup headings - Azure like keywords, always bold
+			return baseStyle.Foreground(tcell.NewRGBColor(45, 150, 255)).Bold(true)
+
+		case TokenEmphasis:
+			return baseStyle.Foreground(tcell.NewRGBColor(220, 220, 230)).Italic(true)
+
+		case TokenStrong:
+			return baseStyle.Foreground(tcell.NewRGBColor(255, 255, 255)).Bold(true)
+
+		case TokenLink:
+			// Links - Cyan, underlined
+			return baseStyle.Foreground(tcell.NewRGBColor(0, 200, 255)).Underline(true)
+
+		case TokenBuiltin:
+			// Builtins - Teal, set apart from user-defined functions
+			return baseStyle.Foreground(tcell.NewRGBColor(80, 220, 200))
+
+		case TokenUnresolved:
+			// Unresolved identifiers - default text, underlined as a hint
+			return baseStyle.Foreground(tcell.NewRGBColor(220, 220, 230)).Underline(true)
+
+		case TokenInvalid:
+			// Invalid tokens - white on dark red so they can't be missed
+			return tcell.StyleDefault.Background(tcell.NewRGBColor(140, 20, 20)).Foreground(tcell.NewRGBColor(255, 255, 255))
+
 		default:
 			// Everything else - soft off-white default
 			return baseStyle.Foreground(tcell.NewRGBColor(220, 220, 230))
@@ -2307,6 +2522,52 @@ func (e *Editor) getEncoder() encoding.Encoding {
 	}
 }
 
+// beforeSave applies the on-save options to the buffer before it's written
+func (e *Editor) beforeSave() {
+	if options.TrimOnSave {
+		e.trimTrailingWhitespace()
+	}
+}
+
+// beforeExitSave applies the on-save options before the buffer is written
+// on the way out, waiting for the formatter as nothing is left to apply it
+// later
+func (e *Editor) beforeExitSave() {
+	e.beforeSave()
+	if !options.FormatOnSave {
+		return
+	}
+	if format, ok := formatterFor(e.format); ok {
+		if out, err := format(strings.Join(e.lines, "\n"), e.filename); err == nil {
+			e.replaceBuffer(out)
+		}
+	}
+}
+
+// afterSave runs once the buffer is written. Formatting on save happens
+// here, in the background, and writes the file again if it changed it.
+func (e *Editor) afterSave() {
+	if _, ok := formatterFor(e.format); ok && options.FormatOnSave {
+		e.formatBuffer(func(e *Editor) {
+			if e.dirty {
+				e.saveWithEncoding(e.filename, strings.Join(e.lines, "\n"))
+				e.dirty = false
+			}
+			e.savedHooks()
+		})
+		return
+	}
+	e.savedHooks()
+}
+
+// savedHooks tells the language server and linters the file was saved
+func (e *Editor) savedHooks() {
+	e.lspSaved()
+	if options.LintOnSave {
+		e.lint(false)
+	}
+}
+
 // saveWithEncoding saves the content using the specified encoding
 func (e *Editor) saveWithEncoding(filename, content string) error {
 	encoder := e.getEncoder()
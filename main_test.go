@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// benchGoSource returns n lines of Go made of repeated declarations
+func benchGoSource(n int) []string {
+	lines := []string{"package bench", "", `import "fmt"`, ""}
+	for i := 0; len(lines) < n; i++ {
+		lines = append(lines,
+			fmt.Sprintf("// point%d is a position on the grid", i),
+			fmt.Sprintf("type point%d struct {", i),
+			"\tx, y int",
+			"}",
+			"",
+			fmt.Sprintf("func (p *point%d) String() string {", i),
+			"\t/* a block comment */",
+			`	return fmt.Sprintf("(%d, %d)", p.x, p.y)`,
+			"}",
+			"",
+		)
+	}
+	return lines[:n]
+}
+
+// BenchmarkHighlight50k highlights a whole 50k-line Go buffer with the
+// grammar, as opening the file does
+func BenchmarkHighlight50k(b *testing.B) {
+	lines := benchGoSource(50000)
+	for b.Loop() {
+		e := &Editor{lines: lines, format: Go, highlighter: NewSyntaxHighlighter(Go)}
+		e.updateSyntaxHighlighting()
+	}
+}
+
+// BenchmarkHighlightSemantic50k runs the Go semantic pass over a 50k-line
+// buffer from an empty cache
+func BenchmarkHighlightSemantic50k(b *testing.B) {
+	lines := benchGoSource(50000)
+	for b.Loop() {
+		if tokens := newGoHighlighter().tokens(lines, ""); len(tokens) != len(lines) {
+			b.Fatalf("got tokens for %d lines, want %d", len(tokens), len(lines))
+		}
+	}
+}
+
+// BenchmarkHighlightEdit50k re-highlights a 50k-line Go buffer after typing
+// in its middle: the grammar for the edited line, then the semantic pass,
+// which reparses only the declaration that changed
+func BenchmarkHighlightEdit50k(b *testing.B) {
+	lines := append([]string(nil), benchGoSource(50000)...)
+	e := &Editor{lines: lines, format: Go, highlighter: NewSyntaxHighlighter(Go)}
+	e.updateSyntaxHighlighting()
+	e.applySemanticTokens()
+	mid := 4 + 10*(len(lines)/20) + 2 // a struct field line
+	field := e.lines[mid]
+	i := 0
+	for b.Loop() {
+		e.lines[mid] = fmt.Sprintf("%s // edit %d", field, i)
+		i++
+		e.updateLineTokens(mid)
+		e.applySemanticTokens()
+	}
+}
+
+// TestSemanticWaitsForBackgroundRun shrinks a large Go buffer while its
+// semantic pass runs in the background: the small buffer's pass waits for
+// it instead of sharing the highlighter's cache, then applies
+func TestSemanticWaitsForBackgroundRun(t *testing.T) {
+	s := tcell.NewSimulationScreen("")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Fini()
+	s.SetSize(80, 24)
+	e := &Editor{screen: s, lines: benchGoSource(syncHighlightLines + 1000), format: Go, highlighter: NewSyntaxHighlighter(Go)}
+	e.updateSyntaxHighlighting()
+	e.startSemanticHighlight()
+	if !e.semanticRunning {
+		t.Fatal("no background run started")
+	}
+
+	e.lines = e.lines[:100]
+	e.updateSyntaxHighlighting()
+	if !e.semanticPending {
+		t.Fatal("the semantic pass ran beside the background one")
+	}
+	for {
+		// Skip the screen's own events, such as its resize
+		if ev, ok := s.PollEvent().(*semanticEvent); ok {
+			e.applySemanticEvent(ev)
+			break
+		}
+	}
+	e.Render()
+	if e.semanticPending || len(e.lineTokens) != 100 {
+		t.Fatalf("after the run: pending %v, tokens for %d lines", e.semanticPending, len(e.lineTokens))
+	}
+}
+
+// TestGoSemanticScopes checks the names the parser resolves within a
+// declaration: locals shadow package names, and a chunk's own constants
+// and types are classified by their declaration
+func TestGoSemanticScopes(t *testing.T) {
+	lines := strings.Split(`package p
+
+const limit = 3
+
+func helper() {}
+
+func run(helper int) int {
+	const local = 2
+	type pair struct{ a int }
+	p := pair{a: local}
+	return helper + p.a + limit
+}`, "\n")
+	tokens := newGoHighlighter().tokens(lines, "")
+	kindAt := func(line int, name string) TokenType {
+		// A trailing colon picks out a composite literal's key
+		col := strings.Index(lines[line], name)
+		name = strings.TrimSuffix(name, ":")
+		for _, tok := range tokens[line] {
+			if tok.Start == col && tok.End == col+len(name) {
+				return tok.Type
+			}
+		}
+		return TokenNormal
+	}
+	for _, tt := range []struct {
+		line int
+		name string
+		want TokenType
+	}{
+		{4, "helper", TokenFunction},
+		{10, "helper", TokenNormal},
+		{10, "limit", TokenConstant},
+		{9, "pair", TokenType_},
+		{9, "a:", TokenProperty},
+		{9, "local", TokenConstant},
+	} {
+		if got := kindAt(tt.line, tt.name); got != tt.want {
+			t.Errorf("line %d: %q is %d, want %d", tt.line+1, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- OPTIONS -----------------
+
+// Options are the editor settings read from config.json in the config
+// directory. Anything left out keeps its default.
+type Options struct {
+	ShowWhitespace       bool             `json:"showWhitespace"`
+	WhitespaceGlyphs     WhitespaceGlyphs `json:"whitespaceGlyphs"`
+	TrimOnSave           bool             `json:"trimOnSave"`
+	IndentGuides         bool             `json:"indentGuides"`
+	IndentGuideGlyph     string           `json:"indentGuideGlyph"`
+	HighlightCurrentLine bool             `json:"highlightCurrentLine"`
+	FormatOnSave         bool             `json:"formatOnSave"`
+	FormatTimeout        int              `json:"formatTimeout"` // seconds
+	JSONIndent           string           `json:"jsonIndent"`
+	InlineDiagnostics    bool             `json:"inlineDiagnostics"` // show messages after the line
+	AutoComplete         int              `json:"autoComplete"`      // word length that opens completion, 0 for never
+	Theme                Theme            `json:"theme"`
+
+	// LanguageServers maps a language name to the command that runs its
+	// language server; an empty command turns the default server off
+	LanguageServers map[string][]string `json:"languageServers"`
+	// Formatters maps a language name to a command that formats source
+	// from stdin to stdout; an empty command turns formatting off
+	Formatters map[string][]string `json:"formatters"`
+	// Linters maps a language name to the command checking its files on
+	// save; an empty command turns linting off
+	Linters    map[string][]string `json:"linters"`
+	LintOnSave bool                `json:"lintOnSave"`
+	// BuildCommands maps a language name to the shell command the build
+	// command runs when the project doesn't name one
+	BuildCommands map[string]string `json:"buildCommands"`
+	// RunCommands maps a language name to the shell command the run
+	// command runs the file with; "{file}" is replaced with its name
+	RunCommands map[string]string `json:"runCommands"`
+	// ErrorFormats are tried before the built-in ones on build output
+	ErrorFormats []ErrorFormat `json:"errorFormats"`
+}
+
+// WhitespaceGlyphs are drawn in place of whitespace while it's shown
+type WhitespaceGlyphs struct {
+	Tab      string `json:"tab"`
+	Space    string `json:"space"`
+	Trailing string `json:"trailing"`
+	CR       string `json:"cr"`
+}
+
+// Theme holds colors for what isn't a syntax token, as "#rrggbb" or a color name
+type Theme struct {
+	Whitespace         string `json:"whitespace"`
+	TrailingWhitespace string `json:"trailingWhitespace"`
+	IndentGuide        string `json:"indentGuide"`
+	ActiveIndentGuide  string `json:"activeIndentGuide"`
+	CurrentLine        string `json:"currentLine"`
+	DiagnosticError    string `json:"diagnosticError"`
+	DiagnosticWarning  string `json:"diagnosticWarning"`
+	DiagnosticInfo     string `json:"diagnosticInfo"`
+	DiagnosticHint     string `json:"diagnosticHint"`
+}
+
+var defaultOptions = Options{
+	WhitespaceGlyphs:     WhitespaceGlyphs{Tab: "→", Space: "·", Trailing: "·", CR: "␍"},
+	IndentGuides:         true,
+	IndentGuideGlyph:     "│",
+	HighlightCurrentLine: true,
+	FormatTimeout:        5,
+	JSONIndent:           "    ",
+	LintOnSave:           true,
+	AutoComplete:         3,
+	Theme: Theme{
+		Whitespace:         "#3c4655",
+		TrailingWhitespace: "#782828",
+		IndentGuide:        "#2a3242",
+		ActiveIndentGuide:  "#5a6a85",
+		CurrentLine:        "#1c2536",
+		DiagnosticError:    "#f05a5a",
+		DiagnosticWarning:  "#e6be50",
+		DiagnosticInfo:     "#96b4e6",
+		DiagnosticHint:     "#828ca0",
+	},
+}
+
+// editorBackground is the background behind the buffer text
+var editorBackground = tcell.NewRGBColor(15, 20, 30)
+
+var options, optionsError = loadOptions(configDir())
+
+// forLanguage looks up a format's entry in a per-language option, whose
+// keys can be any of a language's names or extensions
+func forLanguage[V any](m map[string]V, format FileFormat) (V, bool) {
+	for name, value := range m {
+		if f, ok := grammars.lookup(name); ok && f == format {
+			return value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+func loadOptions(dir string) (Options, error) {
+	opts := defaultOptions
+	if dir == "" {
+		return opts, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return opts, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &opts)
+	}
+	if err != nil {
+		return defaultOptions, fmt.Errorf("config.json: %v", err)
+	}
+	return opts, nil
+}
+
+// themeColor parses a theme color, falling back to def when it's unset or invalid
+func themeColor(value string, def tcell.Color) tcell.Color {
+	if c := tcell.GetColor(value); value != "" && c != tcell.ColorDefault {
+		return c
+	}
+	return def
+}
+
+// glyph returns the first character of a configured glyph, or def
+func glyph(value string, def rune) rune {
+	if r, _ := utf8.DecodeRuneInString(value); r != utf8.RuneError {
+		return r
+	}
+	return def
+}
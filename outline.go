@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// ----------------- OUTLINE -----------------
+
+// symbol is a declaration in the buffer: a function, a type, a class...
+type symbol struct {
+	name      string
+	kind      string
+	line, col int // where its name is
+	endLine   int // the last line of its body
+	depth     int // how many symbols it's nested in
+}
+
+// symbolCache holds the buffer's symbols and the text they were found in
+type symbolCache struct {
+	lines   []string
+	format  FileFormat
+	symbols []symbol
+}
+
+// symbols returns the buffer's symbols in order, finding them again only
+// once the text has changed: Go's with go/parser, other languages' with
+// their grammar's symbol patterns
+func (e *Editor) symbols() []symbol {
+	if c := e.outline; c != nil && c.format == e.format && !linesChanged(c.lines, e.lines) {
+		return c.symbols
+	}
+	var symbols []symbol
+	if e.format == Go {
+		symbols = goSymbols(e.lines)
+	} else if g := grammars.grammar(e.format); g != nil {
+		symbols = grammarSymbols(g, e.lines)
+	}
+	nestSymbols(symbols)
+	e.outline = &symbolCache{lines: append([]string(nil), e.lines...), format: e.format, symbols: symbols}
+	return symbols
+}
+
+// goSymbols lists a Go file's top-level declarations, naming methods after
+// their receiver's type. A file that doesn't parse still gives the
+// declarations before the error.
+func goSymbols(lines []string) []symbol {
+	fset := token.NewFileSet()
+	file, _ := parser.ParseFile(fset, "", strings.Join(lines, "\n"), parser.SkipObjectResolution)
+	if file == nil {
+		return nil
+	}
+	var symbols []symbol
+	add := func(name *ast.Ident, prefix, kind string, node ast.Node) {
+		if name == nil || name.Name == "_" {
+			return
+		}
+		pos := fset.Position(name.Pos())
+		symbols = append(symbols, symbol{
+			name:    prefix + name.Name,
+			kind:    kind,
+			line:    pos.Line - 1,
+			col:     pos.Column - 1,
+			endLine: fset.Position(node.End()).Line - 1,
+		})
+	}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil || len(d.Recv.List) == 0 {
+				add(d.Name, "", "func", d)
+			} else if recv := receiverType(d.Recv.List[0].Type); recv != "" {
+				add(d.Name, recv+".", "method", d)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					kind := "type"
+					switch s.Type.(type) {
+					case *ast.StructType:
+						kind = "struct"
+					case *ast.InterfaceType:
+						kind = "interface"
+					}
+					add(s.Name, "", kind, s)
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						add(name, "", d.Tok.String(), s)
+					}
+				}
+			}
+		}
+	}
+	return symbols
+}
+
+// receiverType names a method receiver's type, without a pointer or type
+// parameters
+func receiverType(expr ast.Expr) string {
+	for {
+		switch t := expr.(type) {
+		case *ast.StarExpr:
+			expr = t.X
+		case *ast.ParenExpr:
+			expr = t.X
+		case *ast.IndexExpr:
+			expr = t.X
+		case *ast.IndexListExpr:
+			expr = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// grammarSymbols finds symbols with a grammar's symbol patterns, the first
+// matching pattern on each line giving its symbol. Names that are keywords
+// are left out, so a method pattern needn't exclude if and while.
+func grammarSymbols(g *Grammar, lines []string) []symbol {
+	if len(g.Symbols) == 0 {
+		return nil
+	}
+	keywords := map[string]bool{}
+	for _, keyword := range g.Keywords {
+		keywords[keyword] = true
+	}
+	var symbols []symbol
+	for i, line := range lines {
+		for _, rule := range g.Symbols {
+			m := rule.re.FindStringSubmatchIndex(line)
+			if m == nil {
+				continue
+			}
+			name, col := "", 0
+			for group := 1; group <= rule.re.NumSubexp(); group++ {
+				if m[2*group] >= 0 {
+					name, col = line[m[2*group]:m[2*group+1]], m[2*group]
+					break
+				}
+			}
+			word := name
+			if g.IgnoreCase {
+				word = strings.ToLower(name)
+			}
+			if name == "" || keywords[word] {
+				continue
+			}
+			symbols = append(symbols, symbol{name: name, kind: rule.Kind, line: i, col: col, endLine: blockEnd(lines, i)})
+			break
+		}
+	}
+	return symbols
+}
+
+// blockEnd finds the last line of the block a declaration on line i opens,
+// going by indentation: the block runs until a line indented no deeper,
+// which still belongs to it when it only closes brackets or says end
+func blockEnd(lines []string, i int) int {
+	indent := visualColForByteCol(lines[i], len(detectIndentation(lines[i])))
+	end := i
+	for j := i + 1; j < len(lines); j++ {
+		trimmed := strings.TrimSpace(lines[j])
+		if trimmed == "" {
+			continue
+		}
+		if visualColForByteCol(lines[j], len(detectIndentation(lines[j]))) > indent {
+			end = j
+			continue
+		}
+		switch {
+		case j == end+1 && trimmed[0] == '{':
+			// A brace on the line after the declaration opens its body
+			end = j
+			continue
+		case strings.IndexByte("})]", trimmed[0]) >= 0 || trimmed == "end":
+			return j
+		}
+		break
+	}
+	return end
+}
+
+// nestSymbols works out how deeply each symbol is nested in the ones
+// before it
+func nestSymbols(symbols []symbol) {
+	var open []int
+	for i := range symbols {
+		for len(open) > 0 && symbols[open[len(open)-1]].endLine < symbols[i].line {
+			open = open[:len(open)-1]
+		}
+		symbols[i].depth = len(open)
+		open = append(open, i)
+	}
+}
+
+// symbolAt returns the innermost symbol whose body holds a line, and the
+// names of it and the symbols it's in, such as Class.method
+func (e *Editor) symbolAt(line int) (int, string) {
+	found := -1
+	var path []string
+	for i, s := range e.symbols() {
+		if s.line > line {
+			break
+		}
+		if line <= s.endLine {
+			found = i
+			path = append(path[:min(s.depth, len(path))], s.name)
+		}
+	}
+	return found, strings.Join(path, ".")
+}
+
+// outlineCommand lists the buffer's symbols in a panel that typing filters,
+// starting at the one the cursor is in
+func (e *Editor) outlineCommand() {
+	symbols := e.symbols()
+	if len(symbols) == 0 {
+		e.message = "No symbols found"
+		return
+	}
+	p := &panel{title: "Outline", filterable: true}
+	for _, s := range symbols {
+		text := fmt.Sprintf("%5d  %s%-9s %s", s.line+1, strings.Repeat("  ", s.depth), s.kind, s.name)
+		p.items = append(p.items, panelItem{text: text, file: e.filename, line: s.line, col: s.col, match: s.name, inBuffer: true})
+	}
+	if i, _ := e.symbolAt(e.cursorLine); i >= 0 {
+		p.selected = i
+	}
+	e.showPanel(p)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- PANEL -----------------
+
+// panelHeight is how many rows an open panel takes, its title included
+const panelHeight = 10
+
+// panelItem is a line in a panel; items with a file, or in the buffer
+// itself, jump there
+type panelItem struct {
+	text      string
+	kind      string // a severity, pass, skip or heading; picks the color
+	file      string
+	line, col int
+	match     string // what filtering matches, when not the text
+	inBuffer  bool   // the position is in the buffer, which may be unnamed
+}
+
+// panel is a list shown below the buffer, such as test results. Typing in
+// a filterable panel narrows its items down by fuzzy match.
+type panel struct {
+	title      string
+	items      []panelItem
+	selected   int
+	scroll     int
+	filterable bool
+	query      string
+	all        []panelItem     // every item, while a query filters them
+	confirm    func(e *Editor) // run by y, for a panel previewing a change
+}
+
+// showPanel opens p below the buffer and gives it the keyboard
+func (e *Editor) showPanel(p *panel) {
+	e.panel = p
+	e.panelVisible = true
+	e.mode = PanelMode
+	e.adjustScroll()
+}
+
+// panelRows is how many screen rows the panel takes, 0 when it's hidden
+func (e *Editor) panelRows() int {
+	if e.panel == nil || !e.panelVisible || e.screen == nil {
+		return 0
+	}
+	_, h := e.screen.Size()
+	return min(panelHeight, (h-5)/2)
+}
+
+// panelCommand handles "panel", which shows and focuses the last panel,
+// and "panel close"
+func (e *Editor) panelCommand(args []string) {
+	if e.panel == nil {
+		e.message = "No panel to show"
+		return
+	}
+	if len(args) > 0 && args[0] == "close" {
+		e.panelVisible = false
+		return
+	}
+	e.showPanel(e.panel)
+}
+
+func (e *Editor) handlePanel(key *tcell.EventKey) {
+	p := e.panel
+	if e.running != nil && e.running.output == p && e.handleRunKey(key) {
+		return
+	}
+	page := max(e.panelRows()-2, 1)
+	switch key.Key() {
+	case tcell.KeyEsc:
+		e.panelVisible = false
+		e.mode = Interactive
+	case tcell.KeyTab, tcell.KeyF6:
+		e.mode = Interactive
+	case tcell.KeyUp:
+		p.selected--
+	case tcell.KeyDown:
+		p.selected++
+	case tcell.KeyPgUp:
+		p.selected -= page
+	case tcell.KeyPgDn:
+		p.selected += page
+	case tcell.KeyHome:
+		p.selected = 0
+	case tcell.KeyEnd:
+		p.selected = len(p.items) - 1
+	case tcell.KeyRune:
+		if p.confirm != nil && (key.Rune() == 'y' || key.Rune() == 'Y') {
+			confirm := p.confirm
+			p.confirm = nil
+			e.panelVisible = false
+			e.mode = Interactive
+			confirm(e)
+		} else if p.filterable {
+			p.filter(p.query + string(key.Rune()))
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if p.filterable && p.query != "" {
+			_, size := utf8.DecodeLastRuneInString(p.query)
+			p.filter(p.query[:len(p.query)-size])
+		}
+	case tcell.KeyEnter:
+		if p.selected < len(p.items) && (p.items[p.selected].file != "" || p.items[p.selected].inBuffer) {
+			item := p.items[p.selected]
+			if e.jumpTo(item.file, item.line, item.col) {
+				e.mode = Interactive
+			}
+		}
+	}
+	p.selected = min(max(p.selected, 0), max(len(p.items)-1, 0))
+}
+
+// filter shows the items fuzzy matching query, the best matches first
+func (p *panel) filter(query string) {
+	if p.all == nil {
+		p.all = p.items
+	}
+	p.query = query
+	p.selected, p.scroll = 0, 0
+	if query == "" {
+		p.items = p.all
+		return
+	}
+	type ranked struct {
+		item  panelItem
+		score int
+	}
+	var matches []ranked
+	for _, item := range p.all {
+		text := item.match
+		if text == "" {
+			text = item.text
+		}
+		if score, _, ok := fuzzyMatch(query, text); ok {
+			matches = append(matches, ranked{item, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	p.items = make([]panelItem, len(matches))
+	for i, m := range matches {
+		p.items[i] = m.item
+	}
+}
+
+// drawPanel draws the panel in the rows from top
+func (e *Editor) drawPanel(top, rows, w int) {
+	p := e.panel
+	drawLine(e.screen, 0, top, w, '-')
+	title := fmt.Sprintf(" %s (%d) ", p.title, len(p.items))
+	if p.filterable && (p.query != "" || e.mode == PanelMode) {
+		title += "- filter: " + p.query + " "
+	}
+	switch {
+	case e.mode == PanelMode && e.running != nil && e.running.output == p:
+		title += "- input: " + e.running.input + "_ Ctrl-C: kill, Ctrl-D: end input, Tab: back to editor "
+	case e.mode == PanelMode && p.confirm != nil:
+		title += "- y: apply, Enter: go to, Esc: cancel "
+	case e.mode == PanelMode:
+		title += "- Enter: go to, Tab: back to editor, Esc: close "
+	}
+	drawString(e.screen, 1, top, title)
+
+	visible := rows - 1
+	if p.selected < p.scroll {
+		p.scroll = p.selected
+	}
+	if p.selected >= p.scroll+visible {
+		p.scroll = p.selected - visible + 1
+	}
+	bg := editorBackground
+	for i := 0; i < visible && p.scroll+i < len(p.items); i++ {
+		idx := p.scroll + i
+		item := p.items[idx]
+		style := tcell.StyleDefault.Background(bg).Foreground(panelColor(item.kind))
+		if idx == p.selected && e.mode == PanelMode {
+			style = style.Background(tcell.NewRGBColor(50, 60, 85))
+		}
+		x := 0
+		for _, r := range item.text {
+			if x >= w {
+				break
+			}
+			e.screen.SetContent(x, top+1+i, r, nil, style)
+			x++
+		}
+		for ; x < w && idx == p.selected && e.mode == PanelMode; x++ {
+			e.screen.SetContent(x, top+1+i, ' ', nil, style)
+		}
+	}
+}
+
+func panelColor(kind string) tcell.Color {
+	switch kind {
+	case "error", "warning", "info", "hint":
+		return severityColor(kind)
+	case "pass":
+		return tcell.NewRGBColor(110, 200, 120)
+	case "skip":
+		return tcell.NewRGBColor(130, 140, 160)
+	case "heading":
+		return tcell.NewRGBColor(150, 180, 230)
+	}
+	return tcell.NewRGBColor(200, 200, 200)
+}
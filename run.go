@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- RUN -----------------
+
+// defaultRunCommands are the shell commands running a file in each
+// language, by grammar name; "{file}" is replaced with the file's name
+var defaultRunCommands = map[string]string{
+	"Go":         "go run .",
+	"Python":     "python3 {file}",
+	"JavaScript": "node {file}",
+	"Shell":      "bash {file}",
+	"PHP":        "php {file}",
+	"SQU1D++":    "squ1d++ {file}",
+}
+
+// runErrorFormats locate the frames of tracebacks and the errors that
+// programs report as they run, which build output doesn't have
+var runErrorFormats = []ErrorFormat{
+	{
+		Name:    "go panic",
+		Pattern: `^\s+(?P<file>\S+\.go):(?P<line>\d+)(?: \+0x[0-9a-f]+)?$`,
+	},
+	{
+		Name:    "node",
+		Pattern: `^\s+at (?:.*\()?(?:file://)?(?P<file>[^\s():]+):(?P<line>\d+):(?P<col>\d+)\)?$`,
+	},
+	{
+		Name:    "node header",
+		Pattern: `^(?P<file>/\S+\.[cm]?[jt]s):(?P<line>\d+)$`,
+	},
+	{
+		Name:    "php",
+		Pattern: `^(?:PHP )?(?P<severity>Fatal error|Parse error|Warning|Notice|Deprecated):\s+(?P<message>.*) in (?P<file>\S+) on line (?P<line>\d+)$`,
+	},
+	{
+		Name:    "bash",
+		Pattern: `^(?P<file>[^:\s]+): line (?P<line>\d+): (?P<message>.*)$`,
+	},
+}
+
+// runInputLines is how many typed lines can wait for a program that isn't
+// reading its input
+const runInputLines = 64
+
+// maxRunLines bounds the output kept from a run; older lines are dropped
+const maxRunLines = 10000
+
+// ansiEscape matches the terminal escape sequences programs color output with
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// runProcess is a program the run command started
+type runProcess struct {
+	cmd     *exec.Cmd
+	stdin   chan<- string // lines for its input; nil once Ctrl-D closed it
+	output  *panel
+	input   string // typed in the panel, sent on Enter
+	partial bool   // the last line of output hasn't ended yet
+	dir     string
+	formats []compiledErrorFormat
+	started time.Time
+	killed  bool
+}
+
+// runCommand runs the buffer's file with its language's runner, streaming
+// what it prints into the panel, where typing goes to its input
+func (e *Editor) runCommand(args []string) {
+	if e.running != nil {
+		e.message = "A program is already running; Ctrl-C stops it"
+		return
+	}
+	if e.filename == "" {
+		e.message = "Save the buffer to a file before running it"
+		return
+	}
+	if e.dirty {
+		e.message = "Save changes before running " + relativePath(e.filename)
+		return
+	}
+	command, ok := forLanguage(options.RunCommands, e.format)
+	if !ok {
+		command = defaultRunCommands[e.format.String()]
+	}
+	if command == "" {
+		e.message = "No runner for " + e.format.String()
+		return
+	}
+	file, err := filepath.Abs(e.filename)
+	if err != nil {
+		e.message = "Run: " + err.Error()
+		return
+	}
+	dir := filepath.Dir(file)
+	command = strings.ReplaceAll(command, "{file}", shellQuote(filepath.Base(file)))
+	for _, arg := range args {
+		command += " " + shellQuote(arg)
+	}
+	config, err := loadProjectConfig(workspaceRoot(e.filename))
+	var formats []compiledErrorFormat
+	if err == nil {
+		formats, err = compileErrorFormats(append(append([]ErrorFormat(nil), config.ErrorFormats...), runErrorFormats...))
+	}
+	if err != nil {
+		e.message = "Run: " + err.Error()
+		return
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = dir
+	setProcessGroup(cmd)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		e.message = "Run: " + err.Error()
+		return
+	}
+	cmd.Stdout, cmd.Stderr = writer, writer
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	writer.Close()
+	if err != nil {
+		reader.Close()
+		e.message = "Run: " + err.Error()
+		return
+	}
+
+	inputs := make(chan string, runInputLines)
+	r := &runProcess{cmd: cmd, stdin: inputs, output: &panel{title: "Run: " + command}, dir: dir, formats: formats, started: time.Now()}
+	e.running = r
+	e.showPanel(r.output)
+	e.message = "Running " + command
+
+	screen := e.screen
+	// Input is written from here, as a program that isn't reading would
+	// block the editor
+	go func() {
+		defer stdin.Close()
+		for line := range inputs {
+			if _, err := io.WriteString(stdin, line); err != nil {
+				postFuncEvent(screen, func(e *Editor) { e.message = "Run: " + err.Error() })
+				// Drop what's typed until Ctrl-D or the program ends
+				for range inputs {
+				}
+				return
+			}
+		}
+	}()
+	go func() {
+		defer reader.Close()
+		buf := make([]byte, 4096)
+		var carry []byte
+		for {
+			n, err := reader.Read(buf)
+			chunk := append(carry, buf[:n]...)
+			// Hold back a character split between reads
+			cut := len(chunk)
+			for i := len(chunk) - 1; i >= 0 && i >= len(chunk)-utf8.UTFMax; i-- {
+				if utf8.RuneStart(chunk[i]) {
+					if !utf8.FullRune(chunk[i:]) {
+						cut = i
+					}
+					break
+				}
+			}
+			carry = append([]byte(nil), chunk[cut:]...)
+			if text := string(chunk[:cut]); text != "" {
+				postFuncEvent(screen, func(e *Editor) { e.runOutput(r, text) })
+			}
+			if err != nil {
+				break
+			}
+		}
+		err := cmd.Wait()
+		postFuncEvent(screen, func(e *Editor) { e.runFinished(r, err) })
+	}()
+}
+
+// runOutput adds what the program printed to its panel, following the end
+// of the output unless a line further up is selected
+func (e *Editor) runOutput(r *runProcess, text string) {
+	p := r.output
+	follow := p.selected >= len(p.items)-1
+	for i, line := range strings.Split(text, "\n") {
+		if i == 0 && r.partial && len(p.items) > 0 {
+			p.items[len(p.items)-1].text += cleanRunOutput(line)
+		} else {
+			p.items = append(p.items, panelItem{text: cleanRunOutput(line)})
+		}
+		r.locate(&p.items[len(p.items)-1])
+	}
+	// The text ends a line when it ends with a newline, leaving an empty item
+	r.partial = !strings.HasSuffix(text, "\n")
+	if !r.partial {
+		p.items = p.items[:len(p.items)-1]
+	}
+	if drop := len(p.items) - maxRunLines; drop > 0 {
+		p.items = append([]panelItem(nil), p.items[drop:]...)
+		p.selected, p.scroll = max(p.selected-drop, 0), max(p.scroll-drop, 0)
+	}
+	if follow {
+		p.selected = max(len(p.items)-1, 0)
+	}
+}
+
+// cleanRunOutput strips carriage returns and colors from a line of output
+// and expands its tabs, which the panel doesn't draw
+func cleanRunOutput(line string) string {
+	line = ansiEscape.ReplaceAllString(strings.TrimSuffix(line, "\r"), "")
+	return strings.ReplaceAll(line, "\t", "    ")
+}
+
+// locate makes a line of output naming a place in an existing file, such
+// as a traceback's frame, jump there
+func (r *runProcess) locate(item *panelItem) {
+	item.file, item.kind = "", ""
+	diags := parseErrors(item.text, r.dir, r.formats)
+	if len(diags) == 0 {
+		return
+	}
+	d := diags[0]
+	if info, err := os.Stat(d.File); err != nil || info.IsDir() {
+		return
+	}
+	item.file, item.line, item.col, item.kind = d.File, d.Line, d.Col, "error"
+}
+
+// runFinished reports how the program ended and puts the places its output
+// points at in the error list
+func (e *Editor) runFinished(r *runProcess, err error) {
+	if e.running == r {
+		e.running = nil
+	}
+	if r.stdin != nil {
+		close(r.stdin)
+		r.stdin = nil
+	}
+	status := fmt.Sprintf("finished in %s", time.Since(r.started).Round(time.Millisecond))
+	switch {
+	case r.killed:
+		status = "killed"
+	case err != nil:
+		status = err.Error()
+		if exit, ok := err.(*exec.ExitError); ok {
+			status = fmt.Sprintf("exited with status %d", exit.ExitCode())
+		}
+	}
+	p := r.output
+	follow := p.selected >= len(p.items)-1
+	p.items = append(p.items, panelItem{text: "[" + status + "]", kind: "heading"})
+	if follow {
+		p.selected = len(p.items) - 1
+	}
+
+	var output []string
+	for _, item := range p.items {
+		output = append(output, item.text)
+	}
+	var diags []Diagnostic
+	for _, d := range parseErrors(strings.Join(output, "\n"), r.dir, r.formats) {
+		if info, err := os.Stat(d.File); err == nil && !info.IsDir() {
+			diags = append(diags, d)
+		}
+	}
+	e.message = "Program " + status
+	if len(diags) > 0 {
+		e.setErrorList(diags)
+		e.message += fmt.Sprintf("; %d location(s) in its output, F8 goes to them", len(diags))
+	}
+}
+
+// stopRun kills the running program and whatever it started
+func (e *Editor) stopRun() {
+	r := e.running
+	if r == nil {
+		e.message = "No program is running"
+		return
+	}
+	r.killed = true
+	if err := killProcessGroup(r.cmd); err != nil {
+		e.message = "Run: " + err.Error()
+		return
+	}
+	e.message = "Stopping the program"
+}
+
+// handleRunKey handles the keys that go to the running program while its
+// panel has the keyboard: typing and Enter send a line to its input,
+// Ctrl-D closes the input and Ctrl-C kills it. It reports whether it used
+// the key.
+func (e *Editor) handleRunKey(key *tcell.EventKey) bool {
+	r := e.running
+	switch key.Key() {
+	case tcell.KeyCtrlC:
+		e.stopRun()
+	case tcell.KeyCtrlD:
+		if r.stdin != nil {
+			close(r.stdin)
+			r.stdin = nil
+		}
+		e.message = "Closed the program's input"
+	case tcell.KeyRune:
+		r.input += string(key.Rune())
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		_, size := utf8.DecodeLastRuneInString(r.input)
+		r.input = r.input[:len(r.input)-size]
+	case tcell.KeyEnter:
+		if r.stdin == nil {
+			e.message = "The program's input is closed"
+			return true
+		}
+		line := r.input + "\n"
+		select {
+		case r.stdin <- line:
+		default:
+			e.message = "The program isn't reading its input"
+			return true
+		}
+		r.input = ""
+		// Show what was typed, as a terminal would echo it
+		e.runOutput(r, line)
+	default:
+		return false
+	}
+	return true
+}
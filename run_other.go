@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup does nothing where process groups aren't available
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd, though not what it started
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- SNIPPETS -----------------
+
+// snippet is a template typed by its trigger word and Tab. Bodies use
+// $1, ${1:placeholder} and ${1|one,two|} for tab stops, visited in order
+// with $0 last; a number used twice mirrors what's typed into the first.
+// $NAME and ${NAME:default} insert variables such as TM_FILENAME and
+// CURRENT_DATE. Tabs in a body become the language's indent unit.
+type snippet struct {
+	Prefix      stringList `json:"prefix"`
+	Body        stringList `json:"body"`
+	Description string     `json:"description"`
+}
+
+// stringList decodes from a string or an array of strings
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// defaultSnippets are available without any snippet files, by grammar
+// name and then snippet name
+var defaultSnippets = map[string]map[string]snippet{
+	"Go": {
+		"if err": {
+			Prefix: stringList{"iferr"},
+			Body:   stringList{"if err != nil {", "\treturn ${1:err}", "}", "$0"},
+		},
+		"table test": {
+			Prefix: stringList{"tt"},
+			Body: stringList{
+				"func Test${1:Name}(t *testing.T) {",
+				"\ttests := []struct {",
+				"\t\tname string",
+				"\t\t$2",
+				"\t}{",
+				"\t\t{name: \"${3:case}\"},",
+				"\t}",
+				"\tfor _, tt := range tests {",
+				"\t\tt.Run(tt.name, func(t *testing.T) {",
+				"\t\t\t$0",
+				"\t\t})",
+				"\t}",
+				"}",
+			},
+		},
+		"for loop": {
+			Prefix: stringList{"fori"},
+			Body:   stringList{"for ${1:i} := 0; $1 < ${2:n}; $1++ {", "\t$0", "}"},
+		},
+		"function": {
+			Prefix: stringList{"fn"},
+			Body:   stringList{"func ${1:name}($2) $3{", "\t$0", "}"},
+		},
+	},
+	"HTML": {
+		"document": {
+			Prefix: stringList{"html5", "!"},
+			Body: stringList{
+				"<!DOCTYPE html>",
+				"<html lang=\"${1:en}\">",
+				"<head>",
+				"\t<meta charset=\"utf-8\">",
+				"\t<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">",
+				"\t<title>${2:$TM_FILENAME_BASE}</title>",
+				"</head>",
+				"<body>",
+				"\t$0",
+				"</body>",
+				"</html>",
+			},
+		},
+	},
+	"Python": {
+		"main": {
+			Prefix: stringList{"ifmain"},
+			Body:   stringList{"if __name__ == \"__main__\":", "\t${1:main()}"},
+		},
+	},
+}
+
+// snippetSets caches each format's snippets, by trigger word
+var snippetSets = map[FileFormat]map[string]snippet{}
+
+// snippetsFor returns the snippets for a format, loading them the first
+// time: the defaults, then the config directory's snippets/<language>.json
+// files, whose snippets replace defaults of the same name
+func snippetsFor(format FileFormat) (map[string]snippet, error) {
+	if set, ok := snippetSets[format]; ok {
+		return set, nil
+	}
+	byName := map[string]snippet{}
+	if g := grammars.grammar(format); g != nil {
+		for name, s := range defaultSnippets[g.Name] {
+			byName[name] = s
+		}
+	}
+	var err error
+	if dir := configDir(); dir != "" {
+		files, _ := filepath.Glob(filepath.Join(dir, "snippets", "*.json"))
+		sort.Strings(files)
+		for _, file := range files {
+			language := strings.TrimSuffix(filepath.Base(file), ".json")
+			if f, ok := grammars.lookup(language); !ok || f != format {
+				continue
+			}
+			var user map[string]snippet
+			data, readErr := os.ReadFile(file)
+			if readErr == nil {
+				readErr = json.Unmarshal(data, &user)
+			}
+			if readErr != nil {
+				err = fmt.Errorf("%s: %v", filepath.Base(file), readErr)
+				continue
+			}
+			for name, s := range user {
+				byName[name] = s
+			}
+		}
+	}
+
+	set := map[string]snippet{}
+	for _, s := range byName {
+		for _, prefix := range s.Prefix {
+			set[prefix] = s
+		}
+	}
+	snippetSets[format] = set
+	return set, err
+}
+
+// snippetCompletions offers the snippets' trigger words
+type snippetCompletions struct{}
+
+func (snippetCompletions) completions(e *Editor, prefix string) []completionItem {
+	set, _ := snippetsFor(e.format)
+	var items []completionItem
+	for trigger := range set {
+		items = append(items, completionItem{text: trigger, kind: "snippet"})
+	}
+	return items
+}
+
+// ----------------- SNIPPET PARSING -----------------
+
+// snippetSegment is a piece of a snippet body: literal text, a tab stop or
+// a variable, the last two with an optional placeholder or default
+type snippetSegment struct {
+	text     string
+	tabstop  int // -1 unless the segment is a tab stop
+	variable string
+	children []snippetSegment
+}
+
+func parseSnippet(body string) []snippetSegment {
+	pos := 0
+	return parseSnippetSegments(body, &pos, false)
+}
+
+// parseSnippetSegments parses from pos up to the end of body, or up to the
+// '}' closing a placeholder when nested is set
+func parseSnippetSegments(body string, pos *int, nested bool) []snippetSegment {
+	var segs []snippetSegment
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			segs = append(segs, snippetSegment{text: text.String(), tabstop: -1})
+			text.Reset()
+		}
+	}
+	for *pos < len(body) {
+		c := body[*pos]
+		switch {
+		case c == '\\' && *pos+1 < len(body) && strings.IndexByte(`$}\`, body[*pos+1]) >= 0:
+			text.WriteByte(body[*pos+1])
+			*pos += 2
+		case c == '}' && nested:
+			flush()
+			return segs
+		case c == '$':
+			if seg, ok := parseSnippetField(body, pos); ok {
+				flush()
+				segs = append(segs, seg)
+			} else {
+				text.WriteByte('$')
+				*pos++
+			}
+		default:
+			text.WriteByte(c)
+			*pos++
+		}
+	}
+	flush()
+	return segs
+}
+
+// parseSnippetField parses a tab stop or variable at pos, which is at a '$'
+func parseSnippetField(body string, pos *int) (snippetSegment, bool) {
+	i := *pos + 1
+	braced := i < len(body) && body[i] == '{'
+	if braced {
+		i++
+	}
+	start := i
+	for i < len(body) && body[i] >= '0' && body[i] <= '9' {
+		i++
+	}
+	seg := snippetSegment{tabstop: -1}
+	if i > start {
+		seg.tabstop, _ = strconv.Atoi(body[start:i])
+	} else {
+		for i < len(body) && body[i] < 0x80 && isWordByte(body[i]) {
+			i++
+		}
+		if i == start {
+			return seg, false
+		}
+		seg.variable = body[start:i]
+	}
+	if !braced {
+		*pos = i
+		return seg, true
+	}
+
+	switch {
+	case i < len(body) && body[i] == '}':
+		i++
+	case i < len(body) && body[i] == ':':
+		i++
+		seg.children = parseSnippetSegments(body, &i, true)
+		if i >= len(body) {
+			return seg, false
+		}
+		i++
+	case i < len(body) && body[i] == '|' && seg.tabstop >= 0:
+		// A choice: the first option is the placeholder
+		end := strings.Index(body[i:], "|}")
+		if end < 0 {
+			return seg, false
+		}
+		choices := strings.Split(body[i+1:i+end], ",")
+		seg.children = []snippetSegment{{text: choices[0], tabstop: -1}}
+		i += end + 2
+	default:
+		return seg, false
+	}
+	*pos = i
+	return seg, true
+}
+
+// ----------------- SNIPPET EXPANSION -----------------
+
+// snippetRange is where a tab stop's text is in the buffer
+type snippetRange struct {
+	line, col, len int
+}
+
+// snippetStop is a tab stop: the cursor goes to the first range and the
+// others mirror it
+type snippetStop struct {
+	number int
+	ranges []*snippetRange
+}
+
+// tabStops are an expanded snippet's tab stops while they're being filled
+// in
+type tabStops struct {
+	stops     []snippetStop // in the order Tab visits them, $0 last
+	current   int
+	fresh     bool // the current stop still holds its placeholder, which typing replaces
+	lineLen   int  // length of the current stop's line after the last key
+	lineCount int
+}
+
+// snippetVariable returns a variable's value and whether it's known
+func (e *Editor) snippetVariable(name string) (string, bool) {
+	now := time.Now()
+	path, _ := filepath.Abs(e.filename)
+	base := filepath.Base(e.filename)
+	switch name {
+	case "TM_FILENAME":
+		return base, e.filename != ""
+	case "TM_FILENAME_BASE":
+		return strings.TrimSuffix(base, filepath.Ext(base)), e.filename != ""
+	case "TM_FILEPATH":
+		return path, e.filename != ""
+	case "TM_DIRECTORY":
+		return filepath.Dir(path), e.filename != ""
+	case "TM_LINE_NUMBER":
+		return strconv.Itoa(e.cursorLine + 1), true
+	case "TM_SELECTED_TEXT", "SELECTION":
+		// There's no selection, so the selection is what was last cut or copied
+		return e.clipboard, e.clipboard != ""
+	case "CURRENT_YEAR":
+		return now.Format("2006"), true
+	case "CURRENT_YEAR_SHORT":
+		return now.Format("06"), true
+	case "CURRENT_MONTH":
+		return now.Format("01"), true
+	case "CURRENT_MONTH_NAME":
+		return now.Format("January"), true
+	case "CURRENT_DATE":
+		return now.Format("02"), true
+	case "CURRENT_DAY_NAME":
+		return now.Format("Monday"), true
+	case "CURRENT_HOUR":
+		return now.Format("15"), true
+	case "CURRENT_MINUTE":
+		return now.Format("04"), true
+	case "CURRENT_SECOND":
+		return now.Format("05"), true
+	}
+	return "", false
+}
+
+// plainSnippetText is the text of segments with every field at its
+// placeholder, for placeholders holding fields of their own
+func (e *Editor) plainSnippetText(segs []snippetSegment) string {
+	var b strings.Builder
+	for _, seg := range segs {
+		switch {
+		case seg.tabstop >= 0:
+			b.WriteString(e.plainSnippetText(seg.children))
+		case seg.variable != "":
+			if value, ok := e.snippetVariable(seg.variable); ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString(e.plainSnippetText(seg.children))
+			}
+		default:
+			b.WriteString(seg.text)
+		}
+	}
+	return b.String()
+}
+
+// renderSnippet expands a snippet body into text, with each line after the
+// first indented by indent, and finds where each tab stop's text starts and
+// ends in it
+func (e *Editor) renderSnippet(segs []snippetSegment, indent string) (string, map[int][][2]int) {
+	unit := e.indentUnit()
+	placeholders := map[int]string{}
+	for _, seg := range segs {
+		if _, ok := placeholders[seg.tabstop]; seg.tabstop >= 0 && (!ok || placeholders[seg.tabstop] == "") {
+			placeholders[seg.tabstop] = e.plainSnippetText(seg.children)
+		}
+	}
+
+	var b strings.Builder
+	emit := func(s string) {
+		s = strings.ReplaceAll(s, "\t", unit)
+		b.WriteString(strings.ReplaceAll(s, "\n", "\n"+indent))
+	}
+	stops := map[int][][2]int{}
+	for _, seg := range segs {
+		switch {
+		case seg.tabstop >= 0:
+			start := b.Len()
+			emit(placeholders[seg.tabstop])
+			stops[seg.tabstop] = append(stops[seg.tabstop], [2]int{start, b.Len()})
+		case seg.variable != "":
+			emit(e.plainSnippetText([]snippetSegment{seg}))
+		default:
+			emit(seg.text)
+		}
+	}
+	return b.String(), stops
+}
+
+// expandSnippet replaces the trigger word before the cursor with its
+// snippet and starts on its tab stops, reporting whether there was one
+func (e *Editor) expandSnippet() bool {
+	start, word := e.wordBeforeCursor()
+	if word == "" {
+		// Triggers can be punctuation, like HTML's "!"
+		line := e.lines[e.cursorLine]
+		start = strings.LastIndexAny(line[:e.cursorCol], " \t") + 1
+		word = line[start:e.cursorCol]
+	}
+	set, err := snippetsFor(e.format)
+	if err != nil {
+		e.message = "Snippets: " + err.Error()
+	}
+	s, ok := set[word]
+	if !ok || word == "" {
+		return false
+	}
+	e.insertSnippet(s, start)
+	return true
+}
+
+// insertSnippet puts a snippet in place of the text from start to the
+// cursor. A line holding only the trigger takes the indent smart
+// indentation gives it; the snippet's lines all share the line's indent.
+func (e *Editor) insertSnippet(s snippet, start int) {
+	e.recordUndo(undoStep)
+	e.completion = nil
+	lineIdx := e.cursorLine
+	line := e.lines[lineIdx]
+	before, after := line[:start], line[e.cursorCol:]
+	indent := detectIndentation(line)
+	if strings.TrimSpace(before) == "" && lineIdx > 0 {
+		indent = e.getSmartIndentation(lineIdx)
+		before = indent
+	}
+
+	text, offsets := e.renderSnippet(parseSnippet(strings.Join(s.Body, "\n")), indent)
+	inserted := strings.Split(before+text+after, "\n")
+	e.lines = append(e.lines[:lineIdx], append(inserted, e.lines[lineIdx+1:]...)...)
+	e.insertLineMeta(lineIdx+1, len(inserted)-1)
+	e.updateLineRange(lineIdx, lineIdx+len(inserted))
+	e.dirty = true
+
+	// Offsets in the text become buffer positions
+	position := func(offset int) (int, int) {
+		head := before + text[:offset]
+		nl := strings.LastIndexByte(head, '\n')
+		return lineIdx + strings.Count(head, "\n"), len(head) - nl - 1
+	}
+	numbers := make([]int, 0, len(offsets))
+	for n := range offsets {
+		if n != 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	numbers = append(numbers, 0)
+	if _, ok := offsets[0]; !ok {
+		offsets[0] = [][2]int{{len(text), len(text)}}
+	}
+	stops := &tabStops{lineCount: len(e.lines)}
+	for _, n := range numbers {
+		stop := snippetStop{number: n}
+		for _, span := range offsets[n] {
+			l, c := position(span[0])
+			stop.ranges = append(stop.ranges, &snippetRange{line: l, col: c, len: span[1] - span[0]})
+		}
+		stops.stops = append(stops.stops, stop)
+	}
+	e.snippet = stops
+	e.gotoSnippetStop(0)
+}
+
+// gotoSnippetStop moves to a tab stop, ending the session at $0
+func (e *Editor) gotoSnippetStop(i int) {
+	s := e.snippet
+	s.current = i
+	r := s.stops[i].ranges[0]
+	e.cursorLine = r.line
+	e.cursorCol = r.col + r.len
+	s.fresh = r.len > 0
+	s.lineLen = len(e.lines[r.line])
+	if s.stops[i].number == 0 {
+		e.snippet = nil
+	}
+	e.updateCursorVisualCol()
+	e.adjustScroll()
+}
+
+// eachSnippetRange calls f on every tab stop range
+func (s *tabStops) eachSnippetRange(f func(r *snippetRange)) {
+	for _, stop := range s.stops {
+		for _, r := range stop.ranges {
+			f(r)
+		}
+	}
+}
+
+// replaceSnippetRange sets a range's text, moving what follows on its line
+func (e *Editor) replaceSnippetRange(r *snippetRange, text string) {
+	line := e.lines[r.line]
+	end := r.col + r.len
+	e.lines[r.line] = line[:r.col] + text + line[end:]
+	delta := len(text) - r.len
+	e.snippet.eachSnippetRange(func(q *snippetRange) {
+		if q != r && q.line == r.line && q.col >= end {
+			q.col += delta
+		}
+	})
+	if e.cursorLine == r.line && e.cursorCol >= end {
+		e.cursorCol += delta
+	}
+	r.len = len(text)
+	e.updateLineTokens(r.line)
+}
+
+// handleSnippetKey handles keys with special meaning while tab stops are
+// being filled in, and reports whether the key was used up
+func (e *Editor) handleSnippetKey(key *tcell.EventKey) bool {
+	s := e.snippet
+	switch key.Key() {
+	case tcell.KeyTab:
+		e.gotoSnippetStop(min(s.current+1, len(s.stops)-1))
+		return true
+	case tcell.KeyBacktab:
+		e.gotoSnippetStop(max(s.current-1, 0))
+		return true
+	case tcell.KeyEsc:
+		e.snippet = nil
+		return true
+	case tcell.KeyRune, tcell.KeyBackspace, tcell.KeyBackspace2, tcell.KeyDelete:
+		stop := s.stops[s.current]
+		r := stop.ranges[0]
+		if !s.fresh || e.cursorLine != r.line || e.cursorCol != r.col+r.len {
+			break
+		}
+		// Typing over a placeholder replaces it
+		s.fresh = false
+		e.recordUndo(undoStep)
+		for _, q := range stop.ranges {
+			e.replaceSnippetRange(q, "")
+		}
+		e.dirty = true
+		s.lineLen = len(e.lines[r.line])
+		e.updateCursorVisualCol()
+		return key.Key() != tcell.KeyRune
+	default:
+		s.fresh = false
+	}
+	return false
+}
+
+// syncSnippet runs after each key while tab stops are being filled in: it
+// copies the current stop's text to its mirrors, and ends the session once
+// the cursor leaves the stop or the key wasn't an edit within it
+func (e *Editor) syncSnippet(key *tcell.EventKey) {
+	s := e.snippet
+	if s == nil {
+		return
+	}
+	switch key.Key() {
+	case tcell.KeyRune, tcell.KeyBackspace, tcell.KeyBackspace2, tcell.KeyDelete,
+		tcell.KeyLeft, tcell.KeyRight, tcell.KeyTab, tcell.KeyBacktab, tcell.KeyCtrlSpace:
+	default:
+		e.snippet = nil
+		return
+	}
+	stop := s.stops[s.current]
+	r := stop.ranges[0]
+	if e.mode != Interactive || len(e.lines) != s.lineCount || r.line >= len(e.lines) {
+		e.snippet = nil
+		return
+	}
+	delta := len(e.lines[r.line]) - s.lineLen
+	if e.cursorLine != r.line || e.cursorCol < r.col || e.cursorCol > r.col+r.len+delta || r.len+delta < 0 {
+		e.snippet = nil
+		return
+	}
+	if delta != 0 {
+		end := r.col + r.len
+		s.eachSnippetRange(func(q *snippetRange) {
+			if q != r && q.line == r.line && q.col >= end {
+				q.col += delta
+			}
+		})
+		r.len += delta
+		text := e.lines[r.line][r.col : r.col+r.len]
+		for _, mirror := range stop.ranges[1:] {
+			e.replaceSnippetRange(mirror, text)
+		}
+		e.updateCursorVisualCol()
+	}
+	s.lineLen = len(e.lines[r.line])
+}
+
+// drawSnippetFields shades the tab stops on a drawn line, the current one
+// brighter
+func (e *Editor) drawSnippetFields(lineIdx, x, y, maxWidth int) {
+	s := e.snippet
+	if s == nil {
+		return
+	}
+	for i, stop := range s.stops {
+		bg := tcell.NewRGBColor(35, 45, 65)
+		if i == s.current {
+			bg = tcell.NewRGBColor(55, 70, 105)
+		}
+		for _, r := range stop.ranges {
+			if r.line != lineIdx || r.len == 0 {
+				continue
+			}
+			line := e.lines[lineIdx]
+			from := visualColForByteCol(line, r.col) - e.horizOffset
+			to := visualColForByteCol(line, min(r.col+r.len, len(line))) - e.horizOffset
+			for vis := max(from, 0); vis < to && vis < maxWidth; vis++ {
+				ch, comb, style, _ := e.screen.GetContent(x+vis, y)
+				e.screen.SetContent(x+vis, y, ch, comb, style.Background(bg))
+			}
+		}
+	}
+}
+
+// snippetsCommand lists the buffer's snippets in the panel
+func (e *Editor) snippetsCommand() {
+	set, err := snippetsFor(e.format)
+	if err != nil {
+		e.message = "Snippets: " + err.Error()
+	}
+	triggers := make([]string, 0, len(set))
+	for trigger := range set {
+		triggers = append(triggers, trigger)
+	}
+	if len(triggers) == 0 {
+		if err == nil {
+			e.message = "No snippets for " + e.format.String()
+		}
+		return
+	}
+	sort.Strings(triggers)
+	p := &panel{title: "Snippets for " + e.format.String() + " - type the word and Tab"}
+	for _, trigger := range triggers {
+		s := set[trigger]
+		text := fmt.Sprintf("%-10s %s", trigger, firstLine(strings.Join(s.Body, "\n")))
+		if s.Description != "" {
+			text = fmt.Sprintf("%-10s %s", trigger, s.Description)
+		}
+		p.items = append(p.items, panelItem{text: text, kind: "heading"})
+	}
+	e.showPanel(p)
+}
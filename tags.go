@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------- CTAGS -----------------
+
+// tag is a definition listed in a tags file
+type tag struct {
+	name    string
+	file    string
+	line    int    // 0-based; -1 when only the pattern says where it is
+	pattern string // the start of the definition's line, for a search address
+	kind    string
+}
+
+// tagFile is a parsed tags file, by tag name
+type tagFile struct {
+	modTime time.Time
+	tags    map[string][]tag
+}
+
+// tagFiles caches parsed tags files by path until they change
+var tagFiles = map[string]*tagFile{}
+
+// findTagsFile looks for a tags file in the file's directory, then the
+// ones above it
+func findTagsFile(filename string) (string, bool) {
+	dir, _ := os.Getwd()
+	if filename != "" {
+		if abs, err := filepath.Abs(filename); err == nil {
+			dir = filepath.Dir(abs)
+		}
+	}
+	for {
+		path := filepath.Join(dir, "tags")
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// loadTags reads a tags file, reusing what was read while it's unchanged
+func loadTags(path string) (*tagFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := tagFiles[path]; ok && f.modTime.Equal(info.ModTime()) {
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &tagFile{modTime: info.ModTime(), tags: map[string][]tag{}}
+	dir := filepath.Dir(path)
+	for _, line := range strings.Split(string(data), "\n") {
+		if t, ok := parseTag(strings.TrimSuffix(line, "\r"), dir); ok {
+			f.tags[t.name] = append(f.tags[t.name], t)
+		}
+	}
+	tagFiles[path] = f
+	return f, nil
+}
+
+// parseTag parses a line of an Exuberant or Universal ctags file: the name,
+// the file and the address, a line number or a /search/ pattern, separated
+// by tabs, then optionally ;" and fields such as the kind and line:N.
+// Files are relative to dir, where the tags file is.
+func parseTag(line, dir string) (tag, bool) {
+	if strings.HasPrefix(line, "!_TAG_") {
+		return tag{}, false
+	}
+	fields := strings.SplitN(line, "\t", 3)
+	if len(fields) < 3 || fields[0] == "" {
+		return tag{}, false
+	}
+	t := tag{name: fields[0], file: fields[1], line: -1}
+	if !filepath.IsAbs(t.file) {
+		t.file = filepath.Join(dir, t.file)
+	}
+
+	address, extra := fields[2], ""
+	if len(address) > 0 && (address[0] == '/' || address[0] == '?') {
+		// The pattern ends at the first unescaped delimiter
+		end := 1
+		for end < len(address) && address[end] != address[0] {
+			if address[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(address) {
+			return tag{}, false
+		}
+		t.pattern = unescapeTagPattern(address[1:end])
+		extra = address[end+1:]
+	} else {
+		number, rest, _ := strings.Cut(address, ";")
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return tag{}, false
+		}
+		t.line, extra = n-1, rest
+	}
+
+	extra = strings.TrimPrefix(strings.TrimPrefix(extra, ";"), "\"")
+	for _, field := range strings.Split(extra, "\t") {
+		key, value, found := strings.Cut(field, ":")
+		switch {
+		case !found && field != "":
+			t.kind = field
+		case key == "kind":
+			t.kind = value
+		case key == "line":
+			if n, err := strconv.Atoi(value); err == nil {
+				t.line = n - 1
+			}
+		}
+	}
+	return t, true
+}
+
+// unescapeTagPattern turns a ctags search pattern, which is anchored and
+// escapes the delimiters and backslashes, back into the text it finds
+func unescapeTagPattern(pattern string) string {
+	pattern = strings.TrimPrefix(pattern, "^")
+	if strings.HasSuffix(pattern, "$") && !strings.HasSuffix(pattern, `\$`) {
+		pattern = pattern[:len(pattern)-1]
+	}
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
+
+// tagLine finds the line a tag's definition is on in lines: the line its
+// pattern matches, the one nearest its line number when it has both.
+// Tags files go stale, so the pattern counts for more than the number.
+func tagLine(t tag, lines []string) int {
+	if t.pattern == "" {
+		return min(max(t.line, 0), max(len(lines)-1, 0))
+	}
+	best := -1
+	for i, line := range lines {
+		if !strings.HasPrefix(line, t.pattern) {
+			continue
+		}
+		if best < 0 || abs(i-t.line) < abs(best-t.line) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return min(max(t.line, 0), max(len(lines)-1, 0))
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// fileLines returns a file's lines, the buffer's when it's the open file
+func (e *Editor) fileLines(file string) []string {
+	if sameFile(file, e.filename) {
+		return e.lines
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+}
+
+// wordAtCursor returns the word the cursor is in or just after
+func (e *Editor) wordAtCursor() string {
+	line := e.lines[e.cursorLine]
+	start, _ := e.wordBeforeCursor()
+	end := min(e.cursorCol, len(line))
+	for end < len(line) && isWordByte(line[end]) {
+		end++
+	}
+	return line[start:end]
+}
+
+// tagCommand jumps to the definition of a name, by default the word under
+// the cursor, as the tags file lists it. When there are several it lists
+// them in the panel to pick from.
+func (e *Editor) tagCommand(args []string) {
+	name := e.wordAtCursor()
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" {
+		e.message = "No word under the cursor"
+		return
+	}
+	path, ok := findTagsFile(e.filename)
+	if !ok {
+		e.message = "No tags file found; tags-regenerate makes one"
+		return
+	}
+	f, err := loadTags(path)
+	if err != nil {
+		e.message = "Tags: " + err.Error()
+		return
+	}
+	tags := f.tags[name]
+	if len(tags) == 0 {
+		e.message = "No tag for " + name
+		return
+	}
+
+	p := &panel{title: "Definitions of " + name}
+	for _, t := range tags {
+		lines := e.fileLines(t.file)
+		line := tagLine(t, lines)
+		col, text := 0, t.pattern
+		if line < len(lines) {
+			col, text = max(strings.Index(lines[line], name), 0), lines[line]
+		}
+		label := fmt.Sprintf("%s:%d: %s", relativePath(t.file), line+1, strings.TrimSpace(text))
+		if t.kind != "" {
+			label = fmt.Sprintf("%s:%d: [%s] %s", relativePath(t.file), line+1, t.kind, strings.TrimSpace(text))
+		}
+		p.items = append(p.items, panelItem{text: label, file: t.file, line: line, col: col})
+	}
+	e.pushJump()
+	if len(p.items) == 1 {
+		item := p.items[0]
+		e.jumpTo(item.file, item.line, item.col)
+		return
+	}
+	e.message = fmt.Sprintf("%d definition(s) of %s", len(p.items), name)
+	e.showPanel(p)
+}
+
+// regenerateTags runs ctags over the project in the background, writing
+// the tags file next to the current one or at the workspace root
+func (e *Editor) regenerateTags() {
+	ctags, err := exec.LookPath("ctags")
+	if err != nil {
+		e.message = "ctags isn't installed"
+		return
+	}
+	path, ok := findTagsFile(e.filename)
+	if !ok {
+		dir, _ := os.Getwd()
+		if e.filename != "" {
+			dir = workspaceRoot(e.filename)
+		}
+		path = filepath.Join(dir, "tags")
+	}
+	dir := filepath.Dir(path)
+	e.message = "Running ctags in " + relativePath(dir)
+
+	screen := e.screen
+	go func() {
+		cmd := exec.Command(ctags, "-R", "--fields=+n", "-f", "tags", ".")
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		postFuncEvent(screen, func(e *Editor) {
+			delete(tagFiles, path)
+			if err != nil {
+				e.message = "ctags: " + err.Error()
+				if line := firstLine(string(out)); line != "" {
+					e.message = "ctags: " + line
+				}
+				return
+			}
+			f, err := loadTags(path)
+			if err != nil {
+				e.message = "Tags: " + err.Error()
+				return
+			}
+			count := 0
+			for _, tags := range f.tags {
+				count += len(tags)
+			}
+			e.message = fmt.Sprintf("Wrote %d tag(s) to %s", count, relativePath(path))
+		})
+	}()
+}
+
+// ----------------- JUMP STACK -----------------
+
+// maxJumps bounds how many jumps back are remembered
+const maxJumps = 100
+
+// jumpPoint is where a jump to a definition was made from
+type jumpPoint struct {
+	file      string
+	line, col int
+}
+
+// pushJump remembers the cursor's position before a jump to a definition
+func (e *Editor) pushJump() {
+	e.jumps = append(e.jumps, jumpPoint{file: e.filename, line: e.cursorLine, col: e.cursorCol})
+	if len(e.jumps) > maxJumps {
+		e.jumps = e.jumps[len(e.jumps)-maxJumps:]
+	}
+}
+
+// jumpBack returns to where the last jump to a definition was made from,
+// passing over any that would leave the cursor where it is
+func (e *Editor) jumpBack() {
+	for len(e.jumps) > 0 {
+		p := e.jumps[len(e.jumps)-1]
+		here := (p.file == e.filename || sameFile(p.file, e.filename)) && p.line == e.cursorLine && p.col == e.cursorCol
+		if !here {
+			if e.jumpTo(p.file, p.line, p.col) {
+				e.jumps = e.jumps[:len(e.jumps)-1]
+			}
+			return
+		}
+		e.jumps = e.jumps[:len(e.jumps)-1]
+	}
+	e.message = "No jumps to go back to"
+}
+
+// jumpTo moves the cursor to a position in a file, opening it if it isn't
+// the buffer's
+func (e *Editor) jumpTo(file string, line, col int) bool {
+	if file != e.filename && !e.visitFile(file) {
+		return false
+	}
+	e.cursorLine = min(max(line, 0), len(e.lines)-1)
+	e.cursorCol = min(max(col, 0), len(e.lines[e.cursorLine]))
+	e.updateCursorVisualCol()
+	e.adjustScroll()
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+// ----------------- UNDO -----------------
+
+// maxUndo caps how many steps can be undone
+const maxUndo = 200
+
+// maxUndoLines caps how many lines the history holds over all its steps;
+// the latest step is kept whatever its size
+const maxUndoLines = 1 << 20
+
+// undoState takes the buffer back to how it was before an edit: the lines
+// from start up to tail lines from the end are replaced with lines. Only
+// the lines that changed are kept, so big buffers don't fill the history.
+type undoState struct {
+	start, tail           int
+	lines                 []string
+	cursorLine, cursorCol int
+}
+
+// Undo groups: consecutive edits of the same group are undone together
+const (
+	undoStep     = ""
+	undoTyping   = "typing"
+	undoDeleting = "deleting"
+)
+
+// diffState is the step taking lines back to before: what lies between
+// their common first and last lines
+func diffState(before, lines []string, cursorLine, cursorCol int) (undoState, bool) {
+	start := 0
+	for start < len(before) && start < len(lines) && before[start] == lines[start] {
+		start++
+	}
+	tail := 0
+	for tail < len(before)-start && tail < len(lines)-start && before[len(before)-1-tail] == lines[len(lines)-1-tail] {
+		tail++
+	}
+	if start == len(before) && start == len(lines) {
+		return undoState{}, false
+	}
+	changed := append([]string(nil), before[start:len(before)-tail]...)
+	return undoState{start: start, tail: tail, lines: changed, cursorLine: cursorLine, cursorCol: cursorCol}, true
+}
+
+// recordUndo saves the buffer before an edit. Edits in the same group as
+// the one before (a run of typing, say) share its step; undoStep always
+// starts a new one.
+func (e *Editor) recordUndo(group string) {
+	if group != undoStep && group == e.undoGroup {
+		return
+	}
+	e.closeUndoStep()
+	e.undoGroup = group
+	e.undoBase = append([]string(nil), e.lines...)
+	e.undoCursor = [2]int{e.cursorLine, e.cursorCol}
+	e.redoStack = nil
+}
+
+// closeUndoStep turns the buffer saved by recordUndo into a step holding
+// just what the edits since changed
+func (e *Editor) closeUndoStep() {
+	if e.undoBase == nil {
+		return
+	}
+	state, changed := diffState(e.undoBase, e.lines, e.undoCursor[0], e.undoCursor[1])
+	e.undoBase = nil
+	if !changed {
+		return
+	}
+	e.undoStack = append(e.undoStack, state)
+	held := 0
+	for _, s := range e.undoStack {
+		held += len(s.lines)
+	}
+	drop := max(len(e.undoStack)-maxUndo, 0)
+	for ; drop < len(e.undoStack)-1 && held > maxUndoLines; drop++ {
+		held -= len(e.undoStack[drop].lines)
+	}
+	e.undoStack = e.undoStack[drop:]
+}
+
+// clearUndo forgets the history, as when another file is opened
+func (e *Editor) clearUndo() {
+	e.undoStack, e.redoStack, e.undoBase = nil, nil, nil
+	e.undoGroup = undoStep
+}
+
+// breakUndoGroup makes the next edit a step of its own, e.g. after the
+// cursor moved
+func (e *Editor) breakUndoGroup() {
+	e.undoGroup = undoStep
+}
+
+// undo and redo apply the top of one stack, saving what it replaced on the other
+func (e *Editor) undo() {
+	e.closeUndoStep()
+	e.restore(&e.undoStack, &e.redoStack, "Nothing to undo")
+}
+
+func (e *Editor) redo() {
+	e.closeUndoStep()
+	e.restore(&e.redoStack, &e.undoStack, "Nothing to redo")
+}
+
+func (e *Editor) restore(from, to *[]undoState, empty string) {
+	if len(*from) == 0 {
+		e.message = empty
+		return
+	}
+	state := (*from)[len(*from)-1]
+	*from = (*from)[:len(*from)-1]
+	end := len(e.lines) - state.tail
+	if state.start > end {
+		// The buffer was changed outside the history
+		e.clearUndo()
+		e.message = "Can't undo: the buffer changed"
+		return
+	}
+	*to = append(*to, undoState{
+		start: state.start, tail: state.tail,
+		lines:      append([]string(nil), e.lines[state.start:end]...),
+		cursorLine: e.cursorLine, cursorCol: e.cursorCol,
+	})
+
+	lines := make([]string, 0, state.start+len(state.lines)+state.tail)
+	lines = append(append(append(lines, e.lines[:state.start]...), state.lines...), e.lines[end:]...)
+	e.lines = lines
+	e.cursorLine, e.cursorCol = min(state.cursorLine, len(e.lines)-1), state.cursorCol
+	e.breakUndoGroup()
+	e.afterBulkEdit()
+	e.adjustScroll()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func newUndoEditor(t *testing.T, lines []string) *Editor {
+	s := tcell.NewSimulationScreen("")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Fini)
+	s.SetSize(80, 24)
+	e := &Editor{screen: s, lines: lines}
+	e.updateSyntaxHighlighting()
+	return e
+}
+
+func TestUndoRedo(t *testing.T) {
+	e := newUndoEditor(t, []string{"a", "b", "c"})
+	states := [][]string{{"a", "b", "c"}}
+	edit := func(group string, change func()) {
+		e.recordUndo(group)
+		change()
+		states = append(states, append([]string(nil), e.lines...))
+	}
+	edit(undoStep, func() { e.lines[1] = "B" })
+	edit(undoStep, func() { e.lines = append(e.lines, "d", "e") })
+	edit(undoStep, func() { e.lines = []string{"a", "e"} })
+	// A run of typing is one step
+	edit(undoTyping, func() { e.lines[0] = "ax" })
+	e.recordUndo(undoTyping)
+	e.lines[0] = "axy"
+	states[len(states)-1] = []string{"axy", "e"}
+
+	for i := len(states) - 2; i >= 0; i-- {
+		e.undo()
+		if !reflect.DeepEqual(e.lines, states[i]) {
+			t.Fatalf("undo to state %d gave %q, want %q", i, e.lines, states[i])
+		}
+	}
+	e.undo()
+	if e.message != "Nothing to undo" {
+		t.Errorf("undo past the start said %q", e.message)
+	}
+	for i := 1; i < len(states); i++ {
+		e.redo()
+		if !reflect.DeepEqual(e.lines, states[i]) {
+			t.Fatalf("redo to state %d gave %q, want %q", i, e.lines, states[i])
+		}
+	}
+}
+
+// TestUndoHoldsChangedLines checks that steps in a big buffer keep only the
+// lines they changed, and that the history is capped by lines held
+func TestUndoHoldsChangedLines(t *testing.T) {
+	lines := make([]string, 100000)
+	for i := range lines {
+		lines[i] = fmt.Sprint(i)
+	}
+	e := newUndoEditor(t, lines)
+	for i := 0; i < maxUndo+10; i++ {
+		e.recordUndo(undoStep)
+		e.lines[i*10] = "edited"
+	}
+	e.closeUndoStep()
+	if len(e.undoStack) != maxUndo {
+		t.Errorf("history has %d step(s), want %d", len(e.undoStack), maxUndo)
+	}
+	for _, s := range e.undoStack {
+		if len(s.lines) != 1 {
+			t.Fatalf("a one-line edit's step holds %d line(s)", len(s.lines))
+		}
+	}
+
+	// Replacing the whole buffer is one big step; more than maxUndoLines of
+	// them leave only what fits, and always the latest
+	for i := 0; i < maxUndoLines/len(lines)+2; i++ {
+		e.recordUndo(undoStep)
+		e.lines = append([]string(nil), e.lines...)
+		for j := range e.lines {
+			e.lines[j] = fmt.Sprint(i, j)
+		}
+	}
+	e.closeUndoStep()
+	held := 0
+	for _, s := range e.undoStack {
+		held += len(s.lines)
+	}
+	if held > maxUndoLines || len(e.undoStack) == 0 {
+		t.Errorf("history holds %d line(s) in %d step(s), want at most %d", held, len(e.undoStack), maxUndoLines)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ----------------- WHITESPACE -----------------
+
+// tabWidth is how many columns a tab advances to, as drawn by expandTabs
+const tabWidth = 4
+
+// drawWhitespace draws glyphs over the tabs, spaces and carriage returns of
+// a drawn line, with trailing whitespace set apart; x is where the line's
+// text starts on screen
+func (e *Editor) drawWhitespace(lineIdx, x, y, maxWidth int) {
+	line := e.lines[lineIdx]
+	glyphs := options.WhitespaceGlyphs
+	bg := tcell.NewRGBColor(15, 20, 30)
+	fg := themeColor(options.Theme.Whitespace, tcell.NewRGBColor(60, 70, 85))
+	style := tcell.StyleDefault.Background(bg).Foreground(fg)
+	trailingStyle := tcell.StyleDefault.Background(themeColor(options.Theme.TrailingWhitespace, tcell.NewRGBColor(120, 40, 40))).Foreground(tcell.NewRGBColor(220, 220, 230))
+
+	// A CRLF line's carriage return isn't trailing whitespace
+	trailing := len(strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t"))
+
+	set := func(col int, r rune, s tcell.Style) {
+		if col -= e.horizOffset; col >= 0 && col < maxWidth {
+			e.screen.SetContent(x+col, y, r, nil, s)
+		}
+	}
+	vis := 0
+	for i := 0; i < len(line); i++ {
+		width := 1
+		if line[i] == '\t' {
+			width = tabWidth - vis%tabWidth
+		}
+		s := style
+		if i >= trailing && line[i] != '\r' {
+			s = trailingStyle
+		}
+		switch line[i] {
+		case ' ':
+			if i >= trailing {
+				set(vis, glyph(glyphs.Trailing, '·'), s)
+			} else {
+				set(vis, glyph(glyphs.Space, '·'), s)
+			}
+		case '\t':
+			set(vis, glyph(glyphs.Tab, '→'), s)
+			for k := 1; k < width; k++ {
+				set(vis+k, ' ', s)
+			}
+		case '\r':
+			set(vis, glyph(glyphs.CR, '␍'), s)
+		}
+		vis += width
+	}
+}
+
+// toggleWhitespace handles the whitespace command: on, off or a toggle
+func (e *Editor) toggleWhitespace(args []string) {
+	switch {
+	case len(args) == 0:
+		e.showWhitespace = !e.showWhitespace
+	case args[0] == "on":
+		e.showWhitespace = true
+	case args[0] == "off":
+		e.showWhitespace = false
+	default:
+		e.message = "Usage: whitespace [on|off]"
+		return
+	}
+	if e.showWhitespace {
+		e.message = "Whitespace shown"
+	} else {
+		e.message = "Whitespace hidden"
+	}
+}
+
+// trimTrailingWhitespace strips spaces and tabs from the ends of lines,
+// keeping CRLF line endings, and returns how many lines changed
+func (e *Editor) trimTrailingWhitespace() int {
+	changed := 0
+	for i, line := range e.lines {
+		cr := strings.HasSuffix(line, "\r")
+		trimmed := strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t")
+		if cr {
+			trimmed += "\r"
+		}
+		if trimmed != line {
+			if changed == 0 {
+				e.recordUndo(undoStep)
+			}
+			e.lines[i] = trimmed
+			changed++
+		}
+	}
+	if changed > 0 {
+		e.afterBulkEdit()
+	}
+	return changed
+}
+
+// reindent rewrites each line's leading whitespace as tabs or as spaces,
+// keeping its width with tabs counted as width columns
+func (e *Editor) reindent(toTabs bool, width int) int {
+	changed := 0
+	for i, line := range e.lines {
+		body := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(body)]
+		cols := 0
+		for _, ch := range indent {
+			if ch == '\t' {
+				cols += width - cols%width
+			} else {
+				cols++
+			}
+		}
+		var rebuilt string
+		if toTabs {
+			rebuilt = strings.Repeat("\t", cols/width) + strings.Repeat(" ", cols%width)
+		} else {
+			rebuilt = strings.Repeat(" ", cols)
+		}
+		if rebuilt != indent {
+			if changed == 0 {
+				e.recordUndo(undoStep)
+			}
+			e.lines[i] = rebuilt + body
+			changed++
+		}
+	}
+	if changed > 0 {
+		e.afterBulkEdit()
+	}
+	return changed
+}
+
+// reindentCommand handles retab and untab, which take an optional tab width
+func (e *Editor) reindentCommand(toTabs bool, args []string) {
+	width := tabWidth
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			e.message = "Invalid tab width: " + args[0]
+			return
+		}
+		width = n
+	}
+	n := e.reindent(toTabs, width)
+	e.message = fmt.Sprintf("Reindented %d line(s)", n)
+}
+
+// afterBulkEdit tidies up after a command rewrote lines throughout the buffer
+func (e *Editor) afterBulkEdit() {
+	e.dirty = true
+	e.fixCursorCol()
+	e.updateSyntaxHighlighting()
+}